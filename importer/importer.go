@@ -0,0 +1,133 @@
+package main
+
+import (
+	"archive/zip"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/17xande/gowiki/models"
+)
+
+func main() {
+	files := flag.String("files", "", "import the Markdown and HTML files in a directory or a zip")
+	mediawiki := flag.String("mediawiki", "", "import the articles of a MediaWiki XML dump")
+	folder := flag.String("folder", "", "folder for the imported pages, named after the directory, zip or wiki if empty")
+	level := flag.Int("level", 0, "level of the imported documents and new folders")
+	author := flag.String("author", "", "email address of the user the documents are imported by")
+	apply := flag.Bool("apply", false, "save the import, without it only a dry run report is shown")
+	flag.Parse()
+
+	if (*files == "") == (*mediawiki == "") {
+		fmt.Println("Choose one of -files or -mediawiki to import. Options:")
+		flag.PrintDefaults()
+		return
+	}
+
+	cfg := &models.Config{}
+	if !cfg.Load() {
+		fmt.Println("Could not load config.toml, run the importer from the project directory.")
+		return
+	}
+
+	db, err := models.NewDB(cfg.Databases["app"])
+	if err != nil {
+		fmt.Println("Could not connect to the app database:\n", err)
+		return
+	}
+	defer db.Close()
+
+	models.LoggerInit(db)
+
+	opts := models.ImportOptions{Folder: *folder, Level: *level, Apply: *apply}
+	if *author != "" {
+		opts.Author, err = models.FindUserByEmail(db, *author)
+		if err != nil {
+			fmt.Println("Could not find the author "+*author+":\n", err)
+			return
+		}
+	} else if *apply {
+		fmt.Println("An import needs an -author to be applied.")
+		return
+	}
+
+	var report *models.ImportReport
+	if *files != "" {
+		if opts.Folder == "" {
+			opts.Folder = strings.TrimSuffix(filepath.Base(*files), filepath.Ext(*files))
+		}
+
+		var source fs.FS
+		if strings.ToLower(filepath.Ext(*files)) == ".zip" {
+			z, err := zip.OpenReader(*files)
+			if err != nil {
+				fmt.Println("Could not open "+*files+":\n", err)
+				return
+			}
+			defer z.Close()
+			source = z
+		} else {
+			source = os.DirFS(*files)
+		}
+
+		fmt.Println("Importing files from " + *files + "...")
+		report, err = models.ImportFiles(db, source, opts)
+	} else {
+		var dump *os.File
+		dump, err = os.Open(*mediawiki)
+		if err != nil {
+			fmt.Println("Could not open "+*mediawiki+":\n", err)
+			return
+		}
+		defer dump.Close()
+
+		fmt.Println("Importing wiki pages from " + *mediawiki + "...")
+		report, err = models.ImportMediaWiki(db, dump, opts)
+	}
+	if err != nil {
+		fmt.Println("Error importing:\n", err)
+		if report != nil && report.Applied && report.Imported() > 0 {
+			// the documents that were created stay, running the import again skips them
+			fmt.Println("The import stopped part way, only these pages were imported:")
+			printReport(report)
+		}
+		return
+	}
+
+	printReport(report)
+}
+
+func printReport(report *models.ImportReport) {
+	for _, f := range report.Folders {
+		state := "new"
+		if f.Exists {
+			state = "existing"
+		}
+		fmt.Printf("Folder %q (%s)\n", f.Name, state)
+	}
+
+	for _, d := range report.Documents {
+		if d.Skipped != "" {
+			fmt.Printf("  skip   %s: %s\n", d.Source, d.Skipped)
+			continue
+		}
+		fmt.Printf("  import %s as %q in %q, %d revisions, %d images", d.Source, d.Title, d.Folder, d.Revisions, d.Images)
+		if len(d.Authors) > 0 {
+			fmt.Printf(", by %s", strings.Join(d.Authors, ", "))
+		}
+		fmt.Println()
+	}
+
+	for _, warning := range report.Warnings {
+		fmt.Println("Warning: " + warning)
+	}
+
+	if report.Applied {
+		fmt.Printf("Imported %d of %d pages.\n", report.Imported(), len(report.Documents))
+	} else {
+		fmt.Printf("Dry run: %d of %d pages would be imported. Run again with -apply to import them.\n", report.Imported(), len(report.Documents))
+	}
+}
@@ -43,6 +43,7 @@ func main() {
 	}
 
 	models.LoggerInit(db)
+	models.MailInit(cfg.Mail)
 
 	mux := mux.NewRouter()
 	mux.HandleFunc("/", models.IndexHandler(db, rend)).Methods("GET")
@@ -51,17 +52,77 @@ func main() {
 	mux.HandleFunc("/logout", models.UserLogoutHandler).Methods("GET")
 	mux.HandleFunc("/document/view/{id}", models.ViewHandler(db, rend)).Methods("GET")
 	mux.HandleFunc("/document/edit/{id}", models.EditHandler(db, rend)).Methods("GET")
+	mux.HandleFunc("/document/edit/", models.EditHandler(db, rend)).Methods("GET")
 	mux.HandleFunc("/save/{id}", models.SaveHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/save/", models.SaveHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/document/review/{id}", models.ReviewHandler(db, rend)).Methods("GET")
+	mux.HandleFunc("/document/review/{id}", models.ReviewSaveHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/document/archive/{id}", models.ArchiveHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/document/collab/{id}", models.CollabHandler(db, rend)).Methods("GET")
+	mux.HandleFunc("/document/lock/{id}", models.LockHeartbeatHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/document/unlock/{id}", models.LockBreakHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/document/comment/{id}", models.CommentHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/comment/reply/{id}", models.CommentReplyHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/comment/resolve/{id}", models.CommentResolveHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/watch/{kind}/{id}", models.WatchHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/star/{kind}/{id}", models.StarHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/code-style", models.CodeStyleHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/notifications/", models.NotificationsHandler(db, rend)).Methods("GET")
+	mux.HandleFunc("/notifications/recent", models.RecentNotificationsHandler(db, rend)).Methods("GET")
+	mux.HandleFunc("/notifications/open/{id}", models.NotificationOpenHandler(db, rend)).Methods("GET")
+	mux.HandleFunc("/notifications/read", models.NotificationsReadHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/notifications/digest", models.DigestSettingsHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/digest/unsubscribe/{token}", models.DigestUnsubscribeHandler(db, rend)).Methods("GET", "POST")
+	mux.HandleFunc("/switcher", models.QuickSwitchHandler(db, rend)).Methods("GET")
+	mux.HandleFunc("/browse/", models.BrowseHandler(db, rend)).Methods("GET")
+	mux.HandleFunc("/browse/save", models.SavedSearchSaveHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/browse/pin/{id}", models.SavedSearchPinHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/browse/delete/{id}", models.SavedSearchDeleteHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/search/", models.SearchHandler(db, rend)).Methods("GET")
+	mux.HandleFunc("/tags/", models.TagsHandler(db, rend)).Methods("GET")
+	mux.HandleFunc("/tags/suggest", models.TagSuggestHandler(db, rend)).Methods("GET")
+	mux.HandleFunc("/tags/rename/{tag}", models.TagRenameHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/tags/{tag}", models.TagHandler(db, rend)).Methods("GET")
+	mux.HandleFunc("/reviews/", models.ReviewsHandler(db, rend)).Methods("GET")
+	mux.HandleFunc("/document/verify/{id}", models.VerifyHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/document/acknowledge/{id}", models.AcknowledgeHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/document/acknowledgements/{id}", models.AckReportHandler(db, rend)).Methods("GET")
+	mux.HandleFunc("/document/acknowledgements/{id}", models.AckRequireHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/verification/", models.VerificationHandler(db, rend)).Methods("GET")
+	mux.HandleFunc("/document/export/{id}", models.DocumentExportHandler(db, rend)).Methods("GET")
+	mux.HandleFunc("/document/shares/{id}", models.DocumentSharesHandler(db, rend)).Methods("GET")
+	mux.HandleFunc("/document/shares/{id}", models.ShareCreateHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/document/shares/revoke/{id}", models.ShareRevokeHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/share/{token}", models.ShareViewHandler(db, rend)).Methods("GET", "POST")
+	mux.HandleFunc("/share/{token}/attachment/{id}", models.ShareAttachmentHandler(db)).Methods("GET")
+	mux.HandleFunc("/document/delete/{id}", models.DocumentDeleteHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/attachment/upload", models.AttachmentUploadHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/attachment/{id}", models.AttachmentHandler(db, false)).Methods("GET")
+	mux.HandleFunc("/attachment/thumb/{id}", models.AttachmentHandler(db, true)).Methods("GET")
 	mux.HandleFunc("/users/", models.UserHandler(db, rend)).Methods("GET")
 	mux.HandleFunc("/user/edit/{id}", models.UserEditHandler(db, rend)).Methods("GET")
 	mux.HandleFunc("/user/save/{id}", models.UserSaveHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/user/delete/{id}", models.UserDeleteHandler(db, rend)).Methods("POST")
 	mux.HandleFunc("/folders/", models.FoldersHandler(db, rend)).Methods("GET")
 	mux.HandleFunc("/folder/view/{id}", models.FolderHandler(db, rend)).Methods("GET")
 	mux.HandleFunc("/folder/edit/{id}", models.FolderEditHandler(db, rend)).Methods("GET")
 	mux.HandleFunc("/folder/edit/", models.FolderEditHandler(db, rend)).Methods("GET")
 	mux.HandleFunc("/folder/save/{id}", models.FolderSaveHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/folder/bulk/{id}", models.FolderBulkHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/folder/export/{id}", models.FolderExportHandler(db, rend)).Methods("GET")
+	mux.HandleFunc("/folder/delete/{id}", models.FolderDeleteHandler(db, rend)).Methods("POST")
 	mux.HandleFunc("/folder/permissions/{id}", models.FolderPermissionsEditHandler(db, rend)).Methods("GET")
 	mux.HandleFunc("/folder/permissions/save/{id}", models.FolderPermissionsSaveHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/import/", models.ImportHandler(db, rend)).Methods("GET")
+	mux.HandleFunc("/import/", models.ImportUploadHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/import/apply", models.ImportApplyHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/trash/", models.TrashHandler(db, rend, cfg.Trash.RetentionDays)).Methods("GET")
+	mux.HandleFunc("/trash/restore/{kind}/{id}", models.TrashRestoreHandler(db, rend)).Methods("POST")
+	mux.HandleFunc("/trash/purge/{kind}/{id}", models.TrashPurgeHandler(db, rend)).Methods("POST")
+
+	go models.TrashPurger(db, cfg.Trash.RetentionDays)
+	go models.DigestMailer(db)
+	go models.VerificationReminder(db)
 
 	n := negroni.New()
 	recovery := negroni.NewRecovery()
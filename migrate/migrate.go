@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/17xande/gowiki/models"
+)
+
+func main() {
+	images := flag.Bool("images", false, "move base64 images embedded in document bodies into attachments")
+	templates := flag.Bool("templates", false, "create the default document templates")
+	deltas := flag.Bool("deltas", false, "store a Quill Delta for documents that only have an HTML body")
+	search := flag.Bool("search", false, "rebuild the search index from every document")
+	contributors := flag.Bool("contributors", false, "record the contributors of every document from its author and history of changes")
+	flag.Parse()
+
+	cfg := &models.Config{}
+	if !cfg.Load() {
+		fmt.Println("Could not load config.toml, run the migration from the project directory.")
+		return
+	}
+
+	db, err := models.NewDB(cfg.Databases["app"])
+	if err != nil {
+		fmt.Println("Could not connect to the app database:\n", err)
+		return
+	}
+	defer db.Close()
+
+	models.LoggerInit(db)
+
+	if !*images && !*templates && !*deltas && !*search && !*contributors {
+		fmt.Println("No migration selected. Available migrations:")
+		flag.PrintDefaults()
+		return
+	}
+
+	if *images {
+		fmt.Println("Extracting embedded images from documents...")
+		changed, err := models.ExtractDataURIImages(db)
+		if err != nil {
+			fmt.Println("Error extracting images:\n", err)
+			return
+		}
+		fmt.Printf("Extracted images from %d documents.\n", changed)
+	}
+
+	if *templates {
+		fmt.Println("Creating default document templates...")
+		created, err := models.SeedTemplates(db)
+		if err != nil {
+			fmt.Println("Error creating templates:\n", err)
+			return
+		}
+		fmt.Printf("Created %d templates.\n", created)
+	}
+
+	if *deltas {
+		fmt.Println("Converting document bodies to Deltas...")
+		changed, warnings, err := models.BackfillDeltas(db)
+		for _, warning := range warnings {
+			fmt.Println("Warning: " + warning)
+		}
+		if err != nil {
+			fmt.Println("Error converting documents:\n", err)
+			return
+		}
+		fmt.Printf("Converted %d documents.\n", changed)
+	}
+
+	if *search {
+		fmt.Println("Rebuilding the search index...")
+		indexed, err := models.RebuildSearchIndex(db)
+		if err != nil {
+			fmt.Println("Error rebuilding the search index:\n", err)
+			return
+		}
+		fmt.Printf("Indexed %d documents.\n", indexed)
+	}
+
+	if *contributors {
+		fmt.Println("Recording document contributors...")
+		changed, err := models.BackfillContributors(db)
+		if err != nil {
+			fmt.Println("Error recording contributors:\n", err)
+			return
+		}
+		fmt.Printf("Recorded contributors of %d documents.\n", changed)
+	}
+}
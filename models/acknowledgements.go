@@ -0,0 +1,285 @@
+package models
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/unrolled/render"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Acknowledgement records that a user read a published version of a document
+type Acknowledgement struct {
+	ID         bson.ObjectId `json:"id" bson:"_id"`
+	DocumentID bson.ObjectId `json:"documentID" bson:"documentID"`
+	UserID     bson.ObjectId `json:"userID" bson:"userID"`
+	Version    int           `json:"version" bson:"version"`
+	// Revision is the revision of the document when it was acknowledged
+	Revision int       `json:"revision" bson:"revision"`
+	Created  time.Time `json:"created"`
+}
+
+// AckStatus is whether one reader acknowledged a document, for the acknowledgement report
+type AckStatus struct {
+	User User
+	// Latest is the latest version the user acknowledged, nil if they never did
+	Latest *Acknowledgement
+}
+
+const ackCol = "acknowledgements"
+
+// AckRequireHandler lets admins mark a document as needing to be acknowledged by its readers, or not
+func AckRequireHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		if !user.Admin {
+			InfoLogger.Print("User tried to change acknowledgements without permission: {userID: " + user.ID.Hex() + ", documentID: " + id + "}")
+			s.AddFlash("Sorry, but only admins can ask readers to acknowledge a document", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		d, err := loadPage(db, id)
+		if err != nil {
+			s.AddFlash("That document doesn't exist", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		required := r.FormValue("required") == "1"
+		err = d.setRequiresAck(db, required)
+		if err != nil {
+			ErrorLogger.Print("Could not change acknowledgements of document {id: "+id+"} ", err)
+			s.AddFlash("Error! Could not change the document. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		InfoLogger.Print("Document acknowledgement changed {id: " + id + ", required: " + strconv.FormatBool(required) + ", userID: " + user.ID.Hex() + "}")
+		if required {
+			s.AddFlash("Everyone who can read \""+d.Title+"\" will be asked to acknowledge it", "success")
+		} else {
+			s.AddFlash("Readers of \""+d.Title+"\" aren't asked to acknowledge it anymore", "success")
+		}
+		s.Save(r, w)
+		http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+	}
+}
+
+// AcknowledgeHandler records that the user read the current version of a document
+func AcknowledgeHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		d, err := loadPage(db, id)
+		if err != nil || !d.RequiresAck || !d.isPublished() || !d.visibleTo(db, user) {
+			s.AddFlash("Sorry, but you can't acknowledge that document", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		// a new version may have been published while the user was reading
+		version, _ := strconv.Atoi(r.FormValue("version"))
+		if version != d.Version {
+			s.AddFlash("A new version of this document was published while you were reading it. Please read it before acknowledging it.", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		err = acknowledge(db, d, user.ID)
+		if err != nil {
+			ErrorLogger.Print("Could not acknowledge document {id: "+id+", userID: "+user.ID.Hex()+"} ", err)
+			s.AddFlash("Error! Could not save your acknowledgement. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		InfoLogger.Print("Document acknowledged {id: " + id + ", version: " + strconv.Itoa(d.Version) + ", revision: " + strconv.Itoa(d.Revision) + ", userID: " + user.ID.Hex() + "}")
+		s.AddFlash("Thanks for reading \""+d.Title+"\"", "success")
+		s.Save(r, w)
+		http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+	}
+}
+
+// AckReportHandler shows who has and hasn't acknowledged the current version of a document
+func AckReportHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		d, err := loadPage(db, id)
+		if err != nil || !d.canSeeAcks(db, user) {
+			s.AddFlash("Sorry, but you can't see who acknowledged that document", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		readers, err := findAckStatuses(db, d)
+		if err != nil {
+			ErrorLogger.Print("Could not find acknowledgements of document {id: "+id+"} ", err)
+			s.AddFlash("Looks like something went wrong. If this error persists, please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		var pending, done []AckStatus
+		for _, rs := range readers {
+			if rs.Latest != nil && rs.Latest.Version == d.Version {
+				done = append(done, rs)
+			} else {
+				pending = append(pending, rs)
+			}
+		}
+
+		data := map[string]interface{}{
+			"user":     user,
+			"document": d,
+			"readers":  readers,
+			"pending":  pending,
+			"done":     done,
+		}
+
+		RenderTemplate(rend, w, r, "document/acknowledgements", data)
+	}
+}
+
+// canSeeAcks checks if the user may see the acknowledgement report of the document
+func (d *Document) canSeeAcks(db *DB, user *User) bool {
+	return user.Admin || (d.visibleTo(db, user) && d.canReview(db, user))
+}
+
+func (d *Document) setRequiresAck(db *DB, required bool) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(documentCol)
+
+	if !required {
+		return collection.UpdateId(d.ID, bson.M{"$unset": bson.M{"requiresAck": ""}})
+	}
+	return collection.UpdateId(d.ID, bson.M{"$set": bson.M{"requiresAck": true}})
+}
+
+// acknowledge records that the user read the current version of the document, once per version
+func acknowledge(db *DB, d *Document, userID bson.ObjectId) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(ackCol)
+
+	_, err := collection.Upsert(bson.M{"documentID": d.ID, "userID": userID, "version": d.Version}, bson.M{
+		"$setOnInsert": bson.M{"_id": bson.NewObjectId(), "revision": d.Revision, "created": time.Now()},
+	})
+	return err
+}
+
+// findAcknowledgement finds the user's acknowledgement of the current version of the document, nil if there is none
+func findAcknowledgement(db *DB, d *Document, userID bson.ObjectId) (*Acknowledgement, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(ackCol)
+
+	ack := &Acknowledgement{}
+	err := collection.Find(bson.M{"documentID": d.ID, "userID": userID, "version": d.Version}).One(ack)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ack, nil
+}
+
+// findAckStatuses finds every user that can read the document, with the latest version they acknowledged
+func findAckStatuses(db *DB, d *Document) ([]AckStatus, error) {
+	users, err := findAllUsers(db)
+	if err != nil {
+		return nil, err
+	}
+
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(ackCol)
+
+	var acks []Acknowledgement
+	err = collection.Find(bson.M{"documentID": d.ID}).Sort("version").All(&acks)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := map[bson.ObjectId]*Acknowledgement{}
+	for i := range acks {
+		latest[acks[i].UserID] = &acks[i]
+	}
+
+	var statuses []AckStatus
+	for _, u := range *users {
+		if u.Deleted || u.Tech || !d.visibleTo(db, &u) {
+			continue
+		}
+		statuses = append(statuses, AckStatus{User: u, Latest: latest[u.ID]})
+	}
+
+	return statuses, nil
+}
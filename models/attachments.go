@@ -0,0 +1,554 @@
+package models
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	// register the gif decoder for image.Decode
+	_ "image/gif"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/unrolled/render"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Attachment represents an encrypted file, like an image, that belongs to a document
+type Attachment struct {
+	ID          bson.ObjectId `json:"id" bson:"_id"`
+	DocumentID  bson.ObjectId `json:"documentID" bson:"documentID,omitempty"`
+	UploaderID  bson.ObjectId `json:"uploaderID" bson:"uploaderID,omitempty"`
+	ContentType string        `json:"contentType" bson:"contentType"`
+	Width       int           `json:"width"`
+	Height      int           `json:"height"`
+	Data        []byte        `json:"-"`
+	Thumb       []byte        `json:"-"`
+	Created     time.Time     `json:"created"`
+}
+
+const attachmentCol = "attachments"
+
+// maxAttachmentSize is the biggest image that can be uploaded, in bytes
+const maxAttachmentSize = 10 << 20
+
+// maxAttachmentPixels is the most pixels an image can have, small files can still decode to huge images
+const maxAttachmentPixels = 40000000
+
+// errImageTooLarge is returned for images with more than maxAttachmentPixels
+var errImageTooLarge = errors.New("Image is too large, it can have at most " + strconv.Itoa(maxAttachmentPixels/1000000) + " megapixels")
+
+// thumbSize is the maximum width or height of generated thumbnails
+const thumbSize = 200
+
+// attachmentRef finds attachment references in document bodies
+var attachmentRef = regexp.MustCompile(`/attachment/([0-9a-f]{24})`)
+
+// dataURIImage finds images embedded as base64 data URIs in document bodies
+var dataURIImage = regexp.MustCompile(`src="data:(image/[a-z+.-]+);base64,([^"]*)"`)
+
+// dataURI matches a base64 image data URI, like the source of an image embedded in a Delta
+var dataURI = regexp.MustCompile(`^data:(image/[a-z+.-]+);base64,(.*)$`)
+
+// AttachmentUploadHandler handles images pasted or dropped into the document editor
+func AttachmentUploadHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			http.Error(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize)
+		err := r.ParseMultipartForm(maxAttachmentSize)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			InfoLogger.Print("Image upload too large {userID: "+user.ID.Hex()+"} ", err)
+			http.Error(w, "Image is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			InfoLogger.Print("Image upload malformed {userID: "+user.ID.Hex()+"} ", err)
+			http.Error(w, "Could not read the upload", http.StatusBadRequest)
+			return
+		}
+
+		file, _, err := r.FormFile("image")
+		if err != nil {
+			http.Error(w, "No image uploaded", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		raw, err := ioutil.ReadAll(file)
+		if err != nil {
+			ErrorLogger.Print("Error reading uploaded image {userID: "+user.ID.Hex()+"} ", err)
+			http.Error(w, "Could not read image", http.StatusBadRequest)
+			return
+		}
+
+		a, err := newAttachment(raw, user.ID)
+		if err != nil {
+			InfoLogger.Print("Rejected image upload {userID: "+user.ID.Hex()+"} ", err)
+			status := http.StatusUnsupportedMediaType
+			if err == errImageTooLarge {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		// the image is only linked to a document the user may edit, otherwise it stays with its uploader
+		docID := r.FormValue("document-id")
+		if bson.IsObjectIdHex(docID) {
+			d, err := loadPage(db, docID)
+			if err == nil && d.canEdit(db, user) {
+				a.DocumentID = d.ID
+			}
+		}
+
+		err = a.save(db)
+		if err != nil {
+			ErrorLogger.Print("Could not save attachment {userID: "+user.ID.Hex()+"} ", err)
+			http.Error(w, "Could not save image", http.StatusInternalServerError)
+			return
+		}
+
+		InfoLogger.Print("Attachment uploaded {id: " + a.ID.Hex() + ", userID: " + user.ID.Hex() + "}")
+
+		rend.JSON(w, http.StatusOK, map[string]string{
+			"id":    a.ID.Hex(),
+			"url":   a.url(),
+			"thumb": a.thumbURL(),
+		})
+	}
+}
+
+// AttachmentHandler serves the decrypted attachment, or its thumbnail when thumb is true
+func AttachmentHandler(db *DB, thumb bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			http.Error(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		a, err := findAttachment(db, id)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		if !a.viewable(db, user) {
+			InfoLogger.Print("User tried to access restricted attachment: {userID: " + user.ID.Hex() + ", attachmentID: " + id + "}")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		ciphertext := a.Data
+		contentType := a.ContentType
+		if thumb {
+			ciphertext = a.Thumb
+			if contentType != "image/jpeg" {
+				contentType = "image/png"
+			}
+		}
+
+		data, err := decryptBytes(ciphertext)
+		if err != nil {
+			ErrorLogger.Print("Could not decrypt attachment {id: "+id+"} ", err)
+			http.Error(w, "Could not decrypt attachment", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+		w.Write(data)
+	}
+}
+
+// newAttachment decodes raw image data, generates its thumbnail and encrypts both
+func newAttachment(raw []byte, uploaderID bson.ObjectId) (*Attachment, error) {
+	// the size is checked before the image is decoded into memory
+	config, _, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return nil, errors.New("Unsupported image format")
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width > maxAttachmentPixels/config.Height {
+		return nil, errImageTooLarge
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, errors.New("Unsupported image format")
+	}
+
+	var thumb bytes.Buffer
+	t := thumbnail(img, thumbSize)
+	if format == "jpeg" {
+		err = jpeg.Encode(&thumb, t, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&thumb, t)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Attachment{
+		ID:          bson.NewObjectId(),
+		UploaderID:  uploaderID,
+		ContentType: "image/" + format,
+		Width:       img.Bounds().Dx(),
+		Height:      img.Bounds().Dy(),
+		Created:     time.Now(),
+	}
+
+	a.Data, err = encryptBytes(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	a.Thumb, err = encryptBytes(thumb.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *Attachment) save(db *DB) error {
+	session := db.sess.Clone()
+	defer session.Close()
+
+	collection := session.DB(db.name).C(attachmentCol)
+	_, err := collection.UpsertId(a.ID, a)
+	return err
+}
+
+func (a *Attachment) url() string {
+	return "/attachment/" + a.ID.Hex()
+}
+
+func (a *Attachment) thumbURL() string {
+	return "/attachment/thumb/" + a.ID.Hex()
+}
+
+// viewable checks if the user may see the attachment.
+// Attachments not yet linked to a document are only visible to their uploader.
+func (a *Attachment) viewable(db *DB, user *User) bool {
+	if a.DocumentID == "" {
+		return a.UploaderID == user.ID
+	}
+
+	d, err := loadPage(db, a.DocumentID.Hex())
+	if err != nil {
+		return a.UploaderID == user.ID
+	}
+
+	return d.visibleTo(db, user)
+}
+
+func findAttachment(db *DB, idHex string) (*Attachment, error) {
+	if !bson.IsObjectIdHex(idHex) {
+		return nil, errors.New("Invalid attachment id: " + idHex)
+	}
+
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(attachmentCol)
+	a := &Attachment{}
+
+	err := collection.FindId(bson.ObjectIdHex(idHex)).One(a)
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// findDocumentAttachments finds all the attachments linked to a document, without their data
+func findDocumentAttachments(db *DB, docID bson.ObjectId) (*[]Attachment, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(attachmentCol)
+	var attachments []Attachment
+
+	err := collection.Find(bson.M{"documentID": docID}).Select(bson.M{"data": 0, "thumb": 0}).Sort("created").All(&attachments)
+	if err != nil {
+		return nil, err
+	}
+
+	return &attachments, nil
+}
+
+// linkAttachments links the attachments referenced in the body to the document,
+// so that they inherit its access rules.
+func linkAttachments(db *DB, docID bson.ObjectId, body template.HTML) error {
+	var ids []bson.ObjectId
+	for _, m := range attachmentRef.FindAllStringSubmatch(string(body), -1) {
+		ids = append(ids, bson.ObjectIdHex(m[1]))
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(attachmentCol)
+
+	query := bson.M{
+		"_id":        bson.M{"$in": ids},
+		"documentID": bson.M{"$exists": false},
+	}
+	_, err := collection.UpdateAll(query, bson.M{"$set": bson.M{"documentID": docID}})
+
+	return err
+}
+
+// extractDataURIs stores every base64 data URI image found in body as an attachment
+// and returns the body with the images referenced by attachment ID instead.
+func extractDataURIs(db *DB, docID bson.ObjectId, uploaderID bson.ObjectId, body template.HTML) (template.HTML, int, error) {
+	var firstErr error
+	count := 0
+
+	replaced := dataURIImage.ReplaceAllStringFunc(string(body), func(match string) string {
+		m := dataURIImage.FindStringSubmatch(match)
+		a, err := storeDataURI(db, docID, uploaderID, m[2])
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return match
+		}
+
+		count++
+		return `src="` + a.url() + `"`
+	})
+
+	return template.HTML(replaced), count, firstErr
+}
+
+// extractDeltaImages stores every base64 data URI image embedded in the Delta as an attachment
+// and points the embeds at the attachments instead.
+func extractDeltaImages(db *DB, docID bson.ObjectId, uploaderID bson.ObjectId, delta *Delta) (int, error) {
+	var firstErr error
+	count := 0
+
+	for i, op := range delta.Ops {
+		embed, ok := op.Insert.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		src, _ := embed["image"].(string)
+		m := dataURI.FindStringSubmatch(src)
+		if m == nil {
+			continue
+		}
+
+		a, err := storeDataURI(db, docID, uploaderID, m[2])
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		delta.Ops[i].Insert = map[string]interface{}{"image": a.url()}
+		count++
+	}
+
+	return count, firstErr
+}
+
+// storeDataURI saves the base64 data of a data URI image as an attachment of the document
+func storeDataURI(db *DB, docID bson.ObjectId, uploaderID bson.ObjectId, data string) (*Attachment, error) {
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := newAttachment(raw, uploaderID)
+	if err != nil {
+		return nil, err
+	}
+
+	a.DocumentID = docID
+	err = a.save(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// ExtractDataURIImages moves the base64 images embedded in every document, its Delta and its draft
+// into attachments. It returns the number of documents that were changed.
+func ExtractDataURIImages(db *DB) (int, error) {
+	docs, err := findAllDocs(db)
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for i := range *docs {
+		d := &(*docs)[i]
+
+		count, err := extractContentImages(db, d)
+		if err != nil {
+			return changed, err
+		}
+		draftCount, err := extractDraftImages(db, d)
+		if err != nil {
+			return changed, err
+		}
+		count += draftCount
+		if count == 0 {
+			continue
+		}
+
+		err = d.save(db)
+		if err != nil {
+			return changed, err
+		}
+
+		changed++
+		InfoLogger.Print("Extracted " + strconv.Itoa(count) + " images from document {id: " + d.ID.Hex() + "}")
+	}
+
+	return changed, nil
+}
+
+// extractContentImages moves the base64 images of the published version into attachments.
+// The body is rendered again from the Delta, documents without one have their HTML body rewritten.
+// Only errors storing the document content are returned, the others are logged.
+func extractContentImages(db *DB, d *Document) (int, error) {
+	if len(d.Body) == 0 && len(d.Delta) == 0 {
+		return 0, nil
+	}
+
+	delta, err := decryptDelta(d.Delta)
+	if err != nil {
+		ErrorLogger.Print("Could not decrypt Delta during image migration {id: "+d.ID.Hex()+"} ", err)
+		return 0, nil
+	}
+
+	if delta != nil {
+		count, err := extractDeltaImages(db, d.ID, "", delta)
+		if err != nil {
+			ErrorLogger.Print("Could not extract all images from document {id: "+d.ID.Hex()+"} ", err)
+		}
+		if count == 0 {
+			return 0, nil
+		}
+
+		_, err = d.setContent(delta)
+		return count, err
+	}
+
+	body, err := d.decrypt()
+	if err != nil {
+		ErrorLogger.Print("Could not decrypt document during image migration {id: "+d.ID.Hex()+"} ", err)
+		return 0, nil
+	}
+
+	if !dataURIImage.MatchString(string(body)) {
+		return 0, nil
+	}
+
+	body, count, err := extractDataURIs(db, d.ID, "", body)
+	if err != nil {
+		ErrorLogger.Print("Could not extract all images from document {id: "+d.ID.Hex()+"} ", err)
+	}
+	if count == 0 {
+		return 0, nil
+	}
+
+	return count, d.encrypt(body)
+}
+
+// extractDraftImages moves the base64 images of the document's draft into attachments, like extractContentImages
+func extractDraftImages(db *DB, d *Document) (int, error) {
+	if d.Draft == nil || (len(d.Draft.Body) == 0 && len(d.Draft.Delta) == 0) {
+		return 0, nil
+	}
+
+	delta, err := decryptDelta(d.Draft.Delta)
+	if err != nil {
+		ErrorLogger.Print("Could not decrypt draft Delta during image migration {id: "+d.ID.Hex()+"} ", err)
+		return 0, nil
+	}
+
+	if delta != nil {
+		count, err := extractDeltaImages(db, d.ID, "", delta)
+		if err != nil {
+			ErrorLogger.Print("Could not extract all images from draft {id: "+d.ID.Hex()+"} ", err)
+		}
+		if count == 0 {
+			return 0, nil
+		}
+
+		d.Draft.Body, err = encryptBytes([]byte(renderDelta(delta)))
+		if err != nil {
+			return 0, err
+		}
+		d.Draft.Delta, err = encryptDelta(delta)
+		return count, err
+	}
+
+	body, err := d.draftBody()
+	if err != nil {
+		ErrorLogger.Print("Could not decrypt draft during image migration {id: "+d.ID.Hex()+"} ", err)
+		return 0, nil
+	}
+
+	if !dataURIImage.MatchString(string(body)) {
+		return 0, nil
+	}
+
+	body, count, err := extractDataURIs(db, d.ID, "", body)
+	if err != nil {
+		ErrorLogger.Print("Could not extract all images from draft {id: "+d.ID.Hex()+"} ", err)
+	}
+	if count == 0 {
+		return 0, nil
+	}
+
+	d.Draft.Body, err = encryptBytes([]byte(body))
+	return count, err
+}
@@ -0,0 +1,658 @@
+package models
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/unrolled/render"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// BrowseItem is a document in the document browser, with the details it can be filtered by
+type BrowseItem struct {
+	Document   *Document
+	Title      string
+	Status     string
+	FolderName string
+	AuthorName string
+	EditorName string
+	Edited     time.Time
+	Snippet    template.HTML
+	// Contributors are the names of the document's contributors, in the order of its ContributorIDs
+	Contributors []string
+	// PendingDraft is the status of the draft waiting on a published document
+	PendingDraft string
+}
+
+// Facet is one value of a browser filter, with the number of documents that have it
+type Facet struct {
+	Value  string
+	Label  string
+	Count  int
+	Active bool
+	URL    string
+}
+
+// FacetGroup is the facets of one filter
+type FacetGroup struct {
+	Name   string
+	Label  string
+	Facets []Facet
+}
+
+// SavedSearch is a document browser query that a user saved to come back to
+type SavedSearch struct {
+	ID      bson.ObjectId `json:"id" bson:"_id"`
+	UserID  bson.ObjectId `json:"userID" bson:"userID"`
+	Name    string        `json:"name"`
+	Query   string        `json:"query"`
+	Pinned  bool          `json:"pinned" bson:"pinned,omitempty"`
+	Created time.Time     `json:"created"`
+}
+
+const savedSearchCol = "savedSearches"
+
+// maxBrowseItems limits the number of documents listed at once
+const maxBrowseItems = 100
+
+// browseFacets are the filters that have facets, in the order they are shown
+var browseFacets = []string{"folder", "tag", "author", "editor", "contributor", "level", "status"}
+
+var facetTitles = map[string]string{
+	"folder":      "Folder",
+	"tag":         "Tag",
+	"author":      "Author",
+	"editor":      "Last Edited By",
+	"contributor": "Contributor",
+	"level":       "Level",
+	"status":      "Status",
+}
+
+// browseParams are all the query parameters the document browser understands
+var browseParams = []string{"q", "folder", "tag", "author", "editor", "contributor", "level", "status", "from", "to", "sort"}
+
+// browseFilter is a parsed document browser query
+type browseFilter struct {
+	values url.Values
+	from   time.Time
+	to     time.Time
+}
+
+// BrowseHandler lists the documents the user can see, narrowed down by the filters in the query
+func BrowseHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		f := parseBrowseFilter(r.URL.Query())
+
+		items, err := findBrowseItems(db, user, f.get("q"))
+		if err != nil {
+			ErrorLogger.Print("Could not find documents to browse {userID: "+user.ID.Hex()+"} ", err)
+			s.AddFlash("Looks like something went wrong. If this error persists, please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		var facets []FacetGroup
+		for _, name := range browseFacets {
+			facets = append(facets, FacetGroup{Name: name, Label: facetTitles[name], Facets: f.facet(items, name)})
+		}
+
+		var matches []BrowseItem
+		for _, item := range items {
+			if f.matches(item, "") {
+				matches = append(matches, item)
+			}
+		}
+		f.sort(matches)
+
+		total := len(matches)
+		if total > maxBrowseItems {
+			matches = matches[:maxBrowseItems]
+		}
+
+		saved, err := findSavedSearches(db, user.ID, false)
+		if err != nil {
+			ErrorLogger.Print("Could not find saved searches {userID: "+user.ID.Hex()+"} ", err)
+			err = nil
+		}
+
+		data := map[string]interface{}{
+			"user":    user,
+			"items":   matches,
+			"total":   total,
+			"facets":  facets,
+			"filter":  f.values,
+			"query":   f.get("q"),
+			"encoded": f.encode(),
+			"saved":   saved,
+			"page":    "browse",
+		}
+
+		RenderTemplate(rend, w, r, "browse/index", data)
+	}
+}
+
+// SavedSearchSaveHandler saves the current document browser query for the user
+func SavedSearchSaveHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		values, _ := url.ParseQuery(r.FormValue("query"))
+		query := parseBrowseFilter(values).encode()
+		name := strings.TrimSpace(r.FormValue("name"))
+
+		if name == "" {
+			s.AddFlash("Please give the search a name", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/browse/?"+query, http.StatusFound)
+			return
+		}
+
+		ss := &SavedSearch{
+			ID:      bson.NewObjectId(),
+			UserID:  user.ID,
+			Name:    name,
+			Query:   query,
+			Pinned:  r.FormValue("pinned") == "on",
+			Created: time.Now(),
+		}
+
+		err := ss.save(db)
+		if err != nil {
+			ErrorLogger.Print("Could not save search {userID: "+user.ID.Hex()+"} ", err)
+			s.AddFlash("Error! Could not save the search. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/browse/?"+query, http.StatusFound)
+			return
+		}
+
+		s.AddFlash("The search \""+name+"\" was saved", "success")
+		s.Save(r, w)
+		http.Redirect(w, r, "/browse/?"+query, http.StatusFound)
+	}
+}
+
+// SavedSearchPinHandler pins a saved search to the index page, or unpins it
+func SavedSearchPinHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		ss, err := findSavedSearch(db, id, user.ID)
+		if err != nil {
+			s.AddFlash("That saved search doesn't exist", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/browse/", http.StatusFound)
+			return
+		}
+
+		ss.Pinned = !ss.Pinned
+		err = ss.save(db)
+		if err != nil {
+			ErrorLogger.Print("Could not pin saved search {id: "+id+"} ", err)
+			s.AddFlash("Error! Could not change the saved search. If this error persists please contact support", "danger")
+			s.Save(r, w)
+		}
+
+		redir := ss.URL()
+		if r.FormValue("redirect") == "index" {
+			redir = "/"
+		}
+		http.Redirect(w, r, redir, http.StatusFound)
+	}
+}
+
+// SavedSearchDeleteHandler deletes one of the user's saved searches
+func SavedSearchDeleteHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		ss, err := findSavedSearch(db, id, user.ID)
+		if err != nil {
+			s.AddFlash("That saved search doesn't exist", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/browse/", http.StatusFound)
+			return
+		}
+
+		err = ss.delete(db)
+		if err != nil {
+			ErrorLogger.Print("Could not delete saved search {id: "+id+"} ", err)
+			s.AddFlash("Error! Could not delete the saved search. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/browse/", http.StatusFound)
+			return
+		}
+
+		s.AddFlash("The search \""+ss.Name+"\" was deleted", "success")
+		s.Save(r, w)
+		http.Redirect(w, r, "/browse/", http.StatusFound)
+	}
+}
+
+// parseBrowseFilter keeps the browser parameters of a query, dropping empty and unknown ones
+func parseBrowseFilter(query url.Values) *browseFilter {
+	f := &browseFilter{values: url.Values{}}
+	for _, key := range browseParams {
+		if v := strings.TrimSpace(query.Get(key)); v != "" {
+			f.values.Set(key, v)
+		}
+	}
+
+	if from, err := time.ParseInLocation("2006-01-02", f.get("from"), time.Local); err == nil {
+		f.from = from
+	} else {
+		f.values.Del("from")
+	}
+
+	// the end date includes the whole day
+	if to, err := time.ParseInLocation("2006-01-02", f.get("to"), time.Local); err == nil {
+		f.to = to.AddDate(0, 0, 1)
+	} else {
+		f.values.Del("to")
+	}
+
+	return f
+}
+
+func (f *browseFilter) get(key string) string {
+	return f.values.Get(key)
+}
+
+// encode returns the filter as a query string, in a stable order so saved searches compare equal
+func (f *browseFilter) encode() string {
+	return f.values.Encode()
+}
+
+// toggle returns the browser URL with a filter set to value, or removed if it already is
+func (f *browseFilter) toggle(key string, value string) string {
+	values := url.Values{}
+	for k, v := range f.values {
+		values[k] = v
+	}
+
+	if values.Get(key) == value {
+		values.Del(key)
+	} else {
+		values.Set(key, value)
+	}
+
+	return "/browse/?" + values.Encode()
+}
+
+// matches checks an item against every filter except skip, which is used to count the facets of skip
+func (f *browseFilter) matches(item BrowseItem, skip string) bool {
+	for _, name := range browseFacets {
+		want := f.get(name)
+		if name == skip || want == "" {
+			continue
+		}
+
+		found := false
+		for _, v := range facetValues(item, name) {
+			if v == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if !f.from.IsZero() && item.Edited.Before(f.from) {
+		return false
+	}
+	if !f.to.IsZero() && !item.Edited.Before(f.to) {
+		return false
+	}
+
+	return true
+}
+
+// facet counts the values of one filter over the items that match all the other filters
+func (f *browseFilter) facet(items []BrowseItem, name string) []Facet {
+	counts := map[string]int{}
+	labels := map[string]string{}
+	for _, item := range items {
+		if !f.matches(item, name) {
+			continue
+		}
+		for _, v := range facetValues(item, name) {
+			counts[v]++
+			labels[v] = facetLabel(item, name, v)
+		}
+	}
+
+	// an active filter stays visible even when nothing matches it
+	if active := f.get(name); active != "" && counts[active] == 0 {
+		labels[active] = active
+		if name == "level" {
+			labels[active] = "Level " + active
+		}
+	}
+
+	facets := make([]Facet, 0, len(labels))
+	for v, label := range labels {
+		facets = append(facets, Facet{
+			Value:  v,
+			Label:  label,
+			Count:  counts[v],
+			Active: f.get(name) == v,
+			URL:    f.toggle(name, v),
+		})
+	}
+
+	sort.Slice(facets, func(i, j int) bool {
+		if name == "level" {
+			a, _ := strconv.Atoi(facets[i].Value)
+			b, _ := strconv.Atoi(facets[j].Value)
+			return a < b
+		}
+		return strings.ToLower(facets[i].Label) < strings.ToLower(facets[j].Label)
+	})
+
+	return facets
+}
+
+// facetValues returns the values an item has for a filter. Only tags and contributors can have more than one.
+func facetValues(item BrowseItem, name string) []string {
+	d := item.Document
+	switch name {
+	case "folder":
+		if d.FolderID == "" {
+			return []string{"none"}
+		}
+		return []string{d.FolderID.Hex()}
+	case "tag":
+		return d.Tags
+	case "author":
+		if d.AuthorID == "" {
+			return []string{"unknown"}
+		}
+		return []string{d.AuthorID.Hex()}
+	case "editor":
+		if d.EditorID == "" {
+			return []string{"unknown"}
+		}
+		return []string{d.EditorID.Hex()}
+	case "contributor":
+		values := make([]string, len(d.ContributorIDs))
+		for i, id := range d.ContributorIDs {
+			values[i] = id.Hex()
+		}
+		return values
+	case "level":
+		return []string{strconv.Itoa(d.Level)}
+	case "status":
+		return []string{item.Status}
+	}
+
+	return nil
+}
+
+func facetLabel(item BrowseItem, name string, value string) string {
+	switch name {
+	case "folder":
+		return item.FolderName
+	case "author":
+		return item.AuthorName
+	case "editor":
+		return item.EditorName
+	case "contributor":
+		for i, id := range item.Document.ContributorIDs {
+			if id.Hex() == value {
+				return item.Contributors[i]
+			}
+		}
+	case "level":
+		return "Level " + value
+	case "status":
+		return strings.ToUpper(value[:1]) + value[1:]
+	}
+
+	return value
+}
+
+// sort orders the items by the sort parameter. Searches default to relevance, everything else to the last edit.
+func (f *browseFilter) sort(items []BrowseItem) {
+	switch f.get("sort") {
+	case "title":
+		sort.SliceStable(items, func(i, j int) bool {
+			return strings.ToLower(items[i].Title) < strings.ToLower(items[j].Title)
+		})
+	case "edited":
+		sort.SliceStable(items, func(i, j int) bool {
+			return items[i].Edited.After(items[j].Edited)
+		})
+	case "oldest":
+		sort.SliceStable(items, func(i, j int) bool {
+			return items[i].Edited.Before(items[j].Edited)
+		})
+	default:
+		// search results are already sorted by relevance
+		if f.get("q") == "" {
+			sort.SliceStable(items, func(i, j int) bool {
+				return items[i].Edited.After(items[j].Edited)
+			})
+		}
+	}
+}
+
+// findBrowseItems finds the documents the user can see, or only those matching query when it isn't empty.
+// Documents in folders that were moved to the trash and templates are left out.
+func findBrowseItems(db *DB, user *User, query string) ([]BrowseItem, error) {
+	var items []BrowseItem
+	if query != "" {
+		results, err := search(db, user, query)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range results {
+			if !r.Document.Template {
+				items = append(items, BrowseItem{Document: r.Document, Title: r.Title, Snippet: r.Snippet})
+			}
+		}
+	} else {
+		docs, err := findVisibleDocs(db, user, bson.M{})
+		if err != nil {
+			return nil, err
+		}
+		for i := range docs {
+			items = append(items, BrowseItem{Document: &docs[i], Title: docs[i].DisplayTitle()})
+		}
+	}
+
+	inTrash, err := findTrashedFolderIDs(db)
+	if err != nil {
+		return nil, err
+	}
+
+	folders, err := findAllFolders(db)
+	if err != nil {
+		return nil, err
+	}
+	folderNames := map[bson.ObjectId]string{}
+	for _, f := range *folders {
+		folderNames[f.ID] = f.Name
+	}
+
+	userNames, err := findUserNames(db)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := items[:0]
+	for _, item := range items {
+		d := item.Document
+		if inTrash[d.FolderID] {
+			continue
+		}
+
+		// a published document is filed as published, its pending draft is shown next to it
+		item.Status = d.Status
+		if item.Status == "" || (d.isPublished() && item.Status != StatusArchived) {
+			item.Status = StatusPublished
+		}
+		if d.Status != item.Status && d.Status != "" {
+			item.PendingDraft = d.Status
+		}
+
+		item.Edited = d.Edited
+		if d.searchesDraft() {
+			item.Edited = d.Draft.Edited
+		}
+
+		item.FolderName = "No folder"
+		if d.FolderID != "" {
+			item.FolderName = folderNames[d.FolderID]
+		}
+
+		item.AuthorName = "Unknown"
+		if name, ok := userNames[d.AuthorID]; ok {
+			item.AuthorName = name
+		}
+
+		item.EditorName = "Unknown"
+		if name, ok := userNames[d.EditorID]; ok {
+			item.EditorName = name
+		}
+
+		for _, id := range d.ContributorIDs {
+			name, ok := userNames[id]
+			if !ok {
+				name = "Unknown"
+			}
+			item.Contributors = append(item.Contributors, name)
+		}
+
+		visible = append(visible, item)
+	}
+
+	return visible, nil
+}
+
+// URL returns the document browser link of the saved search
+func (ss SavedSearch) URL() string {
+	return "/browse/?" + ss.Query
+}
+
+func (ss *SavedSearch) save(db *DB) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(savedSearchCol)
+
+	_, err := collection.UpsertId(ss.ID, ss)
+	return err
+}
+
+func (ss *SavedSearch) delete(db *DB) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(savedSearchCol)
+
+	return collection.RemoveId(ss.ID)
+}
+
+// findSavedSearch finds a saved search that belongs to the user
+func findSavedSearch(db *DB, idHex string, userID bson.ObjectId) (*SavedSearch, error) {
+	if !bson.IsObjectIdHex(idHex) {
+		return nil, errors.New("Invalid saved search id.")
+	}
+
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(savedSearchCol)
+
+	ss := &SavedSearch{}
+	err := collection.Find(bson.M{"_id": bson.ObjectIdHex(idHex), "userID": userID}).One(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	return ss, nil
+}
+
+// findSavedSearches finds the user's saved searches by name, or only the pinned ones
+func findSavedSearches(db *DB, userID bson.ObjectId, pinned bool) ([]SavedSearch, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(savedSearchCol)
+
+	query := bson.M{"userID": userID}
+	if pinned {
+		query["pinned"] = true
+	}
+
+	var searches []SavedSearch
+	err := collection.Find(query).Sort("name").All(&searches)
+	return searches, err
+}
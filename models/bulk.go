@@ -0,0 +1,315 @@
+package models
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/unrolled/render"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// FolderBulkHandler moves or copies the documents selected on the folder page into another folder
+func FolderBulkHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+		redir := "/folder/view/" + id
+
+		r.ParseForm()
+		action := r.FormValue("action")
+		strTarget := r.FormValue("target")
+		strDocIDs := r.Form["documents"]
+
+		if action != "move" && action != "copy" {
+			s.AddFlash("Please choose whether to move or copy the documents", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, redir, http.StatusFound)
+			return
+		}
+
+		if len(strDocIDs) == 0 {
+			s.AddFlash("Please select the documents to "+action, "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, redir, http.StatusFound)
+			return
+		}
+
+		source, err := findFolder(db, id)
+		if err != nil {
+			ErrorLogger.Print("Source folder not found for bulk "+action+" {id: "+id+"} ", err)
+			s.AddFlash("Looks like something went wrong. If this error persists, please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/folders/", http.StatusFound)
+			return
+		}
+
+		if !bson.IsObjectIdHex(strTarget) {
+			s.AddFlash("Please choose the folder to "+action+" the documents to", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, redir, http.StatusFound)
+			return
+		}
+
+		target, err := findFolder(db, strTarget)
+		if err != nil {
+			ErrorLogger.Print("Target folder not found for bulk "+action+" {id: "+strTarget+"} ", err)
+			s.AddFlash("The folder you chose could not be found", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, redir, http.StatusFound)
+			return
+		}
+
+		if target.ID == source.ID && action == "move" {
+			s.AddFlash("Those documents are already in "+target.Name, "info")
+			s.Save(r, w)
+			http.Redirect(w, r, redir, http.StatusFound)
+			return
+		}
+
+		// moving takes documents out of the source folder, copying only reads them
+		sourcePerm := "read"
+		if action == "move" {
+			sourcePerm = "delete"
+		}
+
+		if !hasPermission(db, user, source.ID, sourcePerm) || !hasPermission(db, user, target.ID, "create") {
+			InfoLogger.Print("User tried to " + action + " documents without permission: {userID: " + user.ID.Hex() + ", from: " + source.ID.Hex() + ", to: " + target.ID.Hex() + "}")
+			s.AddFlash("Sorry, but you don't have permission to "+action+" documents from "+source.Name+" to "+target.Name, "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, redir, http.StatusFound)
+			return
+		}
+
+		var failed []string
+		done := 0
+		for _, strDocID := range strDocIDs {
+			d, err := loadPage(db, strDocID)
+			if err != nil || d.FolderID != source.ID || (user.Level < d.Level && !isDocumentUser(d, user)) {
+				failed = append(failed, strDocID)
+				continue
+			}
+
+			if action == "move" {
+				err = d.moveTo(db, target.ID)
+			} else {
+				var c *Document
+				c, err = d.copyTo(db, target.ID)
+				if err == nil {
+					InfoLogger.Print("Document copied {id: " + d.ID.Hex() + ", copyID: " + c.ID.Hex() + ", from: " + source.ID.Hex() + ", to: " + target.ID.Hex() + ", userID: " + user.ID.Hex() + "}")
+				}
+			}
+
+			if err != nil {
+				ErrorLogger.Print("Could not "+action+" document {id: "+d.ID.Hex()+", to: "+target.ID.Hex()+"} ", err)
+				failed = append(failed, d.Title)
+				continue
+			}
+
+			if action == "move" {
+				notifyDocument(db, d, EventMoved, user, " to "+target.Name, source.ID)
+				recordDocumentChange(db, d, EventMoved, user, " to "+target.Name, "")
+				InfoLogger.Print("Document moved {id: " + d.ID.Hex() + ", from: " + source.ID.Hex() + ", to: " + target.ID.Hex() + ", userID: " + user.ID.Hex() + "}")
+			}
+			done++
+		}
+
+		verb := "moved"
+		if action == "copy" {
+			verb = "copied"
+		}
+
+		if done > 0 {
+			s.AddFlash(strconv.Itoa(done)+" documents "+verb+" to "+target.Name, "success")
+		}
+		if len(failed) > 0 {
+			s.AddFlash("These documents could not be "+verb+": "+strings.Join(failed, ", "), "warning")
+		}
+		s.Save(r, w)
+
+		http.Redirect(w, r, redir, http.StatusFound)
+	}
+}
+
+// isDocumentUser checks if the user has been given access to the document individually
+func isDocumentUser(d *Document, user *User) bool {
+	for _, id := range d.UserIDs {
+		if id == user.ID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// moveTo moves the document into another folder
+func (d *Document) moveTo(db *DB, folderID bson.ObjectId) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(documentCol)
+
+	// the revision is bumped so that editors who loaded the document before the move don't move it back
+	err := collection.UpdateId(d.ID, bson.M{"$set": bson.M{"folderID": folderID, "revision": d.Revision + 1}})
+	if err != nil {
+		return err
+	}
+
+	d.FolderID = folderID
+	d.Revision++
+	return nil
+}
+
+// copyTo creates a copy of the document in another folder.
+// The copy gets a new ID, its own copies of the attachments and a freshly encrypted body.
+func (d *Document) copyTo(db *DB, folderID bson.ObjectId) (*Document, error) {
+	c := &Document{
+		ID:        bson.NewObjectId(),
+		Title:     d.Title,
+		URL:       d.URL,
+		Level:     d.Level,
+		Created:   time.Now(),
+		Edited:    time.Now(),
+		FolderID:  folderID,
+		UserIDs:   d.UserIDs,
+		Template:  d.Template,
+		Tags:      d.Tags,
+		AuthorID:  d.AuthorID,
+		Status:    d.Status,
+		Published: d.Published,
+
+		EditorID:       d.EditorID,
+		ContributorIDs: d.ContributorIDs,
+		RequiresAck:    d.RequiresAck,
+		Version:        d.Version,
+	}
+	if d.Verification != nil {
+		v := *d.Verification
+		c.Verification = &v
+	}
+
+	refs, err := copyAttachments(db, d.ID, c.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// documents that were only ever saved as a draft have no published body
+	if len(d.Body) > 0 {
+		body, err := d.decrypt()
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.encrypt(template.HTML(refs.Replace(string(body))))
+		if err != nil {
+			return nil, err
+		}
+
+		c.Delta, err = copyDelta(d.Delta, refs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// pending drafts are copied along, re-encrypted like the body
+	if d.Draft != nil {
+		draft, err := d.draftBody()
+		if err != nil {
+			return nil, err
+		}
+
+		c.Draft = &Draft{
+			Title:    d.Draft.Title,
+			Status:   d.Draft.Status,
+			AuthorID: d.Draft.AuthorID,
+			Edited:   d.Draft.Edited,
+			Summary:  d.Draft.Summary,
+
+			ContributorIDs: d.Draft.ContributorIDs,
+			Verification:   d.Draft.Verification,
+			Tags:           d.Draft.Tags,
+		}
+		c.Draft.Body, err = encryptBytes([]byte(refs.Replace(string(draft))))
+		if err != nil {
+			return nil, err
+		}
+
+		c.Draft.Delta, err = copyDelta(d.Draft.Delta, refs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = c.save(db)
+	if err != nil {
+		return nil, err
+	}
+	indexDocument(db, c)
+
+	return c, nil
+}
+
+// copyAttachments duplicates the attachments of one document for another.
+// The returned replacer points attachment references in a body to the copies.
+func copyAttachments(db *DB, fromID bson.ObjectId, toID bson.ObjectId) (*strings.Replacer, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(attachmentCol)
+
+	var attachments []Attachment
+	err := collection.Find(bson.M{"documentID": fromID}).All(&attachments)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []string
+	for _, a := range attachments {
+		oldURL, oldThumbURL := a.url(), a.thumbURL()
+		a.ID = bson.NewObjectId()
+		a.DocumentID = toID
+		a.Created = time.Now()
+
+		err = collection.Insert(a)
+		if err != nil {
+			return nil, err
+		}
+
+		refs = append(refs, oldThumbURL, a.thumbURL(), oldURL, a.url())
+	}
+
+	return strings.NewReplacer(refs...), nil
+}
+
+// copyDelta re-encrypts a stored Delta with its attachment references pointed at the copies
+func copyDelta(ciphertext []byte, refs *strings.Replacer) ([]byte, error) {
+	if len(ciphertext) == 0 {
+		return nil, nil
+	}
+
+	plaintext, err := decryptBytes(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	return encryptBytes([]byte(refs.Replace(string(plaintext))))
+}
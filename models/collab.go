@@ -0,0 +1,501 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/gorilla/websocket"
+	"github.com/unrolled/render"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// collabMessage is sent between the editor page and the server over the WebSocket.
+//
+// The editor sends "seed" (its starting content, for documents that have no stored Delta yet),
+// "op" (a change made on top of a version) and "cursor" (its selection).
+// The server sends "init", "ack", "op", "join", "leave", "cursor", "saved", "stale" and "error".
+type collabMessage struct {
+	Type     string       `json:"type"`
+	Version  int          `json:"version"`
+	Revision int          `json:"revision,omitempty"`
+	Delta    *Delta       `json:"delta,omitempty"`
+	Range    *collabRange `json:"range,omitempty"`
+	Seeded   bool         `json:"seeded,omitempty"`
+	ClientID string       `json:"clientID,omitempty"`
+	Client   *collabPeer  `json:"client,omitempty"`
+	Peers    []collabPeer `json:"peers,omitempty"`
+	Message  string       `json:"message,omitempty"`
+}
+
+// collabRange is an editor selection
+type collabRange struct {
+	Index  int `json:"index"`
+	Length int `json:"length"`
+}
+
+// collabPeer describes someone connected to a collaborative editing session
+type collabPeer struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Color string `json:"color"`
+}
+
+// collabColors are given to editors in turn so their cursors can be told apart
+var collabColors = []string{"#e6194b", "#3cb44b", "#4363d8", "#f58231", "#911eb4", "#42d4f4", "#f032e6", "#9a6324"}
+
+const (
+	// collabSnapshotInterval is how often the merged content is saved while people are editing
+	collabSnapshotInterval = 15 * time.Second
+	// collabWriteWait is how long a message may take to be written to an editor
+	collabWriteWait = 10 * time.Second
+	// collabPongWait is how long an editor may go without answering a ping
+	collabPongWait = 60 * time.Second
+	// collabPingPeriod must be shorter than collabPongWait
+	collabPingPeriod = 50 * time.Second
+	// collabMaxMessage is the largest message an editor may send, in bytes
+	collabMaxMessage = 4 << 20
+)
+
+var collabUpgrader = websocket.Upgrader{
+	HandshakeTimeout: 10 * time.Second,
+	ReadBufferSize:   4096,
+	WriteBufferSize:  4096,
+}
+
+// collabRooms holds the editing sessions of all documents that are open in an editor
+var collabRooms = &collabHub{rooms: map[bson.ObjectId]*collabRoom{}}
+
+// collabHub keeps one room per document being edited
+type collabHub struct {
+	mu    sync.Mutex
+	rooms map[bson.ObjectId]*collabRoom
+}
+
+// collabRoom is the editing session of one document.
+// It holds the merged content as a Delta and every change made since the room was opened,
+// so changes made on top of older versions can be transformed before they are applied.
+type collabRoom struct {
+	db    *DB
+	docID bson.ObjectId
+
+	mu       sync.Mutex
+	content  *Delta
+	history  []*Delta
+	revision int
+	editorID bson.ObjectId
+	dirty    bool
+	stale    bool
+	clients  map[*collabClient]bool
+	joined   int
+	done     chan struct{}
+}
+
+// collabClient is one editor connected to a room
+type collabClient struct {
+	conn   *websocket.Conn
+	send   chan []byte
+	userID bson.ObjectId
+	peer   collabPeer
+}
+
+// CollabHandler connects an editor to the collaborative editing session of a document
+func CollabHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			http.Error(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		d, err := loadPage(db, id)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		if !d.visibleTo(db, user) || !d.canEdit(db, user) {
+			InfoLogger.Print("User tried to join editing session without permission: {userID: " + user.ID.Hex() + ", documentID: " + id + "}")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		conn, err := collabUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// the upgrader has already replied to the client
+			ErrorLogger.Print("Could not start editing session {id: "+id+", userID: "+user.ID.Hex()+"} ", err)
+			return
+		}
+
+		c := &collabClient{
+			conn:   conn,
+			send:   make(chan []byte, 64),
+			userID: user.ID,
+			peer:   collabPeer{Name: user.Name},
+		}
+
+		room := collabRooms.join(db, d, c)
+		InfoLogger.Print("User joined editing session {id: " + id + ", userID: " + user.ID.Hex() + "}")
+
+		go c.writePump()
+		c.readPump(room)
+
+		collabRooms.leave(room, c)
+		InfoLogger.Print("User left editing session {id: " + id + ", userID: " + user.ID.Hex() + "}")
+	}
+}
+
+// join adds the client to the document's room, opening the room if needed
+func (h *collabHub) join(db *DB, d *Document, c *collabClient) *collabRoom {
+	h.mu.Lock()
+	room, ok := h.rooms[d.ID]
+	if !ok {
+		room = &collabRoom{
+			db:       db,
+			docID:    d.ID,
+			revision: d.Revision,
+			clients:  map[*collabClient]bool{},
+			done:     make(chan struct{}),
+		}
+
+		// start from the stored Delta. Older documents are seeded by the first editor instead.
+		if d.Draft == nil && len(d.Delta) > 0 || d.Draft != nil && len(d.Draft.Delta) > 0 {
+			content, err := d.workingDelta()
+			if err != nil {
+				ErrorLogger.Print("Could not decrypt document for editing session {id: "+d.ID.Hex()+"} ", err)
+			}
+			room.content = content
+		}
+
+		h.rooms[d.ID] = room
+		go room.snapshotLoop()
+	}
+
+	// add while holding the hub so the room can't be closed in between
+	room.add(c)
+	h.mu.Unlock()
+
+	return room
+}
+
+// leave removes the client from its room, and closes the room when the last editor leaves
+func (h *collabHub) leave(room *collabRoom, c *collabClient) {
+	h.mu.Lock()
+	empty := room.remove(c)
+	if empty {
+		delete(h.rooms, room.docID)
+	}
+	h.mu.Unlock()
+
+	if empty {
+		close(room.done)
+		room.snapshot()
+	}
+}
+
+// saved tells the document's room that one of its editors saved the document through the edit form,
+// so the room continues from the new revision instead of treating it as someone else's change.
+func (h *collabHub) saved(docID bson.ObjectId, revision int, userID bson.ObjectId) {
+	h.mu.Lock()
+	room, ok := h.rooms[docID]
+	h.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	for c := range room.clients {
+		if c.userID == userID {
+			room.revision = revision
+			room.stale = false
+			room.broadcast(nil, &collabMessage{Type: "saved", Revision: revision})
+			return
+		}
+	}
+}
+
+func (room *collabRoom) add(c *collabClient) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	c.peer.ID = strconv.Itoa(room.joined)
+	c.peer.Color = collabColors[room.joined%len(collabColors)]
+	room.joined++
+
+	room.sendTo(c, room.initMessage(c))
+	room.broadcast(c, &collabMessage{Type: "join", Client: &c.peer})
+	room.clients[c] = true
+}
+
+// remove takes the client out of the room and reports whether the room is now empty
+func (room *collabRoom) remove(c *collabClient) bool {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if room.clients[c] {
+		delete(room.clients, c)
+		close(c.send)
+		room.broadcast(nil, &collabMessage{Type: "leave", ClientID: c.peer.ID})
+	}
+
+	return len(room.clients) == 0
+}
+
+// initMessage tells a client the current state of the room.
+// Until the room is seeded there is no content yet.
+func (room *collabRoom) initMessage(c *collabClient) *collabMessage {
+	msg := &collabMessage{
+		Type:     "init",
+		Version:  len(room.history),
+		Revision: room.revision,
+		Seeded:   room.content != nil,
+		Delta:    room.content,
+		Client:   &c.peer,
+		Peers:    []collabPeer{},
+	}
+
+	for other := range room.clients {
+		if other != c {
+			msg.Peers = append(msg.Peers, other.peer)
+		}
+	}
+
+	return msg
+}
+
+// handle processes a message from one of the room's editors
+func (room *collabRoom) handle(c *collabClient, msg *collabMessage) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	switch msg.Type {
+	case "seed":
+		if room.content != nil {
+			room.sendTo(c, room.initMessage(c))
+			return
+		}
+
+		if msg.Revision != room.revision {
+			room.sendTo(c, &collabMessage{Type: "stale", Message: "This document was saved since you opened it. Reload the page to edit the latest version."})
+			return
+		}
+
+		if msg.Delta == nil || !msg.Delta.valid() || !msg.Delta.isDocument() {
+			room.sendTo(c, &collabMessage{Type: "error", Message: "Invalid document content."})
+			return
+		}
+
+		room.content = msg.Delta
+		room.sendTo(c, room.initMessage(c))
+
+	case "op":
+		if room.content == nil {
+			room.sendTo(c, &collabMessage{Type: "error", Message: "The editing session has not started yet."})
+			return
+		}
+
+		if msg.Delta == nil || !msg.Delta.valid() || msg.Version < 0 || msg.Version > len(room.history) {
+			room.sendTo(c, &collabMessage{Type: "error", Message: "Invalid change."})
+			return
+		}
+
+		// the change was made on top of msg.Version, move it past everything applied since
+		change := msg.Delta
+		for _, applied := range room.history[msg.Version:] {
+			change = applied.Transform(change, true)
+		}
+
+		content, err := room.content.apply(change)
+		if err != nil {
+			room.sendTo(c, &collabMessage{Type: "error", Message: "The change does not fit the document."})
+			return
+		}
+
+		room.content = content
+		room.history = append(room.history, change)
+		room.editorID = c.userID
+		room.dirty = true
+
+		version := len(room.history)
+		room.sendTo(c, &collabMessage{Type: "ack", Version: version})
+		room.broadcast(c, &collabMessage{Type: "op", Version: version, Delta: change, ClientID: c.peer.ID})
+
+	case "cursor":
+		if msg.Range == nil {
+			return
+		}
+		room.broadcast(c, &collabMessage{Type: "cursor", Range: msg.Range, ClientID: c.peer.ID})
+	}
+}
+
+// snapshotLoop saves the merged content regularly until the room is closed
+func (room *collabRoom) snapshotLoop() {
+	ticker := time.NewTicker(collabSnapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			room.snapshot()
+		case <-room.done:
+			return
+		}
+	}
+}
+
+// snapshot saves the merged content as the document's draft, if it changed since the last snapshot.
+// If the document was saved outside the session, the room stops saving and tells the editors.
+func (room *collabRoom) snapshot() {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if !room.dirty || room.stale || room.content == nil {
+		return
+	}
+
+	d, err := loadPage(room.db, room.docID.Hex())
+	if err != nil {
+		ErrorLogger.Print("Could not load document for editing snapshot {id: "+room.docID.Hex()+"} ", err)
+		return
+	}
+
+	if d.Revision == room.revision {
+		title, _, err := d.workingCopy()
+		if err != nil {
+			ErrorLogger.Print("Could not decrypt document for editing snapshot {id: "+room.docID.Hex()+"} ", err)
+			return
+		}
+
+		body, err := d.saveDraft(title, room.content, room.editorID)
+		if err != nil {
+			ErrorLogger.Print("Could not encrypt editing snapshot {id: "+room.docID.Hex()+"} ", err)
+			return
+		}
+
+		err = d.saveRevision(room.db, d.Revision)
+		if err == nil {
+			room.revision = d.Revision
+			room.dirty = false
+
+			err = linkAttachments(room.db, d.ID, body)
+			if err != nil {
+				ErrorLogger.Print("Could not link attachments to document id: "+d.ID.Hex()+" \n ", err)
+			}
+			indexDocument(room.db, d)
+
+			InfoLogger.Print("Editing snapshot saved {id: " + d.ID.Hex() + ", revision: " + strconv.Itoa(d.Revision) + ", userID: " + room.editorID.Hex() + "}")
+			room.broadcast(nil, &collabMessage{Type: "saved", Revision: d.Revision})
+			return
+		}
+
+		if err != errConflict {
+			ErrorLogger.Print("Could not save editing snapshot {id: "+d.ID.Hex()+"} ", err)
+			return
+		}
+	}
+
+	InfoLogger.Print("Editing session is out of date {id: " + room.docID.Hex() + ", revision: " + strconv.Itoa(room.revision) + "}")
+	room.stale = true
+	room.broadcast(nil, &collabMessage{Type: "stale", Message: "This document was saved outside this editing session. Save your changes with the Save button to merge them."})
+}
+
+// sendTo queues a message for one client. Clients that can't keep up are disconnected.
+// The room must be locked.
+func (room *collabRoom) sendTo(c *collabClient, msg *collabMessage) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		ErrorLogger.Print("Could not encode editing message ", err)
+		return
+	}
+
+	select {
+	case c.send <- b:
+	default:
+		c.conn.Close()
+	}
+}
+
+// broadcast queues a message for every client except the sender. The room must be locked.
+func (room *collabRoom) broadcast(sender *collabClient, msg *collabMessage) {
+	for c := range room.clients {
+		if c != sender {
+			room.sendTo(c, msg)
+		}
+	}
+}
+
+// readPump passes the client's messages to the room until the connection closes
+func (c *collabClient) readPump(room *collabRoom) {
+	defer c.conn.Close()
+
+	c.conn.SetReadLimit(collabMaxMessage)
+	c.conn.SetReadDeadline(time.Now().Add(collabPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(collabPongWait))
+	})
+
+	for {
+		msg := &collabMessage{}
+		err := c.conn.ReadJSON(msg)
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				ErrorLogger.Print("Editing session connection closed unexpectedly {userID: "+c.userID.Hex()+"} ", err)
+			}
+			return
+		}
+
+		room.handle(c, msg)
+	}
+}
+
+// writePump sends queued messages and pings to the client until its queue is closed
+func (c *collabClient) writePump() {
+	ticker := time.NewTicker(collabPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case b, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(collabWriteWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+
+			err := c.conn.WriteMessage(websocket.TextMessage, b)
+			if err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(collabWriteWait))
+			err := c.conn.WriteMessage(websocket.PingMessage, nil)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,482 @@
+package models
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/unrolled/render"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Thread is a discussion on a document. It is about the whole document,
+// or about the text range it was started on when Length is more than 0.
+type Thread struct {
+	ID         bson.ObjectId `json:"id" bson:"_id"`
+	DocumentID bson.ObjectId `json:"documentID" bson:"documentID"`
+	Index      int           `json:"index"`
+	Length     int           `json:"length"`
+	Quote      []byte        `json:"quote" bson:"quote,omitempty"`
+	Resolved   bool          `json:"resolved"`
+	ResolvedBy bson.ObjectId `json:"resolvedBy" bson:"resolvedBy,omitempty"`
+	ResolvedAt time.Time     `json:"resolvedAt" bson:"resolvedAt,omitempty"`
+	Created    time.Time     `json:"created"`
+	Comments   []Comment     `json:"comments"`
+}
+
+// Comment is one message in a thread. The body is encrypted like document bodies.
+type Comment struct {
+	ID         bson.ObjectId   `json:"id" bson:"_id"`
+	AuthorID   bson.ObjectId   `json:"authorID" bson:"authorID"`
+	AuthorName string          `json:"authorName" bson:"authorName"`
+	Body       []byte          `json:"body"`
+	MentionIDs []bson.ObjectId `json:"mentionIDs" bson:"mentionIDs,omitempty"`
+	Created    time.Time       `json:"created"`
+}
+
+// threadView is a thread with its quote and comments decrypted for display
+type threadView struct {
+	*Thread
+	Quote      string
+	Comments   []commentView
+	CanResolve bool
+}
+
+type commentView struct {
+	*Comment
+	Body template.HTML
+}
+
+const threadCol = "threads"
+
+// maxCommentLength is the longest comment that can be posted, in bytes
+const maxCommentLength = 10000
+
+// mention finds @mentions in comments. Users are mentioned by their name without spaces, like @JaneDoe.
+var mention = regexp.MustCompile(`@([\pL\pN_]+(?:[.-][\pL\pN_]+)*)`)
+
+// CommentHandler starts a new thread on a document, about the whole document or a selected range
+func CommentHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		d, err := loadPage(db, id)
+		if err != nil {
+			ErrorLogger.Print("Document not found for comment. id: "+id, err)
+			s.AddFlash("Looks like something went wrong. If this error persists, please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		if !d.visibleTo(db, user) {
+			InfoLogger.Print("User tried to comment on a document without permission: {userID: " + user.ID.Hex() + ", documentID: " + id + "}")
+			s.AddFlash("Sorry, but you don't have permission to view this document", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		c, err := newComment(db, d, user, r.FormValue("body"))
+		if err != nil {
+			s.AddFlash(err.Error(), "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		t := &Thread{
+			ID:         bson.NewObjectId(),
+			DocumentID: d.ID,
+			Created:    time.Now(),
+			Comments:   []Comment{*c},
+		}
+
+		// a selected range is remembered with its text, so it can be found again after edits
+		index, _ := strconv.Atoi(r.FormValue("index"))
+		length, _ := strconv.Atoi(r.FormValue("length"))
+		quote := strings.TrimSpace(r.FormValue("quote"))
+		if index >= 0 && length > 0 && quote != "" {
+			t.Index = index
+			t.Length = length
+			t.Quote, err = encryptBytes([]byte(quote))
+		}
+
+		if err == nil {
+			err = t.save(db)
+		}
+		if err != nil {
+			ErrorLogger.Print("Could not save thread {documentID: "+id+"} ", err)
+			s.AddFlash("Error! Could not save your comment. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		InfoLogger.Print("Thread started {id: " + t.ID.Hex() + ", documentID: " + id + ", userID: " + user.ID.Hex() + "}")
+		notifyMentions(db, d, c, user)
+		s.AddFlash("Your comment was added", "success")
+		s.Save(r, w)
+		http.Redirect(w, r, "/document/view/"+id+"#thread-"+t.ID.Hex(), http.StatusFound)
+	}
+}
+
+// CommentReplyHandler adds a reply to a thread
+func CommentReplyHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		t, d, ok := findThreadForUser(db, id, user)
+		if !ok {
+			s.AddFlash("Sorry, but that discussion could not be found", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		c, err := newComment(db, d, user, r.FormValue("body"))
+		if err != nil {
+			s.AddFlash(err.Error(), "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+d.ID.Hex()+"#thread-"+id, http.StatusFound)
+			return
+		}
+
+		err = t.addComment(db, c)
+		if err != nil {
+			ErrorLogger.Print("Could not save reply {threadID: "+id+"} ", err)
+			s.AddFlash("Error! Could not save your comment. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+d.ID.Hex(), http.StatusFound)
+			return
+		}
+
+		InfoLogger.Print("Comment added {threadID: " + id + ", documentID: " + d.ID.Hex() + ", userID: " + user.ID.Hex() + "}")
+		notifyMentions(db, d, c, user)
+		http.Redirect(w, r, "/document/view/"+d.ID.Hex()+"#thread-"+id, http.StatusFound)
+	}
+}
+
+// CommentResolveHandler resolves a thread, or reopens a resolved one
+func CommentResolveHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		t, d, ok := findThreadForUser(db, id, user)
+		if !ok {
+			s.AddFlash("Sorry, but that discussion could not be found", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		if !t.canResolve(db, d, user) {
+			InfoLogger.Print("User tried to resolve a thread without permission: {userID: " + user.ID.Hex() + ", threadID: " + id + "}")
+			s.AddFlash("Sorry, but you don't have permission to resolve this discussion", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+d.ID.Hex()+"#thread-"+id, http.StatusFound)
+			return
+		}
+
+		err := t.setResolved(db, !t.Resolved, user.ID)
+		if err != nil {
+			ErrorLogger.Print("Could not resolve thread {id: "+id+"} ", err)
+			s.AddFlash("Error! Could not update the discussion. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+d.ID.Hex(), http.StatusFound)
+			return
+		}
+
+		state := "reopened"
+		if t.Resolved {
+			state = "resolved"
+		}
+		InfoLogger.Print("Thread " + state + " {id: " + id + ", documentID: " + d.ID.Hex() + ", userID: " + user.ID.Hex() + "}")
+		s.AddFlash("The discussion was "+state, "success")
+		s.Save(r, w)
+		http.Redirect(w, r, "/document/view/"+d.ID.Hex()+"#thread-"+id, http.StatusFound)
+	}
+}
+
+// newComment builds an encrypted comment, recording the users it mentions
+func newComment(db *DB, d *Document, author *User, text string) (*Comment, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, errors.New("Please write a comment first")
+	}
+	if len(text) > maxCommentLength {
+		return nil, errors.New("That comment is too long")
+	}
+
+	body, err := encryptBytes([]byte(text))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Comment{
+		ID:         bson.NewObjectId(),
+		AuthorID:   author.ID,
+		AuthorName: author.Name,
+		Body:       body,
+		Created:    time.Now(),
+	}
+
+	mentioned, err := findMentions(db, d, text)
+	if err != nil {
+		ErrorLogger.Print("Could not find mentioned users {documentID: "+d.ID.Hex()+"} ", err)
+	}
+	for _, u := range mentioned {
+		c.MentionIDs = append(c.MentionIDs, u.ID)
+	}
+
+	return c, nil
+}
+
+// mentionName is how a user is mentioned in comments
+func mentionName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), ""))
+}
+
+// findMentions finds the users mentioned in a comment.
+// Only users who can read the document can be mentioned, so comments don't leak to anyone else.
+func findMentions(db *DB, d *Document, text string) ([]User, error) {
+	names := map[string]bool{}
+	for _, m := range mention.FindAllStringSubmatch(text, -1) {
+		names[strings.ToLower(m[1])] = true
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	users, err := findAllUsers(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var mentioned []User
+	for i := range *users {
+		u := &(*users)[i]
+		if names[mentionName(u.Name)] && d.visibleTo(db, u) {
+			mentioned = append(mentioned, *u)
+		}
+	}
+
+	return mentioned, nil
+}
+
+// notifyMentions notifies the users mentioned in a comment, except its author
+func notifyMentions(db *DB, d *Document, c *Comment, author *User) {
+	for _, id := range c.MentionIDs {
+		if id == author.ID {
+			continue
+		}
+
+		u, err := findUser(db, id.Hex())
+		if err != nil || u.Deleted {
+			continue
+		}
+
+		notifyUser(db, u, &Notification{
+			Event:      EventMention,
+			DocumentID: d.ID,
+			FolderID:   d.FolderID,
+			Title:      d.DisplayTitle(),
+			ActorID:    author.ID,
+			ActorName:  author.Name,
+		})
+	}
+}
+
+// renderComment escapes a comment for display, with line breaks kept and mentions highlighted
+func renderComment(text string, mentioned map[string]bool) template.HTML {
+	escaped := template.HTMLEscapeString(text)
+	escaped = mention.ReplaceAllStringFunc(escaped, func(m string) string {
+		if !mentioned[strings.ToLower(m[1:])] {
+			return m
+		}
+		return `<strong class="mention">` + m + `</strong>`
+	})
+
+	return template.HTML(strings.Replace(escaped, "\n", "<br>", -1))
+}
+
+// findThreadForUser finds a thread and its document, if the user may read the document
+func findThreadForUser(db *DB, idHex string, user *User) (*Thread, *Document, bool) {
+	if !bson.IsObjectIdHex(idHex) {
+		return nil, nil, false
+	}
+
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(threadCol)
+
+	t := &Thread{}
+	err := collection.FindId(bson.ObjectIdHex(idHex)).One(t)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	d, err := loadPage(db, t.DocumentID.Hex())
+	if err != nil || !d.visibleTo(db, user) {
+		return nil, nil, false
+	}
+
+	return t, d, true
+}
+
+// findDocumentThreads finds the threads on a document and decrypts them for display.
+// Open threads come first, newest last.
+func findDocumentThreads(db *DB, d *Document, user *User) ([]threadView, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(threadCol)
+
+	var threads []Thread
+	err := collection.Find(bson.M{"documentID": d.ID}).Sort("resolved", "created").All(&threads)
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := findAllUsers(db)
+	if err != nil {
+		return nil, err
+	}
+	names := map[bson.ObjectId]string{}
+	for _, u := range *users {
+		names[u.ID] = mentionName(u.Name)
+	}
+
+	canEdit := d.canEdit(db, user)
+	views := make([]threadView, len(threads))
+	for i := range threads {
+		t := &threads[i]
+		v := threadView{Thread: t, CanResolve: canEdit || t.isAuthor(user)}
+
+		if len(t.Quote) > 0 {
+			quote, err := decryptBytes(t.Quote)
+			if err != nil {
+				return nil, err
+			}
+			v.Quote = string(quote)
+		}
+
+		for j := range t.Comments {
+			c := &t.Comments[j]
+			text, err := decryptBytes(c.Body)
+			if err != nil {
+				return nil, err
+			}
+
+			mentioned := map[string]bool{}
+			for _, id := range c.MentionIDs {
+				mentioned[names[id]] = true
+			}
+			v.Comments = append(v.Comments, commentView{Comment: c, Body: renderComment(string(text), mentioned)})
+		}
+
+		views[i] = v
+	}
+
+	return views, nil
+}
+
+func (t *Thread) save(db *DB) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(threadCol)
+
+	return collection.Insert(t)
+}
+
+func (t *Thread) addComment(db *DB, c *Comment) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(threadCol)
+
+	return collection.UpdateId(t.ID, bson.M{"$push": bson.M{"comments": c}})
+}
+
+func (t *Thread) setResolved(db *DB, resolved bool, userID bson.ObjectId) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(threadCol)
+
+	update := bson.M{"$set": bson.M{"resolved": true, "resolvedBy": userID, "resolvedAt": time.Now()}}
+	if !resolved {
+		update = bson.M{"$set": bson.M{"resolved": false}, "$unset": bson.M{"resolvedBy": "", "resolvedAt": ""}}
+	}
+
+	err := collection.UpdateId(t.ID, update)
+	if err != nil {
+		return err
+	}
+
+	t.Resolved = resolved
+	return nil
+}
+
+// isAuthor checks if the user started the thread
+func (t *Thread) isAuthor(user *User) bool {
+	return len(t.Comments) > 0 && t.Comments[0].AuthorID == user.ID
+}
+
+// canResolve checks if the user may resolve or reopen the thread.
+// The person who started it and the document's editors may.
+func (t *Thread) canResolve(db *DB, d *Document, user *User) bool {
+	return t.isAuthor(user) || d.canEdit(db, user)
+}
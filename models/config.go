@@ -11,6 +11,25 @@ import (
 type Config struct {
 	Databases map[string]DBConf `toml:"databases"`
 	Secrets   map[string]string `toml:"secrets"`
+	Trash     TrashConf         `toml:"trash"`
+	Mail      MailConf          `toml:"mail"`
+}
+
+// TrashConf defines how long deleted items are kept before they are purged
+type TrashConf struct {
+	RetentionDays int `toml:"retentionDays"`
+}
+
+// MailConf defines how emails are sent. The "file" driver writes them to Dir instead of sending them,
+// the "smtp" driver sends them through Host.
+type MailConf struct {
+	Driver   string `toml:"driver"`
+	Dir      string `toml:"dir"`
+	Host     string `toml:"host"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	From     string `toml:"from"`
+	BaseURL  string `toml:"baseURL"`
 }
 
 // Load loads the config from the config file
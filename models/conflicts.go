@@ -0,0 +1,49 @@
+package models
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/unrolled/render"
+)
+
+// renderConflict shows the stored version of a document next to the version the user tried to save,
+// so that they can merge the two and save again on top of the latest revision.
+func renderConflict(db *DB, rend *render.Render, w http.ResponseWriter, r *http.Request, user *User, d *Document, title string, body template.HTML) {
+	storedTitle, storedBody, err := d.workingCopy()
+	if err != nil {
+		ErrorLogger.Print("Could not decrypt document for conflict page {id: "+d.ID.Hex()+"} ", err)
+	}
+
+	// the draft author is the last person to save the document
+	editor := &User{Name: "Unknown"}
+	edited := d.Edited
+	if d.Draft != nil {
+		edited = d.Draft.Edited
+		if u, err := findUser(db, d.Draft.AuthorID.Hex()); err == nil {
+			editor = u
+		}
+	}
+
+	data := map[string]interface{}{
+		"user":        user,
+		"document":    d,
+		"storedTitle": storedTitle,
+		"storedBody":  storedBody,
+		"editor":      editor,
+		"edited":      edited,
+		"title":       title,
+		"body":        body,
+		"level":       r.FormValue("level"),
+		"folder":      r.FormValue("folder"),
+		"users":       r.Form["users"],
+		"template":    r.FormValue("template"),
+		"tags":        r.FormValue("tags"),
+		"action":      r.FormValue("action"),
+		"summary":     r.FormValue("summary"),
+		"owner":       r.FormValue("owner"),
+		"interval":    r.FormValue("reviewInterval"),
+	}
+
+	RenderTemplateStatus(rend, w, r, http.StatusConflict, "document/conflict", data)
+}
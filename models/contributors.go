@@ -0,0 +1,172 @@
+package models
+
+import (
+	"net/url"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// personFilters are the query parameters that narrow a listing down to the documents of one person
+var personFilters = []string{"author", "editor", "contributor"}
+
+var personFilterTitles = map[string]string{
+	"author":      "created by",
+	"editor":      "last edited by",
+	"contributor": "edited by",
+}
+
+// appendID adds id to ids, unless it is empty or already there
+func appendID(ids []bson.ObjectId, id bson.ObjectId) []bson.ObjectId {
+	if id == "" {
+		return ids
+	}
+
+	for _, existing := range ids {
+		if existing == id {
+			return ids
+		}
+	}
+
+	return append(ids, id)
+}
+
+// hasPerson checks if the user with id has the role in the document, one of personFilters
+func (d *Document) hasPerson(role string, id bson.ObjectId) bool {
+	switch role {
+	case "author":
+		return d.AuthorID == id
+	case "editor":
+		return d.EditorID == id
+	case "contributor":
+		for _, c := range d.ContributorIDs {
+			if c == id {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// personFilter is a listing narrowed down to the documents one person created or edited
+type personFilter struct {
+	Role  string
+	ID    bson.ObjectId
+	Title string
+}
+
+// parsePersonFilter finds the first person filter in the query, it is nil when there is none
+func parsePersonFilter(query url.Values) *personFilter {
+	for _, role := range personFilters {
+		if v := query.Get(role); bson.IsObjectIdHex(v) {
+			return &personFilter{Role: role, ID: bson.ObjectIdHex(v), Title: personFilterTitles[role]}
+		}
+	}
+
+	return nil
+}
+
+// filter keeps the documents the person has the role in
+func (pf *personFilter) filter(docs []Document) []Document {
+	var matches []Document
+	for _, d := range docs {
+		if d.hasPerson(pf.Role, pf.ID) {
+			matches = append(matches, d)
+		}
+	}
+
+	return matches
+}
+
+// findUserNames maps the ID of every user to their name, for listings that show who made changes
+func findUserNames(db *DB) (map[bson.ObjectId]string, error) {
+	users, err := findAllUsers(db)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[bson.ObjectId]string{}
+	for _, u := range *users {
+		names[u.ID] = u.Name
+	}
+
+	return names, nil
+}
+
+// BackfillContributors records the contributors and last editor of every document that has no contributors yet.
+// They are its author and everyone in its history of changes, the editor is whoever published it last.
+// Documents from before authors and changes were recorded have neither, and stay without contributors.
+// It returns the number of documents that were changed.
+func BackfillContributors(db *DB) (int, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(documentCol)
+	changes := session.DB(db.name).C(changeCol)
+
+	var docs []Document
+	err := collection.Find(bson.M{
+		"contributorIDs": bson.M{"$exists": false},
+	}).Select(bson.M{"authorID": 1, "published": 1, "status": 1}).All(&docs)
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, d := range docs {
+		var history []Change
+		err = changes.Find(bson.M{
+			"documentID": d.ID,
+			"event":      bson.M{"$in": []string{EventPublished, EventDraft, EventReview}},
+		}).Sort("created").All(&history)
+		if err != nil {
+			return changed, err
+		}
+
+		contributors := appendID(nil, d.AuthorID)
+		editor := d.AuthorID
+		for _, c := range history {
+			contributors = appendID(contributors, c.UserID)
+			if c.Event == EventPublished {
+				editor = c.UserID
+			}
+		}
+		if len(contributors) == 0 {
+			continue
+		}
+
+		set := bson.M{"contributorIDs": contributors}
+		if d.isPublished() && editor != "" {
+			set["editorID"] = editor
+		}
+
+		err = collection.UpdateId(d.ID, bson.M{"$set": set})
+		if err != nil {
+			return changed, err
+		}
+		changed++
+	}
+
+	return changed, nil
+}
+
+// findPeople finds the author, the last editor and the contributors of the document.
+// The author and editor are nil when they aren't known.
+func (d *Document) findPeople(db *DB) (author *User, editor *User, contributors []User) {
+	if d.AuthorID != "" {
+		author, _ = findUser(db, d.AuthorID.Hex())
+	}
+	if d.EditorID != "" {
+		editor, _ = findUser(db, d.EditorID.Hex())
+	}
+
+	if len(d.ContributorIDs) > 0 {
+		users, err := findUsers(db, &d.ContributorIDs)
+		if err != nil {
+			ErrorLogger.Print("Could not find contributors of document id: "+d.ID.Hex(), err)
+			return author, editor, nil
+		}
+		contributors = *users
+	}
+
+	return author, editor, contributors
+}
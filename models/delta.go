@@ -0,0 +1,367 @@
+package models
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"unicode/utf16"
+)
+
+// Delta is a Quill Delta: a list of operations describing a document or a change to one.
+// Lengths are counted in UTF-16 code units, the same way the editor counts them.
+type Delta struct {
+	Ops []DeltaOp `json:"ops"`
+}
+
+// DeltaOp is a single insert, delete or retain operation.
+// Insert holds either text or an embed such as {"image": "/attachment/..."}.
+type DeltaOp struct {
+	Insert     interface{}            `json:"insert,omitempty"`
+	Delete     int                    `json:"delete,omitempty"`
+	Retain     int                    `json:"retain,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// errDeltaLength is returned when a change doesn't fit the document it is applied to
+var errDeltaLength = errors.New("Delta does not match the document length.")
+
+// deltaInfinity stands in for the endless retain at the end of every delta
+const deltaInfinity = math.MaxInt32
+
+func (op DeltaOp) isInsert() bool {
+	return op.Insert != nil
+}
+
+func (op DeltaOp) isDelete() bool {
+	return op.Insert == nil && op.Delete > 0
+}
+
+func (op DeltaOp) isRetain() bool {
+	return op.Insert == nil && op.Delete == 0
+}
+
+// length returns the number of characters the operation covers. Embeds count as one.
+func (op DeltaOp) length() int {
+	switch {
+	case op.isDelete():
+		return op.Delete
+	case op.isRetain():
+		return op.Retain
+	}
+
+	if text, ok := op.Insert.(string); ok {
+		return len(utf16.Encode([]rune(text)))
+	}
+
+	return 1
+}
+
+// Length returns the length of the document the delta describes, or the length it covers as a change
+func (d *Delta) Length() int {
+	n := 0
+	for _, op := range d.Ops {
+		n += op.length()
+	}
+
+	return n
+}
+
+// baseLength returns the length a document must have for the delta to be applied to it
+func (d *Delta) baseLength() int {
+	n := 0
+	for _, op := range d.Ops {
+		if !op.isInsert() {
+			n += op.length()
+		}
+	}
+
+	return n
+}
+
+// isDocument checks that the delta only contains inserts
+func (d *Delta) isDocument() bool {
+	for _, op := range d.Ops {
+		if !op.isInsert() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// push appends an operation, merging it with the previous one where possible
+func (d *Delta) push(op DeltaOp) {
+	if op.length() == 0 {
+		return
+	}
+	if len(op.Attributes) == 0 {
+		op.Attributes = nil
+	}
+
+	index := len(d.Ops)
+	if index == 0 {
+		d.Ops = append(d.Ops, op)
+		return
+	}
+
+	last := &d.Ops[index-1]
+	if op.isDelete() && last.isDelete() {
+		last.Delete += op.Delete
+		return
+	}
+
+	// inserts always go before deletes at the same position
+	if last.isDelete() && op.isInsert() {
+		index--
+		if index == 0 {
+			d.Ops = append([]DeltaOp{op}, d.Ops...)
+			return
+		}
+		last = &d.Ops[index-1]
+	}
+
+	if reflect.DeepEqual(op.Attributes, last.Attributes) {
+		lastText, lastIsText := last.Insert.(string)
+		text, isText := op.Insert.(string)
+		if lastIsText && isText {
+			last.Insert = lastText + text
+			return
+		}
+		if last.isRetain() && op.isRetain() {
+			last.Retain += op.Retain
+			return
+		}
+	}
+
+	d.Ops = append(d.Ops, DeltaOp{})
+	copy(d.Ops[index+1:], d.Ops[index:])
+	d.Ops[index] = op
+}
+
+// chop removes a trailing plain retain, which changes nothing
+func (d *Delta) chop() *Delta {
+	if n := len(d.Ops); n > 0 && d.Ops[n-1].isRetain() && d.Ops[n-1].Attributes == nil {
+		d.Ops = d.Ops[:n-1]
+	}
+
+	return d
+}
+
+// Compose returns the delta that has the same effect as applying d and then other
+func (d *Delta) Compose(other *Delta) *Delta {
+	a := newDeltaIterator(d)
+	b := newDeltaIterator(other)
+	result := &Delta{}
+
+	for a.hasNext() || b.hasNext() {
+		if b.peek().isInsert() {
+			result.push(b.next(deltaInfinity))
+		} else if a.peek().isDelete() {
+			result.push(a.next(deltaInfinity))
+		} else {
+			length := minInt(a.peekLength(), b.peekLength())
+			aOp := a.next(length)
+			bOp := b.next(length)
+
+			if bOp.isRetain() {
+				op := DeltaOp{}
+				if aOp.isRetain() {
+					op.Retain = length
+				} else {
+					op.Insert = aOp.Insert
+				}
+				op.Attributes = composeAttributes(aOp.Attributes, bOp.Attributes, aOp.isRetain())
+				result.push(op)
+			} else if bOp.isDelete() && aOp.isRetain() {
+				result.push(bOp)
+			}
+			// otherwise text inserted by d is deleted by other and both disappear
+		}
+	}
+
+	return result.chop()
+}
+
+// Transform returns other rewritten to apply after d, when both were made on the same document.
+// If priority is true d is considered to have happened first, so its inserts go first.
+func (d *Delta) Transform(other *Delta, priority bool) *Delta {
+	a := newDeltaIterator(d)
+	b := newDeltaIterator(other)
+	result := &Delta{}
+
+	for a.hasNext() || b.hasNext() {
+		if a.peek().isInsert() && (priority || !b.peek().isInsert()) {
+			result.push(DeltaOp{Retain: a.next(deltaInfinity).length()})
+		} else if b.peek().isInsert() {
+			result.push(b.next(deltaInfinity))
+		} else {
+			length := minInt(a.peekLength(), b.peekLength())
+			aOp := a.next(length)
+			bOp := b.next(length)
+
+			if aOp.isDelete() {
+				// the text other works on is already gone
+				continue
+			} else if bOp.isDelete() {
+				result.push(bOp)
+			} else {
+				result.push(DeltaOp{Retain: length, Attributes: transformAttributes(aOp.Attributes, bOp.Attributes, priority)})
+			}
+		}
+	}
+
+	return result.chop()
+}
+
+// apply composes a change onto a document after checking that it fits
+func (d *Delta) apply(change *Delta) (*Delta, error) {
+	if change.baseLength() > d.Length() {
+		return nil, errDeltaLength
+	}
+
+	return d.Compose(change), nil
+}
+
+// composeAttributes combines formatting, with b taking precedence.
+// Null values remove formatting and are only kept when composing two changes.
+func composeAttributes(a, b map[string]interface{}, keepNull bool) map[string]interface{} {
+	attributes := map[string]interface{}{}
+	for k, v := range b {
+		if v != nil || keepNull {
+			attributes[k] = v
+		}
+	}
+
+	for k, v := range a {
+		if _, ok := b[k]; !ok {
+			attributes[k] = v
+		}
+	}
+
+	if len(attributes) == 0 {
+		return nil
+	}
+
+	return attributes
+}
+
+// transformAttributes drops the formatting in b that a already changed, when a went first
+func transformAttributes(a, b map[string]interface{}, priority bool) map[string]interface{} {
+	if a == nil || !priority {
+		return b
+	}
+
+	attributes := map[string]interface{}{}
+	for k, v := range b {
+		if _, ok := a[k]; !ok {
+			attributes[k] = v
+		}
+	}
+
+	if len(attributes) == 0 {
+		return nil
+	}
+
+	return attributes
+}
+
+// deltaIterator walks over the operations of a delta, splitting them as needed
+type deltaIterator struct {
+	ops    []DeltaOp
+	index  int
+	offset int
+}
+
+func newDeltaIterator(d *Delta) *deltaIterator {
+	return &deltaIterator{ops: d.Ops}
+}
+
+func (it *deltaIterator) hasNext() bool {
+	return it.peekLength() < deltaInfinity
+}
+
+// peek returns the current operation, or an endless retain when there are none left
+func (it *deltaIterator) peek() DeltaOp {
+	if it.index < len(it.ops) {
+		return it.ops[it.index]
+	}
+
+	return DeltaOp{Retain: deltaInfinity}
+}
+
+func (it *deltaIterator) peekLength() int {
+	if it.index < len(it.ops) {
+		return it.ops[it.index].length() - it.offset
+	}
+
+	return deltaInfinity
+}
+
+// next returns up to length characters of the current operation
+func (it *deltaIterator) next(length int) DeltaOp {
+	if it.index >= len(it.ops) {
+		return DeltaOp{Retain: deltaInfinity}
+	}
+
+	op := it.ops[it.index]
+	offset := it.offset
+	opLength := op.length()
+	if length >= opLength-offset {
+		length = opLength - offset
+		it.index++
+		it.offset = 0
+	} else {
+		it.offset += length
+	}
+
+	if op.isDelete() {
+		return DeltaOp{Delete: length}
+	}
+
+	part := DeltaOp{Attributes: op.Attributes}
+	if op.isRetain() {
+		part.Retain = length
+	} else if text, ok := op.Insert.(string); ok {
+		units := utf16.Encode([]rune(text))
+		part.Insert = string(utf16.Decode(units[offset : offset+length]))
+	} else {
+		part.Insert = op.Insert
+	}
+
+	return part
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// valid checks that every operation is exactly one well formed insert, delete or retain
+func (d *Delta) valid() bool {
+	for _, op := range d.Ops {
+		switch insert := op.Insert.(type) {
+		case nil:
+			if (op.Delete > 0) == (op.Retain > 0) || op.Delete < 0 || op.Retain < 0 {
+				return false
+			}
+			if op.Delete > 0 && op.Attributes != nil {
+				return false
+			}
+		case string:
+			if insert == "" || op.Delete != 0 || op.Retain != 0 {
+				return false
+			}
+		case map[string]interface{}:
+			if len(insert) != 1 || op.Delete != 0 || op.Retain != 0 {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,788 @@
+package models
+
+import (
+	"encoding/json"
+	"html"
+	"html/template"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Documents store their content as an encrypted Quill Delta. The HTML shown to readers and used
+// for exports is rendered from the Delta on the server, in the same markup Quill itself produces.
+
+// safeColor matches the colour values allowed in rendered style attributes
+var safeColor = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|rgb\([0-9, ]+\)|[a-zA-Z]+)$`)
+
+// safeURL matches the links allowed in rendered documents, like Quill's own link sanitiser
+var safeURL = regexp.MustCompile(`^(https?:|mailto:|tel:|/|#|\?|[^:]*$)`)
+
+// safeImageURL matches the image sources allowed in rendered documents
+var safeImageURL = regexp.MustCompile(`^(https?:|/|data:image/|[^:]*$)`)
+
+// qlClass matches the alignment and indent classes Quill puts on blocks
+var qlClass = regexp.MustCompile(`ql-(align|indent|direction)-([a-z0-9]+)`)
+
+func sanitizeURL(url string, allowed *regexp.Regexp) string {
+	url = strings.TrimSpace(url)
+	if !allowed.MatchString(strings.ToLower(url)) {
+		return "about:blank"
+	}
+
+	return url
+}
+
+// encryptDelta encrypts the JSON of a Delta for storage
+func encryptDelta(delta *Delta) ([]byte, error) {
+	b, err := json.Marshal(delta)
+	if err != nil {
+		return nil, err
+	}
+
+	return encryptBytes(b)
+}
+
+// decryptDelta decrypts a stored Delta. It returns nil if nothing was stored.
+func decryptDelta(ciphertext []byte) (*Delta, error) {
+	if len(ciphertext) == 0 {
+		return nil, nil
+	}
+
+	b, err := decryptBytes(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	delta := &Delta{}
+	err = json.Unmarshal(b, delta)
+	if err != nil {
+		return nil, err
+	}
+
+	return delta, nil
+}
+
+// parseDelta reads a Delta posted by the editor. It returns nil if the Delta is missing or not a document.
+func parseDelta(s string) *Delta {
+	if s == "" {
+		return nil
+	}
+
+	delta := &Delta{}
+	err := json.Unmarshal([]byte(s), delta)
+	if err != nil || !delta.valid() || !delta.isDocument() {
+		return nil
+	}
+
+	return delta
+}
+
+// setContent replaces the published content of the document, keeping the Delta and the HTML rendered from it
+func (d *Document) setContent(delta *Delta) (template.HTML, error) {
+	body := renderDelta(delta)
+	err := d.encrypt(body)
+	if err != nil {
+		return "", err
+	}
+
+	d.Delta, err = encryptDelta(delta)
+	return body, err
+}
+
+// contentDelta returns the Delta of the published content, converting the HTML body of documents
+// that were saved before Deltas were stored
+func (d *Document) contentDelta() (*Delta, error) {
+	delta, err := decryptDelta(d.Delta)
+	if err != nil || delta != nil {
+		return delta, err
+	}
+
+	body, err := d.decrypt()
+	if err != nil {
+		return nil, err
+	}
+
+	return htmlToDelta(string(body)), nil
+}
+
+// workingDelta returns the Delta editors should continue working on
+func (d *Document) workingDelta() (*Delta, error) {
+	if d.Draft == nil {
+		return d.contentDelta()
+	}
+
+	delta, err := decryptDelta(d.Draft.Delta)
+	if err != nil || delta != nil {
+		return delta, err
+	}
+
+	body, err := d.draftBody()
+	if err != nil {
+		return nil, err
+	}
+
+	return htmlToDelta(string(body)), nil
+}
+
+// renderDelta renders a document Delta as HTML, the way Quill renders it in the editor
+func renderDelta(delta *Delta) template.HTML {
+	r := &deltaRenderer{}
+
+	for _, op := range delta.Ops {
+		text, ok := op.Insert.(string)
+		if !ok {
+			if embed, ok := op.Insert.(map[string]interface{}); ok {
+				r.line.WriteString(renderInline(renderEmbed(embed), op.Attributes))
+				r.pending = true
+			}
+			continue
+		}
+
+		lines := strings.Split(text, "\n")
+		for i, line := range lines {
+			if line != "" {
+				r.line.WriteString(renderInline(html.EscapeString(line), op.Attributes))
+				r.pending = true
+			}
+
+			// every newline ends a line, and carries the line's block formats
+			if i < len(lines)-1 {
+				r.endLine(op.Attributes)
+			}
+		}
+	}
+
+	// a Delta should end with a newline, but don't lose content when it doesn't
+	if r.pending {
+		r.endLine(nil)
+	}
+	r.closeGroup()
+
+	return template.HTML(r.out.String())
+}
+
+// deltaRenderer collects the lines of a Delta into blocks.
+// Consecutive list items and code lines are grouped into one list or code block.
+type deltaRenderer struct {
+	out     strings.Builder
+	line    strings.Builder
+	pending bool
+	group   string
+	code    []string
+	// language is the language of the code block being collected
+	language string
+}
+
+// endLine writes the collected line as a block with the given line formats
+func (r *deltaRenderer) endLine(attributes map[string]interface{}) {
+	content := r.line.String()
+	r.line.Reset()
+	r.pending = false
+
+	if language, ok := codeLanguage(attributes); ok {
+		// code lines in another language start a new code block
+		if r.group != "pre" || r.language != language {
+			r.closeGroup()
+			r.group = "pre"
+			r.language = language
+		}
+		// code is shown as plain text, drop the inline formatting
+		r.code = append(r.code, stripTags(content))
+		return
+	}
+
+	tag := "p"
+	group := ""
+	if n, ok := attributes["header"].(float64); ok && n >= 1 && n <= 6 {
+		tag = "h" + strconv.Itoa(int(n))
+	} else if isTrue(attributes["blockquote"]) {
+		tag = "blockquote"
+	} else if list, ok := attributes["list"].(string); ok {
+		tag = "li"
+		group = "ul"
+		if list == "ordered" {
+			group = "ol"
+		}
+	}
+
+	if group != r.group {
+		r.closeGroup()
+		if group != "" {
+			r.out.WriteString("<" + group + ">")
+		}
+		r.group = group
+	}
+
+	if content == "" {
+		content = "<br>"
+	}
+
+	r.out.WriteString("<" + tag + blockClass(attributes) + ">" + content + "</" + tag + ">")
+}
+
+func (r *deltaRenderer) closeGroup() {
+	switch r.group {
+	case "pre":
+		language := ""
+		if r.language != "" {
+			language = ` data-language="` + r.language + `"`
+		}
+		r.out.WriteString(`<pre class="ql-syntax" spellcheck="false"` + language + ">" + strings.Join(r.code, "\n") + "\n</pre>")
+		r.code = nil
+		r.language = ""
+	case "ul", "ol":
+		r.out.WriteString("</" + r.group + ">")
+	}
+	r.group = ""
+}
+
+// blockClass returns the class attribute for a line's alignment, indent and direction
+func blockClass(attributes map[string]interface{}) string {
+	var classes []string
+	if align, ok := attributes["align"].(string); ok && safeColor.MatchString(align) {
+		classes = append(classes, "ql-align-"+align)
+	}
+	if indent, ok := attributes["indent"].(float64); ok && indent > 0 && indent <= 8 {
+		classes = append(classes, "ql-indent-"+strconv.Itoa(int(indent)))
+	}
+	if dir, ok := attributes["direction"].(string); ok && dir == "rtl" {
+		classes = append(classes, "ql-direction-rtl")
+	}
+
+	if len(classes) == 0 {
+		return ""
+	}
+
+	return ` class="` + strings.Join(classes, " ") + `"`
+}
+
+// renderInline wraps escaped content in the tags for its inline formats
+func renderInline(content string, attributes map[string]interface{}) string {
+	if isTrue(attributes["code"]) {
+		content = "<code>" + content + "</code>"
+	}
+	if script, ok := attributes["script"].(string); ok && (script == "sub" || script == "super") {
+		tag := "sub"
+		if script == "super" {
+			tag = "sup"
+		}
+		content = "<" + tag + ">" + content + "</" + tag + ">"
+	}
+	if isTrue(attributes["strike"]) {
+		content = "<s>" + content + "</s>"
+	}
+	if isTrue(attributes["underline"]) {
+		content = "<u>" + content + "</u>"
+	}
+	if isTrue(attributes["italic"]) {
+		content = "<em>" + content + "</em>"
+	}
+	if isTrue(attributes["bold"]) {
+		content = "<strong>" + content + "</strong>"
+	}
+
+	var styles []string
+	if color, ok := attributes["color"].(string); ok && safeColor.MatchString(color) {
+		styles = append(styles, "color: "+color+";")
+	}
+	if background, ok := attributes["background"].(string); ok && safeColor.MatchString(background) {
+		styles = append(styles, "background-color: "+background+";")
+	}
+	if len(styles) > 0 {
+		content = `<span style="` + strings.Join(styles, " ") + `">` + content + "</span>"
+	}
+
+	if link, ok := attributes["link"].(string); ok {
+		content = `<a href="` + html.EscapeString(sanitizeURL(link, safeURL)) + `" target="_blank">` + content + "</a>"
+	}
+
+	return content
+}
+
+// renderEmbed renders an embedded image or video
+func renderEmbed(embed map[string]interface{}) string {
+	if src, ok := embed["image"].(string); ok {
+		return `<img src="` + html.EscapeString(sanitizeURL(src, safeImageURL)) + `">`
+	}
+	if src, ok := embed["video"].(string); ok {
+		return `<iframe class="ql-video" frameborder="0" allowfullscreen="true" src="` + html.EscapeString(sanitizeURL(src, safeURL)) + `"></iframe>`
+	}
+
+	return ""
+}
+
+func isTrue(v interface{}) bool {
+	b, ok := v.(bool)
+	return ok && b
+}
+
+// stripTags removes the tags from rendered inline content, leaving the escaped text
+func stripTags(content string) string {
+	return htmlTag.ReplaceAllString(content, "")
+}
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// htmlToDelta converts an HTML body into a document Delta.
+// It understands the markup Quill produces, and reasonably handles other HTML.
+func htmlToDelta(body string) *Delta {
+	nodes, err := xhtml.ParseFragment(strings.NewReader(body), &xhtml.Node{Type: xhtml.ElementNode, Data: "body", DataAtom: atom.Body})
+	c := &deltaConverter{delta: &Delta{}}
+	if err == nil {
+		for _, n := range nodes {
+			c.walk(n, nil, nil)
+		}
+	}
+
+	if c.lineOpen || len(c.delta.Ops) == 0 {
+		c.delta.push(DeltaOp{Insert: "\n"})
+	}
+
+	return c.delta
+}
+
+// deltaConverter builds a Delta while walking an HTML tree
+type deltaConverter struct {
+	delta    *Delta
+	lineOpen bool
+	// emitted counts the inserts made, to tell if a block had any content
+	emitted int
+}
+
+// blockTags are elements that start a new line
+var blockTags = map[atom.Atom]bool{
+	atom.P: true, atom.Div: true, atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Li: true, atom.Blockquote: true, atom.Pre: true, atom.Ul: true, atom.Ol: true, atom.Section: true, atom.Article: true,
+	atom.Header: true, atom.Footer: true, atom.Main: true, atom.Nav: true, atom.Aside: true, atom.Figure: true, atom.Figcaption: true,
+	atom.Table: true, atom.Tr: true, atom.Dl: true, atom.Dt: true, atom.Dd: true, atom.Hr: true, atom.Address: true,
+}
+
+// skipTags are elements whose content isn't part of the document
+var skipTags = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Head: true, atom.Title: true, atom.Noscript: true, atom.Template: true,
+}
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+func (c *deltaConverter) text(s string, inline map[string]interface{}) {
+	if s == "" {
+		return
+	}
+
+	c.delta.push(DeltaOp{Insert: s, Attributes: copyAttributes(inline)})
+	c.lineOpen = true
+	c.emitted++
+}
+
+func (c *deltaConverter) embed(embed map[string]interface{}, inline map[string]interface{}) {
+	c.delta.push(DeltaOp{Insert: embed, Attributes: copyAttributes(inline)})
+	c.lineOpen = true
+	c.emitted++
+}
+
+func (c *deltaConverter) newline(block map[string]interface{}) {
+	c.delta.push(DeltaOp{Insert: "\n", Attributes: copyAttributes(block)})
+	c.lineOpen = false
+	c.emitted++
+}
+
+func (c *deltaConverter) walk(n *xhtml.Node, inline map[string]interface{}, block map[string]interface{}) {
+	switch n.Type {
+	case xhtml.TextNode:
+		s := whitespace.ReplaceAllString(n.Data, " ")
+		if !c.lineOpen {
+			s = strings.TrimLeft(s, " ")
+		}
+		c.text(s, inline)
+		return
+	case xhtml.ElementNode:
+	default:
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			c.walk(child, inline, block)
+		}
+		return
+	}
+
+	if skipTags[n.DataAtom] {
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Br:
+		// a break at the end of a block only keeps the block from collapsing
+		if n.NextSibling != nil || n.Parent == nil || !blockTags[n.Parent.DataAtom] {
+			c.newline(block)
+		}
+		return
+	case atom.Img:
+		if src := attr(n, "src"); src != "" {
+			c.embed(map[string]interface{}{"image": src}, inline)
+		}
+		return
+	case atom.Iframe:
+		if src := attr(n, "src"); src != "" {
+			c.embed(map[string]interface{}{"video": src}, inline)
+		}
+		return
+	case atom.Pre:
+		c.pre(n, block)
+		return
+	}
+
+	if blockTags[n.DataAtom] {
+		c.blockElement(n, inline, block)
+		return
+	}
+
+	inline = inlineFormats(n, inline)
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		c.walk(child, inline, block)
+	}
+
+	// keep table cells apart
+	if (n.DataAtom == atom.Td || n.DataAtom == atom.Th) && c.lineOpen && n.NextSibling != nil {
+		c.text(" ", nil)
+	}
+}
+
+// blockElement converts an element that forms its own line, or contains lines
+func (c *deltaConverter) blockElement(n *xhtml.Node, inline map[string]interface{}, block map[string]interface{}) {
+	// text before the block belongs to a line of its own
+	if c.lineOpen {
+		c.newline(block)
+	}
+
+	block = blockFormats(n, block)
+	before := c.emitted
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		c.walk(child, inline, block)
+	}
+
+	switch n.DataAtom {
+	case atom.Ul, atom.Ol, atom.Table, atom.Dl:
+		// containers only hold other blocks
+		if c.lineOpen {
+			c.newline(block)
+		}
+	default:
+		// empty paragraphs are kept as empty lines
+		if c.lineOpen || c.emitted == before {
+			c.newline(block)
+		}
+	}
+}
+
+// pre converts a code block, keeping its text as it is
+func (c *deltaConverter) pre(n *xhtml.Node, block map[string]interface{}) {
+	if c.lineOpen {
+		c.newline(block)
+	}
+
+	code := strings.TrimSuffix(textContent(n), "\n")
+	codeBlock := copyAttributes(block)
+	if codeBlock == nil {
+		codeBlock = map[string]interface{}{}
+	}
+	codeBlock["code-block"] = true
+	if language := preLanguage(n); language != "" {
+		codeBlock["code-block"] = language
+	}
+
+	for _, line := range strings.Split(code, "\n") {
+		c.text(line, nil)
+		c.newline(codeBlock)
+	}
+}
+
+// preLanguage finds the language of a code block, from Quill's data-language
+// or the language- class Markdown puts on the code inside
+func preLanguage(n *xhtml.Node) string {
+	if language := attr(n, "data-language"); language != "" {
+		return languageChars.ReplaceAllString(strings.ToLower(language), "")
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != xhtml.ElementNode || c.DataAtom != atom.Code {
+			continue
+		}
+		for _, class := range strings.Fields(attr(c, "class")) {
+			if strings.HasPrefix(class, "language-") {
+				return languageChars.ReplaceAllString(strings.ToLower(strings.TrimPrefix(class, "language-")), "")
+			}
+		}
+	}
+
+	return ""
+}
+
+// blockFormats returns the line formats of a block element, added to those of its parents
+func blockFormats(n *xhtml.Node, parent map[string]interface{}) map[string]interface{} {
+	block := copyAttributes(parent)
+	if block == nil {
+		block = map[string]interface{}{}
+	}
+
+	switch n.DataAtom {
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		block["header"] = float64(n.Data[1] - '0')
+	case atom.Blockquote:
+		block["blockquote"] = true
+	case atom.Ul:
+		block["list"] = "bullet"
+	case atom.Ol:
+		block["list"] = "ordered"
+	case atom.Li:
+		if _, ok := block["list"]; !ok {
+			block["list"] = "bullet"
+		}
+	case atom.P, atom.Div:
+		// paragraphs inside list items stay list items, everywhere else they are plain lines
+		if n.Parent == nil || n.Parent.DataAtom != atom.Li {
+			delete(block, "list")
+		}
+	}
+
+	for _, m := range qlClass.FindAllStringSubmatch(attr(n, "class"), -1) {
+		switch m[1] {
+		case "align", "direction":
+			block[m[1]] = m[2]
+		case "indent":
+			if i, err := strconv.Atoi(m[2]); err == nil {
+				block["indent"] = float64(i)
+			}
+		}
+	}
+
+	if align := styleValue(n, "text-align"); align == "center" || align == "right" || align == "justify" {
+		block["align"] = align
+	}
+
+	return block
+}
+
+// inlineFormats returns the text formats of an inline element, added to those of its parents
+func inlineFormats(n *xhtml.Node, parent map[string]interface{}) map[string]interface{} {
+	inline := copyAttributes(parent)
+	if inline == nil {
+		inline = map[string]interface{}{}
+	}
+
+	switch n.DataAtom {
+	case atom.Strong, atom.B:
+		inline["bold"] = true
+	case atom.Em, atom.I:
+		inline["italic"] = true
+	case atom.U, atom.Ins:
+		inline["underline"] = true
+	case atom.S, atom.Strike, atom.Del:
+		inline["strike"] = true
+	case atom.Code, atom.Kbd, atom.Samp, atom.Tt:
+		inline["code"] = true
+	case atom.Sub:
+		inline["script"] = "sub"
+	case atom.Sup:
+		inline["script"] = "super"
+	case atom.A:
+		if href := attr(n, "href"); href != "" {
+			inline["link"] = href
+		}
+	}
+
+	if color := styleValue(n, "color"); color != "" && safeColor.MatchString(color) {
+		inline["color"] = color
+	}
+	if background := styleValue(n, "background-color"); background != "" && safeColor.MatchString(background) {
+		inline["background"] = background
+	}
+	if weight := styleValue(n, "font-weight"); weight == "bold" || weight == "700" {
+		inline["bold"] = true
+	}
+	if style := styleValue(n, "font-style"); style == "italic" {
+		inline["italic"] = true
+	}
+
+	return inline
+}
+
+func attr(n *xhtml.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+
+	return ""
+}
+
+// styleValue returns the value of a property in an element's style attribute
+func styleValue(n *xhtml.Node, property string) string {
+	for _, decl := range strings.Split(attr(n, "style"), ";") {
+		parts := strings.SplitN(decl, ":", 2)
+		if len(parts) == 2 && strings.TrimSpace(strings.ToLower(parts[0])) == property {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+
+	return ""
+}
+
+func textContent(n *xhtml.Node) string {
+	if n.Type == xhtml.TextNode {
+		return n.Data
+	}
+
+	var sb strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == xhtml.ElementNode && child.DataAtom == atom.Br {
+			sb.WriteString("\n")
+			continue
+		}
+		sb.WriteString(textContent(child))
+	}
+
+	return sb.String()
+}
+
+func copyAttributes(attributes map[string]interface{}) map[string]interface{} {
+	if len(attributes) == 0 {
+		return nil
+	}
+
+	c := make(map[string]interface{}, len(attributes))
+	for k, v := range attributes {
+		c[k] = v
+	}
+
+	return c
+}
+
+// lossyTags are elements a Delta has no format for. Their text is kept, but not their structure.
+var lossyTags = map[atom.Atom]bool{
+	atom.Table: true, atom.Dl: true, atom.Form: true, atom.Input: true, atom.Select: true, atom.Textarea: true,
+	atom.Button: true, atom.Object: true, atom.Embed: true, atom.Audio: true, atom.Video: true, atom.Canvas: true,
+	atom.Svg: true, atom.Math: true, atom.Details: true,
+}
+
+// lossyMarkup lists the elements of an HTML body that are lost when it is converted to a Delta
+func lossyMarkup(body string) []string {
+	nodes, err := xhtml.ParseFragment(strings.NewReader(body), &xhtml.Node{Type: xhtml.ElementNode, Data: "body", DataAtom: atom.Body})
+	if err != nil {
+		return nil
+	}
+
+	found := map[string]bool{}
+	var walk func(n *xhtml.Node)
+	walk = func(n *xhtml.Node) {
+		if n.Type == xhtml.ElementNode && lossyTags[n.DataAtom] {
+			found[n.Data] = true
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	for _, n := range nodes {
+		walk(n)
+	}
+
+	tags := make([]string, 0, len(found))
+	for tag := range found {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	return tags
+}
+
+// BackfillDeltas stores a Delta for every document, and its draft, that only has an HTML body.
+// Documents that only have a draft get no published body. The body is rendered again from the new Delta.
+// It returns the number of documents that were changed, and warnings for the ones that lost markup.
+func BackfillDeltas(db *DB) (int, []string, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(documentCol)
+
+	query := bson.M{"$or": []bson.M{
+		bson.M{"delta": bson.M{"$exists": false}},
+		bson.M{"draft": bson.M{"$ne": nil}, "draft.delta": bson.M{"$exists": false}},
+	}}
+
+	var docs []Document
+	err := collection.Find(query).All(&docs)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	changed := 0
+	var warnings []string
+	lost := func(d *Document, version string, body template.HTML) {
+		if tags := lossyMarkup(string(body)); len(tags) > 0 {
+			warning := d.ID.Hex() + " " + strconv.Quote(d.Title) + ": the " + version + " lost its " + strings.Join(tags, ", ")
+			InfoLogger.Print("Delta backfill lost markup {id: " + d.ID.Hex() + ", version: " + version + ", tags: " + strings.Join(tags, ",") + "}")
+			warnings = append(warnings, warning)
+		}
+	}
+
+	// a version that can't be decrypted is left as it is, the other one is still backfilled
+	for i := range docs {
+		d := &docs[i]
+		set := bson.M{}
+
+		if len(d.Delta) == 0 && (len(d.Body) > 0 || d.Draft == nil) {
+			body, err := d.decrypt()
+			if err != nil {
+				ErrorLogger.Print("Could not decrypt document during Delta backfill {id: "+d.ID.Hex()+"} ", err)
+				warnings = append(warnings, d.ID.Hex()+" "+strconv.Quote(d.Title)+": could not be decrypted, it was left as it is")
+			} else {
+				lost(d, "published version", body)
+
+				_, err = d.setContent(htmlToDelta(string(body)))
+				if err != nil {
+					return changed, warnings, err
+				}
+				set["body"] = d.Body
+				set["delta"] = d.Delta
+			}
+		}
+
+		if d.Draft != nil && len(d.Draft.Delta) == 0 {
+			body, err := d.draftBody()
+			if err != nil {
+				ErrorLogger.Print("Could not decrypt draft during Delta backfill {id: "+d.ID.Hex()+"} ", err)
+				warnings = append(warnings, d.ID.Hex()+" "+strconv.Quote(d.Title)+": the draft could not be decrypted, it was left as it is")
+			} else {
+				lost(d, "draft", body)
+
+				delta := htmlToDelta(string(body))
+				ciphertext, err := encryptBytes([]byte(renderDelta(delta)))
+				if err != nil {
+					return changed, warnings, err
+				}
+				deltaCiphertext, err := encryptDelta(delta)
+				if err != nil {
+					return changed, warnings, err
+				}
+				set["draft.body"] = ciphertext
+				set["draft.delta"] = deltaCiphertext
+			}
+		}
+
+		if len(set) == 0 {
+			continue
+		}
+
+		err = collection.UpdateId(d.ID, bson.M{"$set": set})
+		if err != nil {
+			return changed, warnings, err
+		}
+
+		changed++
+	}
+
+	return changed, warnings, nil
+}
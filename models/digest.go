@@ -0,0 +1,530 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/unrolled/render"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Change records a change to a document or folder, for the digest emails
+type Change struct {
+	ID         bson.ObjectId `json:"id" bson:"_id"`
+	Event      string        `json:"event"`
+	DocumentID bson.ObjectId `json:"documentID" bson:"documentID,omitempty"`
+	FolderID   bson.ObjectId `json:"folderID" bson:"folderID,omitempty"`
+	// Title is the title of the document or the name of the folder when it changed
+	Title    string        `json:"title"`
+	Summary  string        `json:"summary,omitempty" bson:"summary,omitempty"`
+	Detail   string        `json:"detail,omitempty" bson:"detail,omitempty"`
+	UserID   bson.ObjectId `json:"userID" bson:"userID"`
+	UserName string        `json:"userName" bson:"userName"`
+	Created  time.Time     `json:"created"`
+}
+
+// DigestFolder is the changes in one folder, as they are listed in a digest
+type DigestFolder struct {
+	Name    string
+	Changes []Change
+}
+
+const changeCol = "changes"
+
+// how often users can get a digest of the changes
+const (
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+var digestPeriods = map[string]time.Duration{
+	DigestDaily:  24 * time.Hour,
+	DigestWeekly: 7 * 24 * time.Hour,
+}
+
+// digestSlack keeps digests from drifting later every time, since the digest mailer only checks once an hour
+const digestSlack = 10 * time.Minute
+
+// maxDigestChanges is the number of changes a single digest lists
+const maxDigestChanges = 200
+
+// unfiledFolder names the group of documents that aren't in a folder
+const unfiledFolder = "Not in a folder"
+
+// DigestSettingsHandler changes how often the user gets a digest of the changes
+func DigestSettingsHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		frequency := r.FormValue("digest")
+		if _, ok := digestPeriods[frequency]; !ok {
+			frequency = ""
+		}
+
+		err := setDigest(db, user.ID, frequency)
+		if err != nil {
+			ErrorLogger.Print("Could not change digest {userID: "+user.ID.Hex()+", digest: "+frequency+"} ", err)
+			s.AddFlash("Error! Could not change your digest. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/notifications/", http.StatusFound)
+			return
+		}
+
+		InfoLogger.Print("Digest changed {userID: " + user.ID.Hex() + ", digest: " + frequency + "}")
+		if frequency == "" {
+			s.AddFlash("You won't get digest emails anymore", "success")
+		} else {
+			s.AddFlash("You'll get a "+frequency+" email with the changes in the wiki", "success")
+		}
+		s.Save(r, w)
+		http.Redirect(w, r, "/notifications/", http.StatusFound)
+	}
+}
+
+// DigestUnsubscribeHandler stops the digest emails of the user the token in the link belongs to,
+// without logging in. Visiting the link asks to confirm, so link checkers in mail clients don't unsubscribe anyone.
+// Mail clients that support one-click unsubscribing POST to it directly.
+func DigestUnsubscribeHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		token := vars["token"]
+
+		u, err := findUserByDigestToken(db, token)
+		if err != nil {
+			renderDigestPage(rend, w, http.StatusNotFound, "digest/unsubscribe", map[string]interface{}{
+				"unknown": true,
+			})
+			return
+		}
+
+		data := map[string]interface{}{
+			"email":  u.Email,
+			"digest": u.Digest,
+		}
+
+		if r.Method == "POST" {
+			err = setDigest(db, u.ID, "")
+			if err != nil {
+				ErrorLogger.Print("Could not unsubscribe from digest {userID: "+u.ID.Hex()+"} ", err)
+				http.Error(w, "Could not unsubscribe, please try again later", http.StatusInternalServerError)
+				return
+			}
+
+			InfoLogger.Print("Digest unsubscribed {userID: " + u.ID.Hex() + "}")
+			data["unsubscribed"] = true
+		}
+
+		renderDigestPage(rend, w, http.StatusOK, "digest/unsubscribe", data)
+	}
+}
+
+// renderDigestPage renders a page that is used without logging in, without the site's navigation
+func renderDigestPage(rend *render.Render, w http.ResponseWriter, status int, tmpl string, data map[string]interface{}) {
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	err := rend.HTML(w, status, tmpl, data, render.HTMLOptions{Layout: "share/layout"})
+	if err != nil {
+		ErrorLogger.Print("Could not render digest page "+tmpl+" ", err)
+	}
+}
+
+// DigestMailer sends the users that asked for it a digest of the changes since their last one.
+// It checks once an hour and never returns, so run it in its own goroutine.
+func DigestMailer(db *DB) {
+	for {
+		count, err := sendDigests(db, time.Now())
+		if err != nil {
+			ErrorLogger.Print("Error sending digests.\n", err)
+		} else if count > 0 {
+			InfoLogger.Print("Sent " + strconv.Itoa(count) + " digests")
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
+
+// sendDigests sends a digest to every user whose digest is due, and returns how many were sent.
+// Users without any changes to read about aren't sent an empty email.
+func sendDigests(db *DB, now time.Time) (int, error) {
+	users, err := findDigestUsers(db)
+	if err != nil {
+		return 0, err
+	}
+
+	cache := &digestCache{docs: map[bson.ObjectId]*Document{}, folders: map[bson.ObjectId]*Folder{}}
+	sent := 0
+	for i := range users {
+		u := &users[i]
+		// users without an email address have nowhere to get a digest
+		if u.Email == "" {
+			continue
+		}
+
+		period := digestPeriods[u.Digest]
+		if now.Sub(u.DigestSent) < period-digestSlack {
+			continue
+		}
+
+		since := u.DigestSent
+		if since.IsZero() {
+			since = now.Add(-period)
+		}
+
+		folders, collected, err := collectDigest(db, cache, u, since, now)
+		if err != nil {
+			ErrorLogger.Print("Could not collect digest {userID: "+u.ID.Hex()+"} ", err)
+			continue
+		}
+
+		more := collected.Before(now)
+		if len(folders) > 0 {
+			sendMail(digestMail(u, folders, since, more))
+			sent++
+		}
+
+		// changes left out of a full digest are sent in the next one
+		err = setDigestSent(db, u.ID, collected)
+		if err != nil {
+			ErrorLogger.Print("Could not record digest {userID: "+u.ID.Hex()+"} ", err)
+		}
+	}
+
+	return sent, nil
+}
+
+// digestCache keeps the documents and folders that changed while the digests of all users are collected
+type digestCache struct {
+	docs    map[bson.ObjectId]*Document
+	folders map[bson.ObjectId]*Folder
+}
+
+// document finds a document, including those in the trash. It is nil once the document is purged.
+func (c *digestCache) document(db *DB, id bson.ObjectId) *Document {
+	d, ok := c.docs[id]
+	if !ok {
+		d = &Document{}
+		if err := findByID(db, documentCol, id, d); err != nil {
+			d = nil
+		}
+		c.docs[id] = d
+	}
+
+	return d
+}
+
+// folder finds a folder, including those in the trash. It is nil once the folder is purged.
+func (c *digestCache) folder(db *DB, id bson.ObjectId) *Folder {
+	f, ok := c.folders[id]
+	if !ok {
+		f = &Folder{}
+		if err := findByID(db, col, id, f); err != nil {
+			f = nil
+		}
+		c.folders[id] = f
+	}
+
+	return f
+}
+
+// collectDigest finds the changes by others between since and until that u may see, grouped by folder.
+// A digest holds at most maxDigestChanges, so it also returns the time up to which changes were collected,
+// which is before until when there were more.
+func collectDigest(db *DB, cache *digestCache, u *User, since, until time.Time) ([]DigestFolder, time.Time, error) {
+	changes, err := findChanges(db, since, until)
+	if err != nil {
+		return nil, since, err
+	}
+
+	groups := map[string]*DigestFolder{}
+	var names []string
+	count := 0
+	collected := until
+	var last time.Time
+	for _, c := range changes {
+		if c.UserID == u.ID || !cache.visible(db, u, &c) {
+			continue
+		}
+
+		// changes made at the same moment go in the same digest, so none are skipped by the next one
+		if count >= maxDigestChanges && !c.Created.Equal(last) {
+			collected = last
+			break
+		}
+		last = c.Created
+
+		name := unfiledFolder
+		if c.FolderID != "" {
+			if f := cache.folder(db, c.FolderID); f != nil {
+				name = f.Name
+			}
+		}
+
+		group, ok := groups[name]
+		if !ok {
+			group = &DigestFolder{Name: name}
+			groups[name] = group
+			names = append(names, name)
+		}
+		group.Changes = append(group.Changes, c)
+		count++
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		if names[i] == unfiledFolder || names[j] == unfiledFolder {
+			return names[j] == unfiledFolder && names[i] != unfiledFolder
+		}
+		return strings.ToLower(names[i]) < strings.ToLower(names[j])
+	})
+
+	folders := make([]DigestFolder, 0, len(names))
+	for _, name := range names {
+		folders = append(folders, *groups[name])
+	}
+
+	return folders, collected, nil
+}
+
+// visible checks if u may read about a change, with the same rules as notifications
+func (c *digestCache) visible(db *DB, u *User, change *Change) bool {
+	if change.DocumentID == "" {
+		f := c.folder(db, change.FolderID)
+		return f != nil && f.visibleTo(u)
+	}
+
+	d := c.document(db, change.DocumentID)
+	if d == nil || !d.visibleTo(db, u) {
+		return false
+	}
+	if change.Event == EventDraft || change.Event == EventReview {
+		return d.canEdit(db, u) || d.canReview(db, u)
+	}
+
+	return true
+}
+
+// digestMail writes the digest email, with a link to unsubscribe that works without logging in
+func digestMail(u *User, folders []DigestFolder, since time.Time, more bool) *Mail {
+	unsubscribe := mailBaseURL + "/digest/unsubscribe/" + u.DigestToken
+
+	var body strings.Builder
+	count := 0
+	for _, f := range folders {
+		count += len(f.Changes)
+	}
+	body.WriteString("Hi " + u.Name + ",\n\n")
+	body.WriteString(pluralize(count, "change") + " in the wiki since " + since.Format("Mon 2 Jan 15:04") + ".\n")
+
+	for _, f := range folders {
+		body.WriteString("\n" + f.Name + "\n" + strings.Repeat("=", utf8.RuneCountInString(f.Name)) + "\n")
+		for _, c := range f.Changes {
+			body.WriteString("\n" + c.message() + "\n")
+			body.WriteString("  " + c.UserName + ", " + c.Created.Format("Mon 2 Jan 15:04") + "\n")
+			if c.Summary != "" {
+				body.WriteString("  " + c.Summary + "\n")
+			}
+			if c.Event != EventDeleted {
+				body.WriteString("  " + mailBaseURL + c.url() + "\n")
+			}
+		}
+	}
+
+	if more {
+		body.WriteString("\nThere were more changes than fit in one email, the rest follow in your next digest.\n")
+	}
+
+	body.WriteString("\n--\nYou get this email " + map[string]string{DigestDaily: "every day", DigestWeekly: "every week"}[u.Digest] + ".")
+	body.WriteString(" Change how often at " + mailBaseURL + "/notifications/\n")
+	body.WriteString("Unsubscribe: " + unsubscribe + "\n")
+
+	return &Mail{
+		To:      u.Email,
+		Subject: "Your " + u.Digest + " wiki digest: " + pluralize(count, "change"),
+		Body:    body.String(),
+		Headers: map[string]string{
+			"List-Unsubscribe":      "<" + unsubscribe + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		},
+	}
+}
+
+// message describes the change, like `"Runbook" was published`
+func (c *Change) message() string {
+	title := strconv.Quote(c.Title)
+	if c.DocumentID == "" {
+		title = "The folder " + title
+	}
+
+	switch c.Event {
+	case EventPublished:
+		return title + " was published"
+	case EventReview:
+		return title + " was sent for review"
+	case EventMoved:
+		return title + " was moved" + c.Detail
+	case EventDeleted:
+		return title + " was moved to the trash"
+	}
+
+	return title + " has a new draft"
+}
+
+// url is the page of what changed
+func (c *Change) url() string {
+	if c.DocumentID != "" {
+		return "/document/view/" + c.DocumentID.Hex()
+	}
+
+	return "/folder/view/" + c.FolderID.Hex()
+}
+
+// recordDocumentChange keeps a change to a document by actor for the digests
+func recordDocumentChange(db *DB, d *Document, event string, actor *User, detail string, summary string) {
+	recordChange(db, &Change{
+		Event:      event,
+		DocumentID: d.ID,
+		FolderID:   d.FolderID,
+		Title:      d.DisplayTitle(),
+		Summary:    summary,
+		Detail:     detail,
+		UserID:     actor.ID,
+		UserName:   actor.Name,
+	})
+}
+
+// recordFolderChange keeps a change to a folder by actor for the digests
+func recordFolderChange(db *DB, f *Folder, event string, actor *User) {
+	recordChange(db, &Change{
+		Event:    event,
+		FolderID: f.ID,
+		Title:    f.Name,
+		UserID:   actor.ID,
+		UserName: actor.Name,
+	})
+}
+
+func recordChange(db *DB, c *Change) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(changeCol)
+
+	c.ID = bson.NewObjectId()
+	c.Created = time.Now()
+	err := collection.Insert(c)
+	if err != nil {
+		ErrorLogger.Print("Could not record change {event: "+c.Event+", documentID: "+c.DocumentID.Hex()+", folderID: "+c.FolderID.Hex()+"} ", err)
+	}
+}
+
+func findChanges(db *DB, since, until time.Time) ([]Change, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(changeCol)
+
+	var changes []Change
+	err := collection.Find(bson.M{"created": bson.M{"$gt": since, "$lte": until}}).Sort("created").All(&changes)
+	return changes, err
+}
+
+// findByID finds a record by its ID, including records in the trash
+func findByID(db *DB, colName string, id bson.ObjectId, result interface{}) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(colName)
+
+	return collection.FindId(id).One(result)
+}
+
+// setDigest changes how often a user gets a digest, an empty frequency stops the digests.
+// The first digest covers the changes from now on, and the user gets a token for unsubscribing without logging in.
+func setDigest(db *DB, userID bson.ObjectId, frequency string) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(userCol)
+
+	if frequency == "" {
+		return collection.UpdateId(userID, bson.M{"$unset": bson.M{"digest": ""}})
+	}
+
+	u := &User{}
+	err := collection.FindId(userID).One(u)
+	if err != nil {
+		return err
+	}
+
+	update := bson.M{"digest": frequency}
+	if u.Digest == "" {
+		update["digestSent"] = time.Now()
+	}
+	if u.DigestToken == "" {
+		token := make([]byte, 24)
+		if _, err := rand.Read(token); err != nil {
+			return err
+		}
+		update["digestToken"] = base64.RawURLEncoding.EncodeToString(token)
+	}
+
+	return collection.UpdateId(userID, bson.M{"$set": update})
+}
+
+func setDigestSent(db *DB, userID bson.ObjectId, sent time.Time) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(userCol)
+
+	return collection.UpdateId(userID, bson.M{"$set": bson.M{"digestSent": sent}})
+}
+
+// findDigestUsers finds the users that asked for a digest
+func findDigestUsers(db *DB) ([]User, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(userCol)
+
+	var users []User
+	err := collection.Find(bson.M{
+		"digest":  bson.M{"$in": []string{DigestDaily, DigestWeekly}},
+		"deleted": notDeleted,
+	}).All(&users)
+	return users, err
+}
+
+func findUserByDigestToken(db *DB, token string) (*User, error) {
+	if token == "" {
+		return nil, errors.New("No digest token")
+	}
+
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(userCol)
+
+	u := &User{}
+	err := collection.Find(bson.M{"digestToken": token, "deleted": notDeleted}).One(u)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
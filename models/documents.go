@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -18,20 +19,41 @@ import (
 
 	"golang.org/x/crypto/scrypt"
 
+	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
 // Document represents a document on the site
 type Document struct {
-	ID       bson.ObjectId   `json:"id" bson:"_id"`
-	Title    string          `json:"title"`
-	Body     []byte          `json:"body"`
-	URL      string          `json:"url"`
-	Level    int             `json:"level"`
-	Created  time.Time       `json:"created"`
-	Edited   time.Time       `json:"edited"`
-	FolderID bson.ObjectId   `json:"folderID" bson:"folderID,omitempty"`
-	UserIDs  []bson.ObjectId `json:"userIDs" bson:"userIDs"`
+	ID        bson.ObjectId   `json:"id" bson:"_id"`
+	Title     string          `json:"title"`
+	Body      []byte          `json:"body"`
+	Delta     []byte          `json:"-" bson:"delta,omitempty"`
+	URL       string          `json:"url"`
+	Level     int             `json:"level"`
+	Created   time.Time       `json:"created"`
+	Edited    time.Time       `json:"edited"`
+	FolderID  bson.ObjectId   `json:"folderID" bson:"folderID,omitempty"`
+	UserIDs   []bson.ObjectId `json:"userIDs" bson:"userIDs"`
+	Deleted   bool            `json:"deleted" bson:"deleted,omitempty"`
+	DeletedAt time.Time       `json:"deletedAt" bson:"deletedAt,omitempty"`
+	DeletedBy bson.ObjectId   `json:"deletedBy" bson:"deletedBy,omitempty"`
+	Template  bool            `json:"template" bson:"template,omitempty"`
+	AuthorID  bson.ObjectId   `json:"authorID" bson:"authorID,omitempty"`
+	Tags      []string        `json:"tags" bson:"tags,omitempty"`
+	Status    string          `json:"status" bson:"status,omitempty"`
+	Published time.Time       `json:"published" bson:"published,omitempty"`
+	Draft     *Draft          `json:"draft" bson:"draft,omitempty"`
+	Revision  int             `json:"revision" bson:"revision,omitempty"`
+	// EditorID is who last edited the published version, ContributorIDs everyone whose edits were published
+	EditorID       bson.ObjectId   `json:"editorID" bson:"editorID,omitempty"`
+	ContributorIDs []bson.ObjectId `json:"contributorIDs" bson:"contributorIDs,omitempty"`
+	Verification   *Verification   `json:"verification" bson:"verification,omitempty"`
+	// RequiresAck asks everyone who can read the document to acknowledge each published Version
+	RequiresAck bool `json:"requiresAck" bson:"requiresAck,omitempty"`
+	Version     int  `json:"version" bson:"version,omitempty"`
+	// DeletedWithFolder marks documents that went into the trash with their folder, they come back with it
+	DeletedWithFolder bool `json:"-" bson:"deletedWithFolder,omitempty"`
 }
 
 const documentCol = "documents"
@@ -57,6 +79,32 @@ func (d *Document) save(db *DB) error {
 	return err
 }
 
+// errConflict is returned when a document was saved by someone else since it was loaded
+var errConflict = errors.New("Document was changed by someone else.")
+
+// saveRevision saves the document only if it is still at the expected revision,
+// so that concurrent edits don't silently overwrite each other.
+func (d *Document) saveRevision(db *DB, expected int) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(documentCol)
+
+	query := bson.M{"_id": d.ID, "revision": expected}
+	if expected == 0 {
+		// documents saved before revisions were introduced don't have the field
+		query["revision"] = bson.M{"$in": []interface{}{0, nil}}
+	}
+
+	d.Revision = expected + 1
+	err := collection.Update(query, d)
+	if err == mgo.ErrNotFound {
+		d.Revision = expected
+		return errConflict
+	}
+
+	return err
+}
+
 // LoadPage loads retrieves the page data from the database
 func loadPage(db *DB, idHex string) (*Document, error) {
 	id := bson.ObjectIdHex(idHex)
@@ -65,7 +113,7 @@ func loadPage(db *DB, idHex string) (*Document, error) {
 
 	collection := session.DB(db.name).C(documentCol)
 	d := &Document{}
-	err := collection.FindId(id).One(d)
+	err := collection.Find(bson.M{"_id": id, "deleted": notDeleted}).One(d)
 
 	if err != nil {
 		return nil, err
@@ -79,7 +127,7 @@ func findAllDocs(db *DB) (*[]Document, error) {
 	collection := session.DB(db.name).C(documentCol)
 	var documents []Document
 
-	err := collection.Find(nil).Sort("title").All(&documents)
+	err := collection.Find(bson.M{"deleted": notDeleted}).Sort("title").All(&documents)
 	if err != nil {
 		return nil, err
 	}
@@ -119,9 +167,30 @@ func IndexHandler(db *DB, rend *render.Render) http.HandlerFunc {
 			return
 		}
 
+		pinned, err := findSavedSearches(db, user.ID, true)
+		if err != nil {
+			ErrorLogger.Print("Could not find pinned searches {userID: "+user.ID.Hex()+"} ", err)
+			err = nil
+		}
+
+		favorites, err := findFavoriteItems(db, user)
+		if err != nil {
+			ErrorLogger.Print("Could not find favorites {userID: "+user.ID.Hex()+"} ", err)
+			err = nil
+		}
+
+		recent, err := findRecentItems(db, user)
+		if err != nil {
+			ErrorLogger.Print("Could not find recent documents {userID: "+user.ID.Hex()+"} ", err)
+			err = nil
+		}
+
 		data := map[string]interface{}{
-			"folders": folders,
-			"user":    user,
+			"folders":   folders,
+			"pinned":    pinned,
+			"favorites": favorites,
+			"recent":    recent,
+			"user":      user,
 		}
 
 		RenderTemplate(rend, w, r, "index", data)
@@ -159,15 +228,29 @@ func ViewHandler(db *DB, rend *render.Render) http.HandlerFunc {
 			return
 		}
 
-		if !levelCheck(w, r, d) {
+		if !levelCheck(w, r, d) || !d.visibleTo(db, user) {
 			s.AddFlash("Sorry, but you don't have permission to view this document", "warning")
 			s.Save(r, w)
 			InfoLogger.Print("User tried to access restricted document: {userID: " + user.ID.Hex() + ", documentID: " + id + "}")
 			http.Redirect(w, r, "/", http.StatusFound)
+			return
 		}
 
+		// editors and reviewers can look at the draft, everyone else sees the published version
+		canEdit := d.canEdit(db, user)
+		canReview := d.canReview(db, user)
+		showDraft := d.Draft != nil && (canEdit || canReview) && (r.URL.Query().Get("draft") != "" || !d.isPublished())
+
 		if user.Tech {
 			body = "<p>This is a sample text that tech users can see.</p><p>Shalom.</p>"
+		} else if showDraft {
+			body, err = d.draftBody()
+			if err != nil {
+				InfoLogger.Print("Could not decrypt draft of page id: "+id+"\nDisplaying blank body", err)
+				s.AddFlash("There was a problem decrypting the page. If this error persists, please contact support.")
+				s.Save(r, w)
+				err = nil
+			}
 		} else {
 			body, err = d.decrypt()
 			if err != nil {
@@ -178,10 +261,101 @@ func ViewHandler(db *DB, rend *render.Render) http.HandlerFunc {
 			}
 		}
 
+		// long documents get a table of contents that links to their headings
+		body, headings := anchorHeadings(body)
+		if len(headings) < tocMinHeadings {
+			headings = nil
+		}
+
+		// code blocks are highlighted here, the viewer only swaps the highlighted lines in
+		codeBlocks := findCodeBlocks(body)
+		codeStyle := defaultCodeStyle
+		var codeCSS template.CSS
+		if len(codeBlocks) > 0 {
+			codeStyle = findCodeStyle(db, user.ID)
+			codeCSS = codeStyleCSS(codeStyle)
+		}
+
+		attachments, err := findDocumentAttachments(db, d.ID)
+		if err != nil {
+			ErrorLogger.Print("Could not find attachments for document id: "+id, err)
+			err = nil
+		}
+
+		var draftAuthor *User
+		if d.Draft != nil {
+			draftAuthor, err = findUser(db, d.Draft.AuthorID.Hex())
+			if err != nil {
+				draftAuthor = &User{Name: "Unknown"}
+				err = nil
+			}
+		}
+
+		lock, err := findLock(db, d.ID)
+		if err != nil {
+			ErrorLogger.Print("Could not find edit lock for document id: "+id, err)
+			err = nil
+		}
+
+		threads, err := findDocumentThreads(db, d, user)
+		if err != nil {
+			ErrorLogger.Print("Could not find comments for document id: "+id, err)
+			err = nil
+		}
+
+		author, editor, contributors := d.findPeople(db)
+
+		// readers of policy documents acknowledge every version that is published
+		var ack *Acknowledgement
+		if d.RequiresAck && d.isPublished() {
+			ack, err = findAcknowledgement(db, d, user.ID)
+			if err != nil {
+				ErrorLogger.Print("Could not find acknowledgement of document id: "+id, err)
+				err = nil
+			}
+		}
+
+		// documents from before authors were recorded may have no owner
+		var owner *User
+		if d.Verification != nil && d.ownerID() != "" {
+			owner, _ = findUser(db, d.ownerID().Hex())
+		}
+
+		err = recordView(db, user.ID, d.ID)
+		if err != nil {
+			ErrorLogger.Print("Could not record view of document id: "+id, err)
+			err = nil
+		}
+
 		data := map[string]interface{}{
-			"document": d,
-			"body":     body,
-			"user":     user,
+			"document":     d,
+			"body":         body,
+			"toc":          headings,
+			"codeBlocks":   codeBlocks,
+			"codeStyle":    codeStyle,
+			"codeStyles":   codeStyles,
+			"codeCSS":      codeCSS,
+			"user":         user,
+			"attachments":  attachments,
+			"canDelete":    hasPermission(db, user, d.FolderID, "delete"),
+			"canEdit":      canEdit,
+			"canReview":    canReview,
+			"canShare":     d.canShare(db, user),
+			"watching":     isWatching(db, user.ID, d.ID),
+			"starred":      isFavorite(db, user.ID, d.ID),
+			"showDraft":    showDraft,
+			"draftAuthor":  draftAuthor,
+			"lock":         lock,
+			"canBreakLock": lock != nil && lock.HolderID != user.ID && d.canBreakLock(db, user),
+			"threads":      threads,
+			"author":       author,
+			"editor":       editor,
+			"contributors": contributors,
+			"owner":        owner,
+			"canVerify":    d.Verification != nil && d.canVerify(db, user),
+			"ack":          ack,
+			"askAck":       d.RequiresAck && d.isPublished() && !showDraft,
+			"canSeeAcks":   d.RequiresAck && d.canSeeAcks(db, user),
 		}
 
 		RenderTemplate(rend, w, r, "document/view", data)
@@ -196,6 +370,8 @@ func EditHandler(db *DB, rend *render.Render) http.HandlerFunc {
 		d := &Document{}
 		var err error
 		var body template.HTML
+		var lock *EditLock
+		var delta *Delta
 
 		// Get the user session from the context.
 		ctx := r.Context()
@@ -224,9 +400,31 @@ func EditHandler(db *DB, rend *render.Render) http.HandlerFunc {
 
 			if !levelCheck(w, r, d) {
 				http.Redirect(w, r, "/", http.StatusFound)
+				return
 			}
 
-			body, err = d.decrypt()
+			if !d.canEdit(db, user) {
+				InfoLogger.Print("User tried to edit document without permission: {userID: " + user.ID.Hex() + ", documentID: " + id + "}")
+				s.AddFlash("Sorry, but you don't have permission to edit this document", "warning")
+				s.Save(r, w)
+				http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+				return
+			}
+
+			// let others know the document is being edited, or warn this user that someone else is
+			lock, err = takeLock(db, d.ID, user)
+			if err != nil {
+				ErrorLogger.Print("Could not take edit lock {id: "+id+", userID: "+user.ID.Hex()+"} ", err)
+				err = nil
+			}
+
+			// continue from the draft if there is one
+			var title string
+			title, body, err = d.workingCopy()
+			d.Title = title
+			if err == nil {
+				delta, err = d.workingDelta()
+			}
 			if err != nil {
 				ErrorLogger.Print("Could not decrypt page id: "+id+" \nDisplaying blank body\n ", err)
 				s.AddFlash("Looks like something went wrong. If this error persists, please contact support", "error")
@@ -252,12 +450,60 @@ func EditHandler(db *DB, rend *render.Render) http.HandlerFunc {
 			d.FolderID = bson.ObjectIdHex(query["folder-id"][0])
 		}
 
+		templates, err := findTemplates(db, user)
+		if err != nil {
+			ErrorLogger.Print("Could not find templates. Document {id: "+id+"} ", err)
+			err = nil
+		}
+
+		// new documents start from the chosen template, or the folder's default template
+		templateID := query.Get("template-id")
+		if id == "" {
+			var folder *Folder
+			if d.FolderID != "" {
+				folder, err = findFolder(db, d.FolderID.Hex())
+				if err != nil {
+					ErrorLogger.Print("Could not find folder for new document {folderID: "+d.FolderID.Hex()+"} ", err)
+					err = nil
+				}
+			}
+
+			if templateID == "" && folder != nil && folder.TemplateID != "" {
+				templateID = folder.TemplateID.Hex()
+			}
+
+			if bson.IsObjectIdHex(templateID) {
+				body, err = templateBody(db, templateID, user, folder)
+				if err != nil {
+					ErrorLogger.Print("Could not load template {id: "+templateID+"} ", err)
+					s.AddFlash("That template could not be loaded, starting with an empty document.", "warning")
+					s.Save(r, w)
+					err = nil
+				}
+			}
+		}
+
 		data := map[string]interface{}{
-			"document": d,
-			"body":     body,
-			"users":    users,
-			"user":     user,
-			"folders":  folders,
+			"document":   d,
+			"body":       body,
+			"delta":      delta,
+			"users":      users,
+			"user":       user,
+			"folders":    folders,
+			"templates":  templates,
+			"templateID": templateID,
+			"canPublish": d.canReview(db, user),
+			"intervals":  reviewIntervals,
+			"languages":  codeLanguages,
+		}
+
+		// the tags, owner and interval of an unpublished draft are shown, so saving it again keeps them
+		data["tags"] = d.pendingTags()
+		data["verification"] = d.pendingVerification()
+
+		if lock != nil && lock.HolderID != user.ID {
+			data["lock"] = lock
+			data["canBreakLock"] = d.canBreakLock(db, user)
 		}
 
 		RenderTemplate(rend, w, r, "document/edit", data)
@@ -280,20 +526,74 @@ func SaveHandler(db *DB, rend *render.Render) http.HandlerFunc {
 			return
 		}
 
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
 		if r.Method == "GET" {
 			http.Redirect(w, r, "/", http.StatusFound)
 			return
 		} else if r.Method == "POST" {
 			var userIDs []bson.ObjectId
+			var err error
 			r.ParseForm()
 			title := r.Form["title"][0]
-			body := template.HTML(r.Form["body"][0])
+
+			// the Delta is the source of truth, the HTML body is only used by editors that don't send one
+			delta := parseDelta(r.FormValue("delta"))
+			if delta == nil {
+				delta = htmlToDelta(r.FormValue("body"))
+			}
+			body := renderDelta(delta)
 			strUserIDs := r.Form["users"]
 			strFolderID := r.Form["folder"][0]
+			action := r.FormValue("action")
+			summary := strings.TrimSpace(r.FormValue("summary"))
 
-			d = &Document{
-				Title:  title,
-				Edited: time.Now(),
+			if idHex != "" {
+				d, err = loadPage(db, idHex)
+				if err != nil {
+					ErrorLogger.Print("Could not find page to save. id: "+idHex+" \n ", err)
+					s.AddFlash("Error! Could not save page. If this error persists please contact support", "error")
+					s.Save(r, w)
+					http.Redirect(w, r, "/", http.StatusFound)
+					return
+				}
+
+				if !d.canEdit(db, user) {
+					InfoLogger.Print("User tried to save document without permission: {userID: " + user.ID.Hex() + ", documentID: " + idHex + "}")
+					s.AddFlash("Sorry, but you don't have permission to edit this document", "warning")
+					s.Save(r, w)
+					http.Redirect(w, r, "/document/view/"+idHex, http.StatusFound)
+					return
+				}
+
+				// the editor started from an older revision, let them merge before saving
+				revision, _ := strconv.Atoi(r.FormValue("revision"))
+				if revision != d.Revision {
+					InfoLogger.Print("Document save conflict {id: " + idHex + ", revision: " + strconv.Itoa(revision) + ", stored: " + strconv.Itoa(d.Revision) + ", userID: " + user.ID.Hex() + "}")
+					renderConflict(db, rend, w, r, user, d, title, body)
+					return
+				}
+			} else {
+				d = &Document{
+					ID:       bson.NewObjectId(),
+					Created:  time.Now(),
+					AuthorID: user.ID,
+				}
+			}
+
+			d.Template = len(r.Form["template"]) > 0 && r.Form["template"][0] == "on"
+
+			// the owner keeps the document accurate, reviewing it every interval
+			ownerID := bson.ObjectId("")
+			if strOwnerID := r.FormValue("owner"); bson.IsObjectIdHex(strOwnerID) {
+				ownerID = bson.ObjectIdHex(strOwnerID)
+			}
+			reviewDays, _ := strconv.Atoi(r.FormValue("reviewInterval"))
+			if !isReviewInterval(reviewDays) {
+				reviewDays = 0
 			}
 
 			level, err := strconv.Atoi(r.Form["level"][0])
@@ -308,30 +608,77 @@ func SaveHandler(db *DB, rend *render.Render) http.HandlerFunc {
 			for _, uID := range strUserIDs {
 				userIDs = append(userIDs, bson.ObjectIdHex(uID))
 			}
-
-			if len(userIDs) > 0 {
-				d.UserIDs = userIDs
-			}
+			d.UserIDs = userIDs
 
 			// if document is in a folder, write it to the folder
+			folderID := bson.ObjectId("")
 			if strFolderID != "" {
-				d.FolderID = bson.ObjectIdHex(strFolderID)
+				folderID = bson.ObjectIdHex(strFolderID)
 			}
 
-			err = d.encrypt(body)
+			if (idHex == "" || folderID != d.FolderID) && !hasPermission(db, user, folderID, "create") {
+				InfoLogger.Print("User tried to add a document to a folder without permission: {userID: " + user.ID.Hex() + ", folderID: " + strFolderID + "}")
+				s.AddFlash("Sorry, but you don't have permission to add documents to that folder", "warning")
+				s.Save(r, w)
+				http.Redirect(w, r, "/", http.StatusFound)
+				return
+			}
+			d.FolderID = folderID
+
+			// images that weren't uploaded by the editor are still stored as attachments
+			_, err = extractDeltaImages(db, d.ID, user.ID, delta)
+			if err != nil {
+				ErrorLogger.Print("Could not extract images from document id: "+d.ID.Hex()+" \n ", err)
+				err = nil
+			}
+
+			// changes are saved as a draft, the published version stays as it is until the draft is published
+			body, err = d.saveDraft(title, delta, user.ID)
 			if err != nil {
 				ErrorLogger.Print("Could not encrypt body of document id: "+idHex+" \n ", err)
 				err = nil
 			}
 
+			// the summary describes the whole draft, so it is kept until someone describes it again
+			if summary != "" {
+				d.Draft.Summary = summary
+			}
+			summary = d.Draft.Summary
+
+			// the tags, owner and interval go live with the draft, like its content
+			d.Draft.Tags = parseTags(r.FormValue("tags"))
+			if d.Draft.Tags == nil {
+				d.Draft.Tags = []string{}
+			}
+			d.Draft.Verification = &Verification{OwnerID: ownerID, IntervalDays: reviewDays}
+
+			switch action {
+			case "review":
+				d.requestReview()
+			case "publish":
+				if d.canReview(db, user) {
+					d.publish()
+				} else {
+					s.AddFlash("You can't publish this document yourself, so it was saved as a draft. Request a review to have it published.", "warning")
+				}
+			}
+
 			if idHex != "" {
-				d.ID = bson.ObjectIdHex(idHex)
+				err = d.saveRevision(db, d.Revision)
 			} else {
-				d.ID = bson.NewObjectId()
-				d.Created = time.Now()
+				d.Revision = 1
+				err = d.save(db)
 			}
 
-			err = d.save(db)
+			if err == errConflict {
+				// someone else saved between loading and saving this document
+				latest, err := loadPage(db, idHex)
+				if err == nil {
+					InfoLogger.Print("Document save conflict {id: " + idHex + ", stored: " + strconv.Itoa(latest.Revision) + ", userID: " + user.ID.Hex() + "}")
+					renderConflict(db, rend, w, r, user, latest, title, body)
+					return
+				}
+			}
 
 			if err != nil {
 				ErrorLogger.Print("Could not save page id: "+d.ID.Hex()+" \n ", err)
@@ -342,11 +689,55 @@ func SaveHandler(db *DB, rend *render.Render) http.HandlerFunc {
 				return
 			}
 
-			InfoLogger.Print("Document saved {id: " + d.ID.Hex() + "}")
+			err = linkAttachments(db, d.ID, body)
+			if err != nil {
+				ErrorLogger.Print("Could not link attachments to document id: "+d.ID.Hex()+" \n ", err)
+				err = nil
+			}
+			indexDocument(db, d)
+
+			err = recordEdit(db, user.ID, d.ID)
+			if err != nil {
+				ErrorLogger.Print("Could not record edit of document id: "+d.ID.Hex()+" \n ", err)
+				err = nil
+			}
+
+			event := EventDraft
+			switch d.Status {
+			case StatusPublished:
+				if action == "publish" {
+					event = EventPublished
+				}
+			case StatusReview:
+				event = EventReview
+			}
+			notifyDocument(db, d, event, user, "")
+			recordDocumentChange(db, d, event, user, "", summary)
+
+			// keep a collaborative editing session on this document in step with the new revision
+			collabRooms.saved(d.ID, d.Revision, user.ID)
+
+			// the user is done editing, so others don't have to wait for the lock to expire
+			err = releaseLock(db, d.ID, user.ID)
+			if err != nil {
+				ErrorLogger.Print("Could not release edit lock {id: "+d.ID.Hex()+", userID: "+user.ID.Hex()+"} ", err)
+				err = nil
+			}
+
+			InfoLogger.Print("Document saved {id: " + d.ID.Hex() + ", status: " + d.Status + ", userID: " + user.ID.Hex() + "}")
+			switch d.Status {
+			case StatusReview:
+				s.AddFlash("The draft was sent for review", "success")
+			case StatusPublished:
+				s.AddFlash("The document was published", "success")
+			default:
+				s.AddFlash("The draft was saved", "success")
+			}
+			s.Save(r, w)
 		}
 
-		redir := "/view/" + d.ID.Hex()
-		if d.FolderID.Hex() != "" {
+		redir := "/document/view/" + d.ID.Hex()
+		if d.Status == StatusPublished && d.FolderID.Hex() != "" {
 			redir = "/folder/view/" + d.FolderID.Hex()
 		}
 
@@ -355,47 +746,61 @@ func SaveHandler(db *DB, rend *render.Render) http.HandlerFunc {
 }
 
 func (d *Document) encrypt(body template.HTML) (err error) {
+	d.Body, err = encryptBytes([]byte(body))
+	return err
+}
+
+func (d *Document) decrypt() (body template.HTML, err error) {
+	plaintext, err := decryptBytes(d.Body)
+	if err != nil {
+		return "", err
+	}
+
+	body = template.HTML(plaintext)
+	return body, err
+}
+
+// encryptBytes encrypts plaintext with the document key.
+// The random IV is stored in front of the returned ciphertext.
+func encryptBytes(plaintext []byte) (ciphertext []byte, err error) {
 	var block cipher.Block
 	key := []byte(keyHash)
-	plaintext := []byte(body)
 	block, err = aes.NewCipher(key)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	ciphertext := make([]byte, aes.BlockSize+len(plaintext))
+	ciphertext = make([]byte, aes.BlockSize+len(plaintext))
 	iv := ciphertext[:aes.BlockSize]
 
 	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return err
+		return nil, err
 	}
 
 	stream := cipher.NewCFBEncrypter(block, iv)
 	stream.XORKeyStream(ciphertext[aes.BlockSize:], plaintext)
 
-	d.Body = ciphertext
-
-	return err
+	return ciphertext, err
 }
 
-func (d *Document) decrypt() (body template.HTML, err error) {
+// decryptBytes decrypts ciphertext created by encryptBytes.
+// The ciphertext is left untouched.
+func decryptBytes(ciphertext []byte) (plaintext []byte, err error) {
 	var block cipher.Block
 	key := []byte(keyHash)
-	ciphertext := d.Body
 	block, err = aes.NewCipher(key)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if len(ciphertext) < aes.BlockSize {
-		return "", errors.New("Can't decrypt document, ciphertext too short.")
+		return nil, errors.New("Can't decrypt, ciphertext too short.")
 	}
 	iv := ciphertext[:aes.BlockSize]
-	ciphertext = ciphertext[aes.BlockSize:]
+	plaintext = make([]byte, len(ciphertext)-aes.BlockSize)
 
 	stream := cipher.NewCFBDecrypter(block, iv)
-	stream.XORKeyStream(ciphertext, ciphertext)
+	stream.XORKeyStream(plaintext, ciphertext[aes.BlockSize:])
 
-	body = template.HTML(ciphertext)
-	return body, err
+	return plaintext, err
 }
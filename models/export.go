@@ -0,0 +1,585 @@
+package models
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"html"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/unrolled/render"
+
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// exportStyle is the stylesheet of exported HTML, covering the classes Quill puts on blocks
+const exportStyle = `body { max-width: 48rem; margin: 2rem auto; padding: 0 1rem; font-family: sans-serif; line-height: 1.5; }
+img { max-width: 100%; }
+blockquote { margin-left: 0; padding-left: 1rem; border-left: 4px solid #ccc; }
+pre.ql-syntax { padding: .5rem; overflow: auto; background: #23241f; color: #f8f8f2; }
+.ql-align-center { text-align: center; }
+.ql-align-right { text-align: right; }
+.ql-align-justify { text-align: justify; }
+.ql-direction-rtl { direction: rtl; }
+.ql-indent-1 { padding-left: 3em; }
+.ql-indent-2 { padding-left: 6em; }
+.ql-indent-3 { padding-left: 9em; }
+.ql-indent-4 { padding-left: 12em; }
+.ql-indent-5 { padding-left: 15em; }
+.ql-indent-6 { padding-left: 18em; }
+.ql-indent-7 { padding-left: 21em; }
+.ql-indent-8 { padding-left: 24em; }
+.toc ul { list-style: none; padding-left: 0; }
+.toc-h2 { padding-left: 1em; }
+.toc-h3 { padding-left: 2em; }
+.toc-h4, .toc-h5, .toc-h6 { padding-left: 3em; }
+`
+
+// exportImageExt maps image content types to file extensions
+var exportImageExt = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// exportDoc is the version of a document a user exports, with the images it uses
+type exportDoc struct {
+	doc    *Document
+	title  string
+	delta  *Delta
+	images map[string]*exportImage
+}
+
+// exportImage is a decrypted image attachment
+type exportImage struct {
+	id          string
+	contentType string
+	data        []byte
+}
+
+// DocumentExportHandler downloads a document as Markdown or as a standalone HTML page
+func DocumentExportHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+		format := r.URL.Query().Get("format")
+
+		d, err := loadPage(db, id)
+		if err != nil {
+			ErrorLogger.Print("Document not found for export. id: "+id, err)
+			s.AddFlash("Looks like something went wrong. If this error persists, please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		if !levelCheck(w, r, d) || !d.visibleTo(db, user) {
+			InfoLogger.Print("User tried to export restricted document: {userID: " + user.ID.Hex() + ", documentID: " + id + "}")
+			s.AddFlash("Sorry, but you don't have permission to view this document", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		if format != "md" && format != "html" {
+			s.AddFlash("Please choose Markdown or HTML to export to", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		e, err := loadExportDoc(db, user, d, r.URL.Query().Get("draft") != "")
+		if err != nil {
+			ErrorLogger.Print("Could not export document {id: "+id+"} ", err)
+			s.AddFlash("Error! Could not export the document. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		// images are embedded, so the file works on its own
+		embedded := e.imageSources(func(img *exportImage) string {
+			return "data:" + img.contentType + ";base64," + base64.StdEncoding.EncodeToString(img.data)
+		})
+
+		var content, contentType string
+		switch format {
+		case "md":
+			content = "# " + e.title + "\n\n" + renderMarkdown(embedded)
+			contentType = "text/markdown; charset=utf-8"
+		case "html":
+			content = exportHTMLPage(e.title, renderDelta(embedded), findCodeStyle(db, user.ID))
+			contentType = "text/html; charset=utf-8"
+		}
+
+		InfoLogger.Print("Document exported {id: " + id + ", format: " + format + ", userID: " + user.ID.Hex() + "}")
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", contentDisposition(exportFileName(e.title, "document")+"."+format))
+		io.WriteString(w, content)
+	}
+}
+
+// FolderExportHandler downloads the documents of a folder that the user can see,
+// as a zip of Markdown files or as an EPUB book
+func FolderExportHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+		format := r.URL.Query().Get("format")
+
+		f, err := findFolder(db, id)
+		if err != nil {
+			ErrorLogger.Print("Folder not found for export. id: "+id, err)
+			s.AddFlash("Looks like something went wrong. If this error persists, please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/folders/", http.StatusFound)
+			return
+		}
+
+		if format != "zip" && format != "epub" {
+			s.AddFlash("Please choose a zip of Markdown files or EPUB to export to", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/folder/view/"+id, http.StatusFound)
+			return
+		}
+
+		err = f.findDocsForFolder(db)
+		if err != nil {
+			ErrorLogger.Print("Could not find documents to export for folder {id: "+id+"} ", err)
+			s.AddFlash("Error! Could not export the folder. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/folder/view/"+id, http.StatusFound)
+			return
+		}
+
+		// the same documents the user could open one by one
+		var docs []*exportDoc
+		for i := range f.Documents {
+			d := &f.Documents[i]
+			if d.Template || user.Level < d.Level || !d.visibleTo(db, user) {
+				continue
+			}
+
+			e, err := loadExportDoc(db, user, d, false)
+			if err != nil {
+				ErrorLogger.Print("Could not export document {id: "+d.ID.Hex()+"} ", err)
+				s.AddFlash("Error! Could not export \""+d.Title+"\". If this error persists please contact support", "danger")
+				s.Save(r, w)
+				http.Redirect(w, r, "/folder/view/"+id, http.StatusFound)
+				return
+			}
+			docs = append(docs, e)
+		}
+
+		var buf bytes.Buffer
+		if format == "zip" {
+			err = writeMarkdownZip(&buf, f.Name, docs)
+		} else {
+			err = writeEPUB(&buf, f, user, docs)
+		}
+		if err != nil {
+			ErrorLogger.Print("Could not write export of folder {id: "+id+", format: "+format+"} ", err)
+			s.AddFlash("Error! Could not export the folder. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/folder/view/"+id, http.StatusFound)
+			return
+		}
+
+		contentType := "application/zip"
+		if format == "epub" {
+			contentType = "application/epub+zip"
+		}
+
+		InfoLogger.Print("Folder exported {id: " + id + ", format: " + format + ", documents: " + strconv.Itoa(len(docs)) + ", userID: " + user.ID.Hex() + "}")
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", contentDisposition(exportFileName(f.Name, "folder")+"."+format))
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.Write(buf.Bytes())
+	}
+}
+
+// loadExportDoc loads the version of a document the user sees on the view page.
+// Editors and reviewers export the draft of a document that was never published, or when they ask for it.
+func loadExportDoc(db *DB, user *User, d *Document, draft bool) (*exportDoc, error) {
+	e := &exportDoc{doc: d, images: map[string]*exportImage{}}
+
+	var err error
+	showDraft := d.Draft != nil && (d.canEdit(db, user) || d.canReview(db, user)) && (draft || !d.isPublished())
+	if user.Tech {
+		// tech users only ever see sample text
+		e.title = d.Title
+		e.delta = htmlToDelta("<p>This is a sample text that tech users can see.</p><p>Shalom.</p>")
+		return e, nil
+	} else if showDraft {
+		e.title = d.Draft.Title
+		e.delta, err = d.workingDelta()
+	} else {
+		e.title = d.Title
+		e.delta, err = d.contentDelta()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range e.delta.Ops {
+		embed, ok := op.Insert.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		src, _ := embed["image"].(string)
+		m := attachmentRef.FindStringSubmatch(src)
+		if m == nil || e.images[m[1]] != nil {
+			continue
+		}
+
+		a, err := findAttachment(db, m[1])
+		if err != nil || !a.viewable(db, user) {
+			// leave the reference as it is rather than failing the whole export
+			continue
+		}
+		data, err := decryptBytes(a.Data)
+		if err != nil {
+			return nil, err
+		}
+		e.images[m[1]] = &exportImage{id: m[1], contentType: a.ContentType, data: data}
+	}
+
+	return e, nil
+}
+
+// imageSources returns the document Delta with the attachment images pointing to src(image)
+func (e *exportDoc) imageSources(src func(img *exportImage) string) *Delta {
+	delta := &Delta{Ops: make([]DeltaOp, len(e.delta.Ops))}
+	copy(delta.Ops, e.delta.Ops)
+
+	for i, op := range delta.Ops {
+		embed, ok := op.Insert.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ref, _ := embed["image"].(string)
+		m := attachmentRef.FindStringSubmatch(ref)
+		if m == nil || e.images[m[1]] == nil {
+			continue
+		}
+		delta.Ops[i].Insert = map[string]interface{}{"image": src(e.images[m[1]])}
+	}
+
+	return delta
+}
+
+// fileName returns the name of the image inside an archive
+func (img *exportImage) fileName() string {
+	ext, ok := exportImageExt[img.contentType]
+	if !ok {
+		ext = ".img"
+	}
+
+	return img.id + ext
+}
+
+// exportHTMLPage wraps a rendered body in a complete HTML page, with a table of contents for long documents
+// and code blocks highlighted in the code style
+func exportHTMLPage(title string, body template.HTML, codeStyle string) string {
+	body, headings := anchorHeadings(body)
+
+	style := exportStyle
+	if strings.Contains(string(body), "ql-syntax") {
+		body = highlightBody(body)
+		style += string(codeStyleCSS(codeStyle)) + lineNumberCSS
+	}
+
+	var toc strings.Builder
+	if len(headings) >= tocMinHeadings {
+		toc.WriteString("<nav class=\"toc\">\n<ul>\n")
+		for _, h := range headings {
+			toc.WriteString("<li class=\"toc-h" + strconv.Itoa(h.Level) + "\"><a href=\"#" + html.EscapeString(h.ID) + "\">" + html.EscapeString(h.Text) + "</a></li>\n")
+		}
+		toc.WriteString("</ul>\n</nav>\n")
+	}
+
+	return "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>" + html.EscapeString(title) + "</title>\n" +
+		"<style>\n" + style + "</style>\n</head>\n<body>\n<h1>" + html.EscapeString(title) + "</h1>\n" +
+		toc.String() + string(body) + "\n</body>\n</html>\n"
+}
+
+// exportFileName turns a title into a safe file name, without an extension
+func exportFileName(title string, fallback string) string {
+	name := strings.Trim(tagChars.ReplaceAllString(strings.TrimSpace(title), "-"), "-")
+	// titles can be in any script, so they are cut between characters and not bytes
+	if runes := []rune(name); len(runes) > 80 {
+		name = strings.TrimRight(string(runes[:80]), "-")
+	}
+	if name == "" {
+		return fallback
+	}
+
+	return name
+}
+
+// contentDisposition makes a response download as a file, keeping non ASCII names for the browsers that support them
+func contentDisposition(name string) string {
+	ascii := strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII {
+			return '_'
+		}
+		return r
+	}, name)
+
+	return `attachment; filename="` + ascii + `"; filename*=UTF-8''` + url.PathEscape(name)
+}
+
+// uniqueFileNames gives every document a file name, numbering titles that are used more than once
+func uniqueFileNames(docs []*exportDoc) []string {
+	names := make([]string, len(docs))
+	used := map[string]bool{}
+	for i, e := range docs {
+		base := exportFileName(e.title, "document")
+		name := base
+		for n := 2; used[strings.ToLower(name)]; n++ {
+			name = base + "-" + strconv.Itoa(n)
+		}
+		used[strings.ToLower(name)] = true
+		names[i] = name
+	}
+
+	return names
+}
+
+// writeMarkdownZip writes a zip with a folder of Markdown files and the images they use
+func writeMarkdownZip(w io.Writer, folderName string, docs []*exportDoc) error {
+	z := zip.NewWriter(w)
+	root := exportFileName(folderName, "folder") + "/"
+	names := uniqueFileNames(docs)
+	written := map[string]bool{}
+
+	for i, e := range docs {
+		content := "# " + e.title + "\n\n" + renderMarkdown(e.imageSources(func(img *exportImage) string {
+			return "images/" + img.fileName()
+		}))
+
+		fw, err := z.CreateHeader(&zip.FileHeader{Name: root + names[i] + ".md", Method: zip.Deflate, Modified: e.doc.Edited})
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(fw, content); err != nil {
+			return err
+		}
+
+		for _, img := range e.images {
+			if written[img.id] {
+				continue
+			}
+			written[img.id] = true
+
+			fw, err := z.Create(root + "images/" + img.fileName())
+			if err != nil {
+				return err
+			}
+			if _, err = fw.Write(img.data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return z.Close()
+}
+
+// writeEPUB writes an EPUB 3 book with a chapter for every document
+func writeEPUB(w io.Writer, f *Folder, user *User, docs []*exportDoc) error {
+	z := zip.NewWriter(w)
+
+	// the mimetype has to come first and can't be compressed
+	fw, err := z.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	if _, err = io.WriteString(fw, "application/epub+zip"); err != nil {
+		return err
+	}
+
+	files := map[string]string{
+		"META-INF/container.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`,
+		"OEBPS/style.css": exportStyle,
+	}
+
+	var manifest, spine, nav strings.Builder
+	images := map[string]*exportImage{}
+	for i, e := range docs {
+		chapter := "chapter-" + strconv.Itoa(i+1) + ".xhtml"
+		body, err := xhtmlBody(renderDelta(e.imageSources(func(img *exportImage) string {
+			return "images/" + img.fileName()
+		})))
+		if err != nil {
+			return err
+		}
+
+		files["OEBPS/"+chapter] = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head>
+<title>` + html.EscapeString(e.title) + `</title>
+<link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body>
+<h1>` + html.EscapeString(e.title) + `</h1>
+` + body + `
+</body>
+</html>
+`
+		id := "chapter-" + strconv.Itoa(i+1)
+		manifest.WriteString(`    <item id="` + id + `" href="` + chapter + `" media-type="application/xhtml+xml"/>` + "\n")
+		spine.WriteString(`    <itemref idref="` + id + `"/>` + "\n")
+		nav.WriteString(`      <li><a href="` + chapter + `">` + html.EscapeString(e.title) + `</a></li>` + "\n")
+
+		for _, img := range e.images {
+			images[img.id] = img
+		}
+	}
+
+	for _, img := range images {
+		files["OEBPS/images/"+img.fileName()] = string(img.data)
+		manifest.WriteString(`    <item id="image-` + img.id + `" href="images/` + img.fileName() + `" media-type="` + img.contentType + `"/>` + "\n")
+	}
+
+	title := html.EscapeString(f.Name)
+	files["OEBPS/nav.xhtml"] = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head>
+<title>` + title + `</title>
+</head>
+<body>
+  <nav epub:type="toc" id="toc">
+    <h1>` + title + `</h1>
+    <ol>
+` + nav.String() + `    </ol>
+  </nav>
+</body>
+</html>
+`
+
+	files["OEBPS/content.opf"] = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="book-id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="book-id">urn:rgcms:folder:` + f.ID.Hex() + `</dc:identifier>
+    <dc:title>` + title + `</dc:title>
+    <dc:creator>` + html.EscapeString(user.Name) + `</dc:creator>
+    <dc:language>en</dc:language>
+    <meta property="dcterms:modified">` + time.Now().UTC().Format("2006-01-02T15:04:05Z") + `</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="style" href="style.css" media-type="text/css"/>
+` + manifest.String() + `  </manifest>
+  <spine>
+` + spine.String() + `  </spine>
+</package>
+`
+
+	// container.xml first, so readers find the package quickly
+	order := []string{"META-INF/container.xml", "OEBPS/content.opf", "OEBPS/nav.xhtml", "OEBPS/style.css"}
+	for i := range docs {
+		order = append(order, "OEBPS/chapter-"+strconv.Itoa(i+1)+".xhtml")
+	}
+	for _, img := range images {
+		order = append(order, "OEBPS/images/"+img.fileName())
+	}
+
+	for _, name := range order {
+		fw, err := z.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(fw, files[name]); err != nil {
+			return err
+		}
+	}
+
+	return z.Close()
+}
+
+// xhtmlBody rewrites rendered HTML as well formed XHTML for EPUB readers.
+// Videos can't be played in a book, so they become links.
+func xhtmlBody(body template.HTML) (string, error) {
+	nodes, err := xhtml.ParseFragment(strings.NewReader(string(body)), &xhtml.Node{Type: xhtml.ElementNode, Data: "body", DataAtom: atom.Body})
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	for _, n := range nodes {
+		replaceVideos(n)
+		if err := xhtml.Render(&out, n); err != nil {
+			return "", err
+		}
+	}
+
+	return out.String(), nil
+}
+
+func replaceVideos(n *xhtml.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		replaceVideos(c)
+	}
+
+	if n.Type != xhtml.ElementNode || n.DataAtom != atom.Iframe {
+		return
+	}
+
+	src := attr(n, "src")
+	n.Data = "a"
+	n.DataAtom = atom.A
+	n.Attr = []xhtml.Attribute{{Key: "href", Val: src}}
+	for n.FirstChild != nil {
+		n.RemoveChild(n.FirstChild)
+	}
+	n.AppendChild(&xhtml.Node{Type: xhtml.TextNode, Data: "Video: " + src})
+}
@@ -0,0 +1,215 @@
+package models
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/unrolled/render"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Favorite is a document or folder a user starred, to find it again on the home page
+type Favorite struct {
+	ID       bson.ObjectId `json:"id" bson:"_id"`
+	UserID   bson.ObjectId `json:"userID" bson:"userID"`
+	Kind     string        `json:"kind" bson:"kind"`
+	TargetID bson.ObjectId `json:"targetID" bson:"targetID"`
+	Created  time.Time     `json:"created"`
+}
+
+const favoriteCol = "favorites"
+
+// maxRecentItems is the number of recently viewed and edited documents on the home page
+const maxRecentItems = 10
+
+// homeItem is a document or folder listed on the home page
+type homeItem struct {
+	Kind  string
+	Title string
+	URL   string
+	// Viewed is when the user last looked at a recent document, Edited is set instead when that was to edit it
+	Viewed time.Time
+	Edited time.Time
+}
+
+// liveFolders remembers which folders are out of the trash while the home page is listed
+type liveFolders map[bson.ObjectId]bool
+
+// has checks that the document isn't in a folder that is in the trash
+func (lf liveFolders) has(db *DB, d *Document) bool {
+	if d.FolderID == "" {
+		return true
+	}
+
+	live, ok := lf[d.FolderID]
+	if !ok {
+		_, err := findFolder(db, d.FolderID.Hex())
+		live = err == nil
+		lf[d.FolderID] = live
+	}
+
+	return live
+}
+
+// StarHandler adds a document or folder to the user's favorites, or removes it
+func StarHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		kind := vars["kind"]
+		id := vars["id"]
+		redir := "/" + kind + "/view/" + id
+		if r.FormValue("redirect") == "index" {
+			redir = "/"
+		}
+
+		var target bson.ObjectId
+		switch kind {
+		case "document":
+			d, err := loadPage(db, id)
+			if err != nil || !d.visibleTo(db, user) {
+				s.AddFlash("Sorry, but you can't star that document", "warning")
+				s.Save(r, w)
+				http.Redirect(w, r, "/", http.StatusFound)
+				return
+			}
+			target = d.ID
+		case "folder":
+			f, err := findFolder(db, id)
+			if err != nil || !f.visibleTo(user) {
+				s.AddFlash("Sorry, but you can't star that folder", "warning")
+				s.Save(r, w)
+				http.Redirect(w, r, "/", http.StatusFound)
+				return
+			}
+			target = f.ID
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		starred := r.FormValue("star") == "1"
+		err := setFavorite(db, user.ID, kind, target, starred)
+		if err != nil {
+			ErrorLogger.Print("Could not change favorite {kind: "+kind+", id: "+id+", userID: "+user.ID.Hex()+"} ", err)
+			s.AddFlash("Error! Could not change your favorites. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, redir, http.StatusFound)
+			return
+		}
+
+		InfoLogger.Print("Favorite changed {kind: " + kind + ", id: " + id + ", starred: " + strconv.FormatBool(starred) + ", userID: " + user.ID.Hex() + "}")
+		http.Redirect(w, r, redir, http.StatusFound)
+	}
+}
+
+// setFavorite stars or unstars the target for the user
+func setFavorite(db *DB, userID bson.ObjectId, kind string, targetID bson.ObjectId, starred bool) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(favoriteCol)
+
+	selector := bson.M{"userID": userID, "targetID": targetID}
+	if !starred {
+		_, err := collection.RemoveAll(selector)
+		return err
+	}
+
+	_, err := collection.Upsert(selector, bson.M{
+		"$setOnInsert": bson.M{"_id": bson.NewObjectId(), "kind": kind, "created": time.Now()},
+	})
+	return err
+}
+
+// isFavorite checks if the user starred the target
+func isFavorite(db *DB, userID bson.ObjectId, targetID bson.ObjectId) bool {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(favoriteCol)
+
+	count, err := collection.Find(bson.M{"userID": userID, "targetID": targetID}).Count()
+	return err == nil && count > 0
+}
+
+// findFavoriteItems finds the documents and folders the user starred and can still see, folders first.
+// Documents in folders that are in the trash are left out.
+func findFavoriteItems(db *DB, user *User) ([]homeItem, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(favoriteCol)
+
+	var favorites []Favorite
+	err := collection.Find(bson.M{"userID": user.ID}).Sort("-kind", "created").All(&favorites)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []homeItem{}
+	folders := liveFolders{}
+	for _, fav := range favorites {
+		switch fav.Kind {
+		case "document":
+			d, err := loadPage(db, fav.TargetID.Hex())
+			if err == nil && folders.has(db, d) && d.visibleTo(db, user) {
+				items = append(items, homeItem{Kind: "document", Title: d.DisplayTitle(), URL: "/document/view/" + d.ID.Hex()})
+			}
+		case "folder":
+			f, err := findFolder(db, fav.TargetID.Hex())
+			if err == nil && f.visibleTo(user) {
+				items = append(items, homeItem{Kind: "folder", Title: f.Name, URL: "/folder/view/" + f.ID.Hex()})
+			}
+		}
+	}
+
+	return items, nil
+}
+
+// findRecentItems finds the documents the user viewed or edited last and can still see, most recent first.
+// Documents in folders that are in the trash are left out.
+func findRecentItems(db *DB, user *User) ([]homeItem, error) {
+	views, err := findRecentViews(db, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []homeItem{}
+	folders := liveFolders{}
+	for _, v := range views {
+		d, err := loadPage(db, v.DocumentID.Hex())
+		if err != nil || !folders.has(db, d) || !d.visibleTo(db, user) {
+			continue
+		}
+
+		item := homeItem{Kind: "document", Title: d.DisplayTitle(), URL: "/document/view/" + d.ID.Hex(), Viewed: v.Viewed}
+		if !v.Edited.Before(v.Viewed) {
+			item.Viewed = time.Time{}
+			item.Edited = v.Edited
+		}
+
+		items = append(items, item)
+		if len(items) == maxRecentItems {
+			break
+		}
+	}
+
+	return items, nil
+}
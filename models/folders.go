@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"path"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
@@ -27,6 +28,15 @@ type Folder struct {
 	Users       []User          `json:"-" bson:"-"` // doesn't get stored in the database
 	Documents   []Document      `json:"-" bson:"documents,omitempty"`
 	Permissions []Permission    `json:"-" bson:"permissions,omitempty"`
+	TemplateID  bson.ObjectId   `json:"templateID" bson:"templateID,omitempty"`
+	ReviewerIDs []bson.ObjectId `json:"reviewerIDs" bson:"reviewerIDs,omitempty"`
+	Deleted     bool            `json:"deleted" bson:"deleted,omitempty"`
+	DeletedAt   time.Time       `json:"deletedAt" bson:"deletedAt,omitempty"`
+	DeletedBy   bson.ObjectId   `json:"deletedBy" bson:"deletedBy,omitempty"`
+	AuthorID    bson.ObjectId   `json:"authorID" bson:"authorID,omitempty"`
+	Created     time.Time       `json:"created" bson:"created,omitempty"`
+	EditorID    bson.ObjectId   `json:"editorID" bson:"editorID,omitempty"`
+	Edited      time.Time       `json:"edited" bson:"edited,omitempty"`
 	// We might have folders within folders in the future
 	// FolderIDs   []bson.ObjectId `json:"folderIDs" bson:"folderIDs"`
 	// Folders     []Folder        `json:"-" bson:"-"` // doesn't get stored in the database
@@ -81,9 +91,43 @@ func FolderHandler(db *DB, rend *render.Render) http.HandlerFunc {
 			return
 		}
 
+		// drafts that were never published are only listed for their editors and reviewers
+		var docs []Document
+		for i := range f.Documents {
+			if f.Documents[i].visibleTo(db, user) {
+				docs = append(docs, f.Documents[i])
+			}
+		}
+		f.Documents = docs
+
+		// the listing can be narrowed down to the documents one person created or edited
+		people := parsePersonFilter(r.URL.Query())
+		if people != nil {
+			f.Documents = people.filter(f.Documents)
+		}
+
+		names, err := findUserNames(db)
+		if err != nil {
+			ErrorLogger.Print("Could not find user names. Folder {id: "+id+"} ", err)
+			err = nil
+		}
+
+		folders, err := findAllFolders(db)
+		if err != nil {
+			ErrorLogger.Print("Could not find all folders. Folder {id: "+id+"} ", err)
+			err = nil
+		}
+
 		data := map[string]interface{}{
-			"user":   user,
-			"folder": f,
+			"user":      user,
+			"folder":    f,
+			"folders":   folders,
+			"canDelete": hasPermission(db, user, f.ID, "delete"),
+			"canCopy":   hasPermission(db, user, f.ID, "read"),
+			"watching":  isWatching(db, user.ID, f.ID),
+			"starred":   isFavorite(db, user.ID, f.ID),
+			"names":     names,
+			"people":    people,
 		}
 
 		RenderTemplate(rend, w, r, "folder/view", data)
@@ -174,11 +218,18 @@ func FolderEditHandler(db *DB, rend *render.Render) http.HandlerFunc {
 			err = nil
 		}
 
+		templates, err := findTemplates(db, user)
+		if err != nil {
+			ErrorLogger.Print("Error trying to find templates for folder {id: "+id+"}", err)
+			err = nil
+		}
+
 		data := map[string]interface{}{
-			"user":   user,
-			"users":  users,
-			"folder": f,
-			"exists": exists,
+			"user":      user,
+			"users":     users,
+			"folder":    f,
+			"exists":    exists,
+			"templates": templates,
 		}
 
 		RenderTemplate(rend, w, r, "folder/edit", data)
@@ -202,6 +253,11 @@ func FolderSaveHandler(db *DB, rend *render.Render) http.HandlerFunc {
 			return
 		}
 
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
 		if r.Method == "POST" {
 			var userIDs []bson.ObjectId
 			r.ParseForm()
@@ -226,11 +282,29 @@ func FolderSaveHandler(db *DB, rend *render.Render) http.HandlerFunc {
 				UserIDs: userIDs,
 			}
 
+			if strTemplateID := r.FormValue("template"); bson.IsObjectIdHex(strTemplateID) {
+				f.TemplateID = bson.ObjectIdHex(strTemplateID)
+			}
+
+			for _, uID := range r.Form["reviewers"] {
+				f.ReviewerIDs = append(f.ReviewerIDs, bson.ObjectIdHex(uID))
+			}
+
+			now := time.Now()
 			if id != "" {
 				f.ID = bson.ObjectIdHex(id)
+				// the form only has the settings, so keep who created the folder
+				if existing, err := findFolder(db, id); err == nil {
+					f.AuthorID = existing.AuthorID
+					f.Created = existing.Created
+				}
 			} else {
 				f.ID = bson.NewObjectId()
+				f.AuthorID = user.ID
+				f.Created = now
 			}
+			f.EditorID = user.ID
+			f.Edited = now
 
 			err = f.save(db)
 
@@ -382,7 +456,7 @@ func findAllFolders(db *DB) (*[]Folder, error) {
 	collection := session.DB(db.name).C(col)
 	var folders []Folder
 
-	err := collection.Find(nil).Sort("name").All(&folders)
+	err := collection.Find(bson.M{"deleted": notDeleted}).Sort("name").All(&folders)
 	if err != nil {
 		return nil, err
 	}
@@ -412,7 +486,7 @@ func findFolder(db *DB, idHex string) (*Folder, error) {
 	collection := session.DB(db.name).C(col)
 	f := &Folder{}
 
-	err := collection.FindId(id).One(f)
+	err := collection.Find(bson.M{"_id": id, "deleted": notDeleted}).One(f)
 	if err != nil {
 		return nil, err
 	}
@@ -457,13 +531,24 @@ func findFoldersAndDocuments(db *DB, user *User) (*[]Folder, error) {
 	collection := s.DB(db.name).C(col)
 	var folders []Folder
 
-	query := []bson.M{{
-		"$lookup": bson.M{ // lookup the documents table here
+	query := []bson.M{
+		{"$match": bson.M{"deleted": notDeleted}},
+		{"$lookup": bson.M{ // lookup the documents table here
 			"from":         "documents",
 			"localField":   "_id",
 			"foreignField": "folderID",
 			"as":           "documents",
 		}},
+		{"$project": bson.M{ // leave out documents that are in the trash
+			"name":    1,
+			"level":   1,
+			"userIDs": 1,
+			"documents": bson.M{"$filter": bson.M{
+				"input": "$documents",
+				"as":    "doc",
+				"cond":  bson.M{"$ne": []interface{}{"$$doc.deleted", true}},
+			}},
+		}},
 		{"$match": bson.M{
 			"$or": []bson.M{
 				bson.M{"documents.level": bson.M{"$lte": user.Level}},
@@ -483,6 +568,21 @@ func findFoldersAndDocuments(db *DB, user *User) (*[]Folder, error) {
 	return &folders, nil
 }
 
+// visibleTo checks if the user may see the folder
+func (f *Folder) visibleTo(user *User) bool {
+	if user.Admin || user.Level >= f.Level {
+		return true
+	}
+
+	for _, id := range f.UserIDs {
+		if id == user.ID {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (f *Folder) save(db *DB) (err error) {
 	session := db.sess.Clone()
 	defer session.Close()
@@ -499,7 +599,7 @@ func (f *Folder) findDocsForFolder(db *DB) error {
 	collection := session.DB(db.name).C(documentCol)
 	var docs []Document
 
-	err := collection.Find(bson.M{"folderID": f.ID}).All(&docs)
+	err := collection.Find(bson.M{"folderID": f.ID, "deleted": notDeleted}).All(&docs)
 	f.Documents = docs
 
 	return err
@@ -0,0 +1,95 @@
+package models
+
+import (
+	"bytes"
+	"html/template"
+	"strconv"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Heading is a heading of a document, listed in its table of contents
+type Heading struct {
+	Level int
+	Text  string
+	// ID is the anchor of the heading, it only depends on the text so links survive edits elsewhere
+	ID string
+}
+
+// tocMinHeadings is the number of headings a document needs before it gets a table of contents
+const tocMinHeadings = 2
+
+// headingIDs hands out anchors for the headings of one document, numbering repeated ones
+type headingIDs map[string]int
+
+// next returns the anchor for a heading with the given text
+func (ids headingIDs) next(text string) string {
+	id := strings.Trim(tagChars.ReplaceAllString(strings.ToLower(text), "-"), "-")
+	if id == "" {
+		id = "section"
+	}
+
+	ids[id]++
+	if n := ids[id]; n > 1 {
+		return id + "-" + strconv.Itoa(n)
+	}
+
+	return id
+}
+
+// anchorHeadings gives every heading in a rendered body an id, and returns the body and its headings.
+// Empty headings are skipped, the same way the viewer skips them when it puts the ids back.
+func anchorHeadings(body template.HTML) (template.HTML, []Heading) {
+	nodes, err := xhtml.ParseFragment(strings.NewReader(string(body)), &xhtml.Node{Type: xhtml.ElementNode, Data: "body", DataAtom: atom.Body})
+	if err != nil {
+		return body, nil
+	}
+
+	ids := headingIDs{}
+	var headings []Heading
+	var walk func(n *xhtml.Node)
+	walk = func(n *xhtml.Node) {
+		if n.Type == xhtml.ElementNode {
+			switch n.DataAtom {
+			case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+				text := strings.TrimSpace(whitespace.ReplaceAllString(textContent(n), " "))
+				if text == "" {
+					return
+				}
+
+				h := Heading{Level: int(n.Data[1] - '0'), Text: text, ID: ids.next(text)}
+				setAttr(n, "id", h.ID)
+				headings = append(headings, h)
+				return
+			}
+		}
+
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+
+	var out bytes.Buffer
+	for _, n := range nodes {
+		walk(n)
+		if err := xhtml.Render(&out, n); err != nil {
+			return body, nil
+		}
+	}
+
+	return template.HTML(out.String()), headings
+}
+
+// setAttr sets the attribute of an element, replacing it if it is already there
+func setAttr(n *xhtml.Node, key string, val string) {
+	for i, a := range n.Attr {
+		if a.Key == key {
+			n.Attr[i].Val = val
+			return
+		}
+	}
+
+	n.Attr = append(n.Attr, xhtml.Attribute{Key: key, Val: val})
+}
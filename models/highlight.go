@@ -0,0 +1,369 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"html/template"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/gorilla/sessions"
+	"github.com/unrolled/render"
+
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// CodeLanguage is a language code blocks can be marked as in the editor
+type CodeLanguage struct {
+	Name  string
+	Label string
+}
+
+// codeLanguages are offered in the editor, code blocks without a language are detected when they are shown
+var codeLanguages = []CodeLanguage{
+	{"bash", "Shell"},
+	{"powershell", "PowerShell"},
+	{"batch", "Batch"},
+	{"go", "Go"},
+	{"python", "Python"},
+	{"javascript", "JavaScript"},
+	{"typescript", "TypeScript"},
+	{"java", "Java"},
+	{"csharp", "C#"},
+	{"php", "PHP"},
+	{"ruby", "Ruby"},
+	{"sql", "SQL"},
+	{"json", "JSON"},
+	{"yaml", "YAML"},
+	{"toml", "TOML"},
+	{"ini", "INI"},
+	{"xml", "XML"},
+	{"html", "HTML"},
+	{"css", "CSS"},
+	{"docker", "Dockerfile"},
+	{"nginx", "Nginx"},
+	{"diff", "Diff"},
+	{"plaintext", "Plain text"},
+}
+
+// codeStyles are the colour schemes users can pick for code blocks
+var codeStyles = []string{"monokai", "dracula", "github", "github-dark", "solarized-light", "solarized-dark", "nord", "vs"}
+
+// defaultCodeStyle matches the dark code blocks of the editor
+const defaultCodeStyle = "monokai"
+
+// languageChars matches the characters that aren't allowed in language names
+var languageChars = regexp.MustCompile(`[^a-z0-9+#_-]+`)
+
+// shellLine matches a line that looks like a shell command, chroma can't tell those apart from plain text
+var shellLine = regexp.MustCompile(`^(\$ |sudo |apt(-get)? |yum |dnf |brew |npm |npx |yarn |pip3? |go |git |docker |docker-compose |kubectl |helm |cd |ls |mkdir |rm |cp |mv |cat |echo |export |source |curl |wget |chmod |chown |ssh |scp |tar |make |systemctl |journalctl |grep |find )`)
+
+// codeBlock is a code block of a document with its highlighted lines, for the viewer
+type codeBlock struct {
+	Text string `json:"text"`
+	HTML string `json:"html"`
+}
+
+// CodeStyleHandler changes the colour scheme the user sees code blocks in
+func CodeStyleHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		redir := r.FormValue("redirect")
+		if !strings.HasPrefix(redir, "/document/view/") {
+			redir = "/"
+		}
+
+		style := r.FormValue("style")
+		if !isCodeStyle(style) {
+			s.AddFlash("Sorry, but that code style doesn't exist", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, redir, http.StatusFound)
+			return
+		}
+
+		err := setCodeStyle(db, user.ID, style)
+		if err != nil {
+			ErrorLogger.Print("Could not change code style {userID: "+user.ID.Hex()+", style: "+style+"} ", err)
+			s.AddFlash("Error! Could not change your code style. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, redir, http.StatusFound)
+			return
+		}
+
+		InfoLogger.Print("Code style changed {userID: " + user.ID.Hex() + ", style: " + style + "}")
+		http.Redirect(w, r, redir, http.StatusFound)
+	}
+}
+
+func isCodeStyle(name string) bool {
+	for _, style := range codeStyles {
+		if style == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func setCodeStyle(db *DB, userID bson.ObjectId, style string) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(userCol)
+
+	if style == defaultCodeStyle {
+		return collection.UpdateId(userID, bson.M{"$unset": bson.M{"codeStyle": ""}})
+	}
+	return collection.UpdateId(userID, bson.M{"$set": bson.M{"codeStyle": style}})
+}
+
+// findCodeStyle finds the colour scheme the user picked for code blocks, or the default one
+func findCodeStyle(db *DB, userID bson.ObjectId) string {
+	u, err := findUser(db, userID.Hex())
+	if err != nil || !isCodeStyle(u.CodeStyle) {
+		return defaultCodeStyle
+	}
+
+	return u.CodeStyle
+}
+
+// codeLanguage returns the language of a code line, and if the line is code at all.
+// Code blocks from before languages could be picked have no language.
+func codeLanguage(attributes map[string]interface{}) (string, bool) {
+	switch v := attributes["code-block"].(type) {
+	case bool:
+		return "", v
+	case string:
+		return languageChars.ReplaceAllString(strings.ToLower(v), ""), true
+	}
+
+	return "", false
+}
+
+// codeLexer finds the lexer for the language, or guesses it from the code
+func codeLexer(language string, code string) chroma.Lexer {
+	lexer := lexers.Get(language)
+	if language == "" || lexer == nil {
+		lexer = lexers.Analyse(code)
+	}
+	if lexer == nil && looksLikeShell(code) {
+		lexer = lexers.Get("bash")
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+
+	return chroma.Coalesce(lexer)
+}
+
+// looksLikeShell checks if the first line of the code is a shell command
+func looksLikeShell(code string) bool {
+	for _, line := range strings.Split(code, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return shellLine.MatchString(line + " ")
+		}
+	}
+
+	return false
+}
+
+// highlightLines highlights the lines of a code block. Every line is escaped HTML with its own spans,
+// so lines can be wrapped on their own, and the text of the lines is exactly the text of the code.
+func highlightLines(language string, lines []string) []string {
+	code := strings.Join(lines, "\n")
+	plain := func() []string {
+		out := make([]string, len(lines))
+		for i, line := range lines {
+			out[i] = html.EscapeString(line)
+		}
+		return out
+	}
+
+	iterator, err := codeLexer(language, code).Tokenise(nil, code)
+	if err != nil {
+		return plain()
+	}
+
+	out := make([]string, 0, len(lines))
+	var line strings.Builder
+	written := 0
+	for _, token := range iterator.Tokens() {
+		// lexers may add a newline at the end, which isn't part of the code
+		value := token.Value
+		if written+len(value) > len(code) {
+			value = value[:len(code)-written]
+		}
+		written += len(value)
+
+		class := tokenClass(token.Type)
+		for i, part := range strings.Split(value, "\n") {
+			if i > 0 {
+				out = append(out, line.String())
+				line.Reset()
+			}
+			if part == "" {
+				continue
+			}
+			if class == "" {
+				line.WriteString(html.EscapeString(part))
+			} else {
+				line.WriteString(`<span class="hljs-` + class + `">` + html.EscapeString(part) + "</span>")
+			}
+		}
+	}
+	out = append(out, line.String())
+
+	if written != len(code) || len(out) != len(lines) {
+		return plain()
+	}
+
+	return out
+}
+
+// tokenClass is the short CSS class of the token type, the one of its category when it has none of its own
+func tokenClass(t chroma.TokenType) string {
+	for _, tt := range []chroma.TokenType{t, t.SubCategory(), t.Category()} {
+		if class, ok := chroma.StandardTypes[tt]; ok {
+			return class
+		}
+	}
+
+	return ""
+}
+
+// codeStyleCSS is the stylesheet of the colour scheme for highlighted code blocks
+func codeStyleCSS(name string) template.CSS {
+	style := styles.Get(name)
+	bg := style.Get(chroma.Background)
+	// some styles expect the page's own black on white
+	if !bg.Colour.IsSet() {
+		bg.Colour = chroma.NewColour(0, 0, 0)
+	}
+	if !bg.Background.IsSet() {
+		bg.Background = chroma.NewColour(255, 255, 255)
+	}
+
+	var css strings.Builder
+	// Quill's themes give code blocks a colour scheme of their own
+	css.WriteString(".ql-bubble .ql-editor pre.ql-syntax, pre.ql-syntax { " + chromahtml.StyleEntryToCSS(bg) + " }\n")
+
+	types := make([]chroma.TokenType, 0, len(chroma.StandardTypes))
+	for t := range chroma.StandardTypes {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	for _, t := range types {
+		// the types below zero style chroma's own markup, like line numbers
+		class := chroma.StandardTypes[t]
+		if class == "" || t < 0 {
+			continue
+		}
+		if entry := chromahtml.StyleEntryToCSS(style.Get(t).Sub(bg)); entry != "" {
+			css.WriteString("pre.ql-syntax .hljs-" + class + " { " + entry + " }\n")
+		}
+	}
+
+	return template.CSS(css.String())
+}
+
+// codeLines splits the text of a rendered code block into its lines
+func codeLines(n *xhtml.Node) []string {
+	return strings.Split(strings.TrimSuffix(textContent(n), "\n"), "\n")
+}
+
+// findCodeBlocks highlights the code blocks of a rendered body for the viewer, which looks them up by their text
+func findCodeBlocks(body template.HTML) []codeBlock {
+	nodes, err := xhtml.ParseFragment(strings.NewReader(string(body)), &xhtml.Node{Type: xhtml.ElementNode, Data: "body", DataAtom: atom.Body})
+	if err != nil {
+		return nil
+	}
+
+	var blocks []codeBlock
+	var walk func(n *xhtml.Node)
+	walk = func(n *xhtml.Node) {
+		if n.Type == xhtml.ElementNode && n.DataAtom == atom.Pre {
+			lines := codeLines(n)
+			blocks = append(blocks, codeBlock{
+				Text: strings.Join(lines, "\n") + "\n",
+				HTML: strings.Join(highlightLines(attr(n, "data-language"), lines), "\n") + "\n",
+			})
+			return
+		}
+
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	for _, n := range nodes {
+		walk(n)
+	}
+
+	return blocks
+}
+
+// highlightBody highlights the code blocks of a rendered body in place and numbers their lines,
+// for pages that show the body as it is
+func highlightBody(body template.HTML) template.HTML {
+	nodes, err := xhtml.ParseFragment(strings.NewReader(string(body)), &xhtml.Node{Type: xhtml.ElementNode, Data: "body", DataAtom: atom.Body})
+	if err != nil {
+		return body
+	}
+
+	var walk func(n *xhtml.Node)
+	walk = func(n *xhtml.Node) {
+		if n.Type == xhtml.ElementNode && n.DataAtom == atom.Pre {
+			lines := highlightLines(attr(n, "data-language"), codeLines(n))
+			for n.FirstChild != nil {
+				n.RemoveChild(n.FirstChild)
+			}
+			setAttr(n, "class", "ql-syntax line-numbers")
+			n.AppendChild(&xhtml.Node{
+				Type: xhtml.RawNode,
+				Data: `<span class="code-line">` + strings.Join(lines, "</span>\n"+`<span class="code-line">`) + "</span>\n",
+			})
+			return
+		}
+
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+
+	var out bytes.Buffer
+	for _, n := range nodes {
+		walk(n)
+		if err := xhtml.Render(&out, n); err != nil {
+			return body
+		}
+	}
+
+	return template.HTML(out.String())
+}
+
+// lineNumberCSS numbers the lines of code blocks highlighted by highlightBody, without the numbers being copied
+const lineNumberCSS = `pre.line-numbers { counter-reset: code-line; }
+pre.line-numbers .code-line::before { counter-increment: code-line; content: counter(code-line); display: inline-block; width: 2.5em; margin-right: 1em; text-align: right; opacity: .5; user-select: none; }
+`
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"image"
+	"image/color"
+)
+
+// thumbnail scales img down so that neither side is bigger than max pixels.
+// Each thumbnail pixel is the average of the source pixels it covers,
+// which gives decent quality without depending on an image library.
+func thumbnail(img image.Image, max int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return img
+	}
+
+	tw, th := w, h
+	if w > max || h > max {
+		if w >= h {
+			tw = max
+			th = h * max / w
+		} else {
+			th = max
+			tw = w * max / h
+		}
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		sy0 := b.Min.Y + y*h/th
+		sy1 := b.Min.Y + (y+1)*h/th
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+
+		for x := 0; x < tw; x++ {
+			sx0 := b.Min.X + x*w/tw
+			sx1 := b.Min.X + (x+1)*w/tw
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					bl += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(bl / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,1026 @@
+package models
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/russross/blackfriday/v2"
+	"github.com/unrolled/render"
+
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ImportOptions control where imported documents go and whether they are saved
+type ImportOptions struct {
+	// Folder is the folder for pages at the top of the source, pages in directories go in folders named after them
+	Folder string
+	Level  int
+	// Author is the user the documents and attachments are created by
+	Author *User
+	// Apply saves the import, without it the report only shows what would be imported
+	Apply bool
+}
+
+// ImportReport describes what an import did, or would do when it is a dry run
+type ImportReport struct {
+	Applied   bool
+	Folders   []ImportFolder
+	Documents []ImportDocument
+	Warnings  []string
+}
+
+// ImportFolder is a folder that imported documents go in
+type ImportFolder struct {
+	Name   string
+	ID     bson.ObjectId
+	Exists bool
+}
+
+// ImportDocument is a page of the import source and the document it becomes
+type ImportDocument struct {
+	Source    string
+	Title     string
+	Folder    string
+	ID        bson.ObjectId
+	Revisions int
+	Authors   []string
+	Images    int
+	// Skipped is the reason the page isn't imported, if it isn't
+	Skipped string
+}
+
+// Imported counts the documents that are, or would be, created
+func (r *ImportReport) Imported() int {
+	count := 0
+	for _, d := range r.Documents {
+		if d.Skipped == "" {
+			count++
+		}
+	}
+
+	return count
+}
+
+// importPage is a page read from an import source, before it becomes a document
+type importPage struct {
+	// source is the path of the file, or the title of the wiki page
+	source string
+	// dir is the directory of the file, that relative links and images start from
+	dir       string
+	folder    string
+	title     string
+	html      string
+	tags      []string
+	created   time.Time
+	edited    time.Time
+	revisions int
+	authors   []string
+	id        bson.ObjectId
+	// history is who edited a wiki page and when, oldest first
+	history []importRevision
+}
+
+// importRevision is an edit of a page in the import source
+type importRevision struct {
+	edited  time.Time
+	author  string
+	comment string
+}
+
+// importSource is the pages read from a directory, a zip or a wiki dump
+type importSource struct {
+	// files holds the images the pages refer to, it is nil for wiki dumps
+	files    fs.FS
+	pages    []*importPage
+	warnings []string
+}
+
+// ImportFiles imports the Markdown and HTML files in files, which can be a directory or a zip.
+// Every directory becomes a folder.
+func ImportFiles(db *DB, files fs.FS, opts ImportOptions) (*ImportReport, error) {
+	src, err := readImportFiles(files, opts.Folder)
+	if err != nil {
+		return nil, err
+	}
+
+	return runImport(db, src, opts)
+}
+
+// ImportMediaWiki imports the articles of a MediaWiki XML dump, with the history of who edited them and when.
+// Documents only keep their latest version, so the text of older revisions isn't imported.
+func ImportMediaWiki(db *DB, dump io.Reader, opts ImportOptions) (*ImportReport, error) {
+	src, err := readMediaWiki(dump, opts.Folder)
+	if err != nil {
+		return nil, err
+	}
+
+	return runImport(db, src, opts)
+}
+
+// readImportFiles reads the pages of a directory tree. The folder of a page is named after its directory,
+// below the folder given for the top of the tree.
+func readImportFiles(files fs.FS, folder string) (*importSource, error) {
+	src := &importSource{files: files}
+
+	err := fs.WalkDir(files, ".", func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name := entry.Name()
+		if p != "." && (strings.HasPrefix(name, ".") || name == "__MACOSX") {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		ext := strings.ToLower(path.Ext(name))
+		if ext != ".md" && ext != ".markdown" && ext != ".html" && ext != ".htm" {
+			return nil
+		}
+
+		raw, err := readImportFile(files, p)
+		if err != nil {
+			return err
+		}
+
+		page := &importPage{
+			source:    p,
+			dir:       path.Dir(p),
+			folder:    importFolderName(folder, path.Dir(p)),
+			revisions: 1,
+		}
+
+		if ext == ".md" || ext == ".markdown" {
+			page.html = string(blackfriday.Run(raw))
+		} else {
+			page.html = string(raw)
+		}
+
+		page.title = htmlTitle(page.html)
+		if page.title == "" {
+			page.title = strings.TrimSuffix(name, path.Ext(name))
+		}
+
+		if info, err := entry.Info(); err == nil && !info.ModTime().IsZero() {
+			page.created = info.ModTime()
+			page.edited = info.ModTime()
+		}
+
+		src.pages = append(src.pages, page)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return src, nil
+}
+
+// importFolderName names the folder for a directory, with its parents, below the top folder
+func importFolderName(top string, dir string) string {
+	parts := []string{}
+	if top = strings.TrimSpace(top); top != "" {
+		parts = append(parts, top)
+	}
+	if dir != "." {
+		parts = append(parts, strings.Split(dir, "/")...)
+	}
+
+	return strings.Join(parts, " / ")
+}
+
+// htmlTitle finds the title of an HTML page, or its first top level heading
+func htmlTitle(body string) string {
+	doc, err := xhtml.Parse(strings.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	var title, heading string
+	var find func(n *xhtml.Node)
+	find = func(n *xhtml.Node) {
+		if n.Type == xhtml.ElementNode {
+			switch {
+			case n.DataAtom == atom.Title && title == "":
+				title = strings.TrimSpace(whitespace.ReplaceAllString(textContent(n), " "))
+			case n.DataAtom == atom.H1 && heading == "":
+				heading = strings.TrimSpace(whitespace.ReplaceAllString(textContent(n), " "))
+			}
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			find(child)
+		}
+	}
+	find(doc)
+
+	if title != "" {
+		return title
+	}
+
+	return heading
+}
+
+// mediaWikiDump is the part of a MediaWiki XML export that is imported
+type mediaWikiDump struct {
+	SiteName string          `xml:"siteinfo>sitename"`
+	Pages    []mediaWikiPage `xml:"page"`
+}
+
+type mediaWikiPage struct {
+	Title     string              `xml:"title"`
+	NS        int                 `xml:"ns"`
+	Redirect  *struct{}           `xml:"redirect"`
+	Revisions []mediaWikiRevision `xml:"revision"`
+}
+
+type mediaWikiRevision struct {
+	Timestamp time.Time `xml:"timestamp"`
+	Username  string    `xml:"contributor>username"`
+	IP        string    `xml:"contributor>ip"`
+	Comment   string    `xml:"comment"`
+	Text      string    `xml:"text"`
+}
+
+// readMediaWiki reads the articles of a MediaWiki dump. Other namespaces, like talk and user pages,
+// and redirects are left out. Every page goes in the given folder, or one named after the wiki.
+func readMediaWiki(dump io.Reader, folder string) (*importSource, error) {
+	var wiki mediaWikiDump
+	err := xml.NewDecoder(dump).Decode(&wiki)
+	if err != nil {
+		return nil, errors.New("Could not read the MediaWiki dump: " + err.Error())
+	}
+
+	folder = strings.TrimSpace(folder)
+	if folder == "" {
+		folder = strings.TrimSpace(wiki.SiteName)
+	}
+
+	src := &importSource{}
+	skipped := 0
+	for _, wp := range wiki.Pages {
+		if wp.NS != 0 || wp.Redirect != nil || len(wp.Revisions) == 0 {
+			skipped++
+			continue
+		}
+
+		revisions := wp.Revisions
+		sort.SliceStable(revisions, func(i, j int) bool {
+			return revisions[i].Timestamp.Before(revisions[j].Timestamp)
+		})
+		latest := revisions[len(revisions)-1]
+
+		page := &importPage{
+			source:    wp.Title,
+			folder:    folder,
+			title:     wikiTitle(wp.Title),
+			created:   revisions[0].Timestamp,
+			edited:    latest.Timestamp,
+			revisions: len(revisions),
+		}
+
+		seen := map[string]bool{}
+		for _, rev := range revisions {
+			author := rev.Username
+			if author == "" {
+				author = rev.IP
+			}
+			if author != "" && !seen[author] {
+				seen[author] = true
+				page.authors = append(page.authors, author)
+			}
+			page.history = append(page.history, importRevision{rev.Timestamp, author, strings.TrimSpace(rev.Comment)})
+		}
+
+		converted := wikitextToHTML(latest.Text)
+		page.html = converted.html
+		page.tags = parseTags(strings.Join(converted.categories, ","))
+		if len(converted.files) > 0 {
+			src.warnings = append(src.warnings, page.title+": "+pluralize(len(converted.files), "file")+" left out, the dump doesn't include uploads")
+		}
+		if converted.templates > 0 {
+			src.warnings = append(src.warnings, page.title+": "+pluralize(converted.templates, "template")+" left out")
+		}
+
+		src.pages = append(src.pages, page)
+	}
+
+	if skipped > 0 {
+		src.warnings = append(src.warnings, "Left out "+pluralize(skipped, "page")+" that aren't articles, like redirects and talk pages")
+	}
+
+	return src, nil
+}
+
+// runImport turns the pages of an import source into documents. Pages are converted and checked
+// the same way whether the import is applied or not, so a dry run reports what applying it would do.
+// Pages whose title is already used in their folder are skipped, and links to them go to the existing document.
+func runImport(db *DB, src *importSource, opts ImportOptions) (*ImportReport, error) {
+	if opts.Apply && opts.Author == nil {
+		return nil, errors.New("An import needs an author")
+	}
+
+	report := &ImportReport{Applied: opts.Apply, Warnings: src.warnings}
+
+	folders, err := importFolders(db, src, opts, report)
+	if err != nil {
+		return report, err
+	}
+
+	// every page gets its id first, so pages can link to pages that come after them
+	byTitle := map[string]*importPage{}
+	bySource := map[string]*importPage{}
+	skipped := map[*importPage]string{}
+	for _, p := range src.pages {
+		key := p.folder + "\x00" + strings.ToLower(p.title)
+		if _, ok := byTitle[key]; ok {
+			skipped[p] = "Another page in the import has this title"
+			continue
+		}
+
+		existing, err := findDocumentByTitle(db, folders[p.folder].ID, p.title)
+		if err != nil {
+			return report, err
+		}
+		if existing != nil {
+			p.id = existing.ID
+			skipped[p] = "A document with this title already exists"
+		} else {
+			p.id = bson.NewObjectId()
+		}
+
+		byTitle[key] = p
+		bySource[p.source] = p
+	}
+
+	// wiki links name the page, not its folder, and every wiki page is in the same folder
+	wikiPages := map[string]*importPage{}
+	for _, p := range src.pages {
+		if src.files == nil && p.id != "" {
+			wikiPages[wikiTitle(p.source)] = p
+		}
+	}
+
+	for _, p := range src.pages {
+		doc := ImportDocument{
+			Source:    p.source,
+			Title:     p.title,
+			Folder:    p.folder,
+			ID:        p.id,
+			Revisions: p.revisions,
+			Authors:   p.authors,
+			Skipped:   skipped[p],
+		}
+
+		if doc.Skipped == "" {
+			delta := htmlToDelta(p.html)
+			dropTitleLine(delta, p.title)
+
+			report.Warnings = append(report.Warnings, resolveImportLinks(delta, p, bySource, wikiPages)...)
+
+			var warnings []string
+			doc.Images, warnings, err = importImages(db, src.files, p, delta, opts)
+			report.Warnings = append(report.Warnings, warnings...)
+			if err != nil {
+				return report, err
+			}
+
+			if opts.Apply {
+				err = saveImportedDocument(db, p, folders[p.folder].ID, delta, opts)
+				if err != nil {
+					return report, err
+				}
+			}
+		}
+
+		report.Documents = append(report.Documents, doc)
+	}
+
+	return report, nil
+}
+
+// importFolders finds or creates the folders the pages go in
+func importFolders(db *DB, src *importSource, opts ImportOptions, report *ImportReport) (map[string]ImportFolder, error) {
+	folders := map[string]ImportFolder{}
+
+	for _, p := range src.pages {
+		if _, ok := folders[p.folder]; ok || p.folder == "" {
+			continue
+		}
+
+		f, err := findFolderByName(db, p.folder)
+		if err != nil {
+			return nil, err
+		}
+
+		folder := ImportFolder{Name: p.folder, Exists: f != nil}
+		if f != nil {
+			folder.ID = f.ID
+		} else if opts.Apply {
+			f = &Folder{
+				ID:      bson.NewObjectId(),
+				Name:    p.folder,
+				Level:   opts.Level,
+				UserIDs: []bson.ObjectId{},
+			}
+			err = f.save(db)
+			if err != nil {
+				return nil, err
+			}
+			folder.ID = f.ID
+		}
+
+		folders[p.folder] = folder
+		report.Folders = append(report.Folders, folder)
+	}
+
+	return folders, nil
+}
+
+// dropTitleLine removes the first line of the Delta when it is a heading that repeats the title
+func dropTitleLine(delta *Delta, title string) {
+	text := ""
+	for i, op := range delta.Ops {
+		s, ok := op.Insert.(string)
+		if !ok {
+			return
+		}
+
+		nl := strings.Index(s, "\n")
+		if nl < 0 {
+			text += s
+			continue
+		}
+		text += s[:nl]
+
+		if header, _ := op.Attributes["header"].(float64); header != 1 || strings.TrimSpace(text) != title {
+			return
+		}
+
+		rest := delta.Ops[i+1:]
+		if nl < len(s)-1 {
+			rest = append([]DeltaOp{{Insert: s[nl+1:], Attributes: op.Attributes}}, rest...)
+		}
+		if len(rest) == 0 {
+			rest = []DeltaOp{{Insert: "\n"}}
+		}
+		delta.Ops = rest
+		return
+	}
+}
+
+// resolveImportLinks points links to other imported pages at their documents.
+// It returns warnings for the links it couldn't resolve.
+func resolveImportLinks(delta *Delta, p *importPage, bySource map[string]*importPage, wikiPages map[string]*importPage) []string {
+	var warnings []string
+	missing := map[string]bool{}
+
+	for i, op := range delta.Ops {
+		link, ok := op.Attributes["link"].(string)
+		if !ok {
+			continue
+		}
+
+		if strings.HasPrefix(link, wikiLinkPrefix) {
+			target := wikiPages[wikiTitle(strings.TrimPrefix(link, wikiLinkPrefix))]
+			if target == nil {
+				// there's nothing to link to, so it's left as text
+				missing[strings.TrimPrefix(link, wikiLinkPrefix)] = true
+				delete(delta.Ops[i].Attributes, "link")
+				continue
+			}
+			delta.Ops[i].Attributes["link"] = "/document/view/" + target.id.Hex()
+			continue
+		}
+
+		u, err := url.Parse(link)
+		if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" || strings.HasPrefix(u.Path, "/") {
+			continue
+		}
+
+		target := bySource[path.Join(p.dir, u.Path)]
+		if target == nil {
+			missing[link] = true
+			continue
+		}
+		delta.Ops[i].Attributes["link"] = "/document/view/" + target.id.Hex()
+	}
+
+	for link := range missing {
+		warnings = append(warnings, p.title+": link to "+link+" doesn't go to an imported page")
+	}
+	sort.Strings(warnings)
+
+	return warnings
+}
+
+// importImages finds the images of a page. Images in the import source are stored as attachments
+// of the document when the import is applied, and images that can't be found are removed.
+// It returns the number of images the document will have.
+func importImages(db *DB, files fs.FS, p *importPage, delta *Delta, opts ImportOptions) (int, []string, error) {
+	var warnings []string
+	count := 0
+	ops := delta.Ops[:0]
+
+	for _, op := range delta.Ops {
+		embed, ok := op.Insert.(map[string]interface{})
+		src, _ := embed["image"].(string)
+		if !ok || src == "" {
+			ops = append(ops, op)
+			continue
+		}
+
+		u, err := url.Parse(src)
+		if err != nil || u.Scheme != "" || u.Host != "" || strings.HasPrefix(u.Path, "/") || files == nil {
+			// data URIs become attachments when the document is saved, other images are linked where they are
+			count++
+			ops = append(ops, op)
+			continue
+		}
+
+		raw, err := readImportFile(files, path.Join(p.dir, u.Path))
+		if err != nil {
+			warnings = append(warnings, p.title+": image "+src+" was not found")
+			continue
+		}
+
+		a, err := newAttachment(raw, importAuthorID(opts))
+		if err != nil {
+			warnings = append(warnings, p.title+": image "+src+" is not a supported image")
+			continue
+		}
+
+		if opts.Apply {
+			a.DocumentID = p.id
+			err = a.save(db)
+			if err != nil {
+				return count, warnings, err
+			}
+		}
+
+		op.Insert = map[string]interface{}{"image": a.url()}
+		ops = append(ops, op)
+		count++
+	}
+
+	delta.Ops = ops
+	return count, warnings, nil
+}
+
+func importAuthorID(opts ImportOptions) bson.ObjectId {
+	if opts.Author == nil {
+		return ""
+	}
+
+	return opts.Author.ID
+}
+
+// saveImportedDocument saves an imported page as a published document, encrypted like every other
+func saveImportedDocument(db *DB, p *importPage, folderID bson.ObjectId, delta *Delta, opts ImportOptions) error {
+	now := time.Now()
+	d := &Document{
+		ID:        p.id,
+		Title:     p.title,
+		Level:     opts.Level,
+		Created:   p.created,
+		Edited:    p.edited,
+		FolderID:  folderID,
+		UserIDs:   []bson.ObjectId{},
+		AuthorID:  opts.Author.ID,
+		Tags:      p.tags,
+		Status:    StatusPublished,
+		Published: now,
+
+		EditorID:       opts.Author.ID,
+		ContributorIDs: []bson.ObjectId{opts.Author.ID},
+	}
+	if d.Created.IsZero() {
+		d.Created = now
+	}
+	if d.Edited.IsZero() {
+		d.Edited = now
+	}
+
+	_, err := extractDeltaImages(db, d.ID, opts.Author.ID, delta)
+	if err != nil {
+		ErrorLogger.Print("Could not extract images from imported document {id: "+d.ID.Hex()+"} ", err)
+	}
+
+	_, err = d.setContent(delta)
+	if err != nil {
+		return err
+	}
+
+	err = d.save(db)
+	if err != nil {
+		return err
+	}
+
+	err = saveImportedHistory(db, p, d, opts)
+	if err != nil {
+		return err
+	}
+
+	indexDocument(db, d)
+	InfoLogger.Print("Document imported {id: " + d.ID.Hex() + ", source: " + strconv.Quote(p.source) + ", userID: " + opts.Author.ID.Hex() + "}")
+
+	return nil
+}
+
+// saveImportedHistory keeps the edits of an imported page with the changes to documents. The editors of
+// the source aren't users of the wiki, so the changes are by the importing user under the editor's name.
+func saveImportedHistory(db *DB, p *importPage, d *Document, opts ImportOptions) error {
+	if len(p.history) == 0 {
+		return nil
+	}
+
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(changeCol)
+
+	changes := make([]interface{}, len(p.history))
+	for i, rev := range p.history {
+		name := rev.author
+		if name == "" {
+			name = "Unknown"
+		}
+		changes[i] = &Change{
+			ID:         bson.NewObjectId(),
+			Event:      EventPublished,
+			DocumentID: d.ID,
+			FolderID:   d.FolderID,
+			Title:      d.Title,
+			Summary:    rev.comment,
+			UserID:     opts.Author.ID,
+			UserName:   name,
+			Created:    rev.edited,
+		}
+	}
+
+	return collection.Insert(changes...)
+}
+
+// findFolderByName finds a folder that isn't in the trash by its name, or nil if there isn't one
+func findFolderByName(db *DB, name string) (*Folder, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(col)
+
+	var folders []Folder
+	err := collection.Find(bson.M{"name": name, "deleted": notDeleted}).Select(bson.M{"documents": 0}).Limit(1).All(&folders)
+	if err != nil || len(folders) == 0 {
+		return nil, err
+	}
+
+	return &folders[0], nil
+}
+
+// findDocumentByTitle finds a document in the folder by its title, or nil if there isn't one
+func findDocumentByTitle(db *DB, folderID bson.ObjectId, title string) (*Document, error) {
+	if folderID == "" {
+		// pages without a folder, or in a folder that doesn't exist yet, can't clash
+		return nil, nil
+	}
+
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(documentCol)
+
+	var docs []Document
+	query := bson.M{"folderID": folderID, "title": title, "deleted": notDeleted, "template": bson.M{"$ne": true}}
+	err := collection.Find(query).Select(bson.M{"body": 0, "delta": 0, "draft": 0}).Limit(1).All(&docs)
+	if err != nil || len(docs) == 0 {
+		return nil, err
+	}
+
+	return &docs[0], nil
+}
+
+// maxImportSize is the largest zip or wiki dump that can be uploaded
+const maxImportSize = 200 << 20
+
+// maxImportFileSize is the largest page or image that is read from an import, however well it was compressed
+const maxImportFileSize = 20 << 20
+
+// readImportFile reads a file of an import source, failing if it is larger than maxImportFileSize
+func readImportFile(files fs.FS, name string) ([]byte, error) {
+	f, err := files.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(f, maxImportFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > maxImportFileSize {
+		return nil, errors.New(name + " is larger than " + strconv.Itoa(maxImportFileSize>>20) + " MB")
+	}
+
+	return raw, nil
+}
+
+// importUploadAge is how long an uploaded import waits to be applied before it is cleaned up
+const importUploadAge = 24 * time.Hour
+
+// importKinds maps the kinds of upload that can be imported to their file extensions
+var importKinds = map[string]string{
+	"files":     ".zip",
+	"mediawiki": ".xml",
+}
+
+// ImportHandler shows the form for uploading content to import
+func ImportHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		if !user.Admin {
+			InfoLogger.Print("User tried to open the importer without permission: {userID: " + user.ID.Hex() + "}")
+			s.AddFlash("Sorry, but only admins can import content", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		data := map[string]interface{}{
+			"user": user,
+			"page": "import",
+		}
+
+		RenderTemplate(rend, w, r, "import/index", data)
+	}
+}
+
+// ImportUploadHandler stores an uploaded zip of Markdown and HTML files or a MediaWiki dump,
+// and shows a dry run of importing it, which the admin applies with ImportApplyHandler
+func ImportUploadHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		if !user.Admin {
+			InfoLogger.Print("User tried to upload an import without permission: {userID: " + user.ID.Hex() + "}")
+			s.AddFlash("Sorry, but only admins can import content", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+		err := r.ParseMultipartForm(32 << 20)
+		if err != nil {
+			InfoLogger.Print("Import upload too large or malformed {userID: "+user.ID.Hex()+"} ", err)
+			s.AddFlash("The upload is too large, imports can be up to "+strconv.Itoa(maxImportSize>>20)+"MB", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/import/", http.StatusFound)
+			return
+		}
+
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			s.AddFlash("Choose a file to import", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/import/", http.StatusFound)
+			return
+		}
+		defer file.Close()
+
+		kind := ""
+		ext := strings.ToLower(filepath.Ext(header.Filename))
+		for k, e := range importKinds {
+			if e == ext {
+				kind = k
+			}
+		}
+		if kind == "" {
+			s.AddFlash("Upload a zip of Markdown or HTML files, or a MediaWiki XML dump", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/import/", http.StatusFound)
+			return
+		}
+
+		cleanImportUploads()
+
+		token := bson.NewObjectId().Hex()
+		out, err := os.Create(importUploadPath(token, kind))
+		if err == nil {
+			_, err = io.Copy(out, file)
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			ErrorLogger.Print("Could not store import upload {userID: "+user.ID.Hex()+"} ", err)
+			s.AddFlash("Error! Could not store the upload. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/import/", http.StatusFound)
+			return
+		}
+
+		folder := strings.TrimSpace(r.FormValue("folder"))
+		if folder == "" && kind == "files" {
+			folder = strings.TrimSuffix(filepath.Base(header.Filename), filepath.Ext(header.Filename))
+		}
+		level, _ := strconv.Atoi(r.FormValue("level"))
+		opts := ImportOptions{Folder: folder, Level: level, Author: user}
+
+		report, err := runUploadedImport(db, token, kind, opts)
+		if err != nil {
+			InfoLogger.Print("Could not read import upload {token: "+token+", userID: "+user.ID.Hex()+"} ", err)
+			os.Remove(importUploadPath(token, kind))
+			s.AddFlash("Could not read "+header.Filename+": "+err.Error(), "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/import/", http.StatusFound)
+			return
+		}
+
+		InfoLogger.Print("Import dry run {token: " + token + ", file: " + strconv.Quote(header.Filename) + ", documents: " + strconv.Itoa(report.Imported()) + ", userID: " + user.ID.Hex() + "}")
+
+		data := map[string]interface{}{
+			"user":     user,
+			"page":     "import",
+			"report":   report,
+			"token":    token,
+			"kind":     kind,
+			"fileName": header.Filename,
+			"folder":   folder,
+			"level":    level,
+		}
+
+		RenderTemplate(rend, w, r, "import/index", data)
+	}
+}
+
+// ImportApplyHandler imports an upload that was checked with a dry run
+func ImportApplyHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		if !user.Admin {
+			InfoLogger.Print("User tried to apply an import without permission: {userID: " + user.ID.Hex() + "}")
+			s.AddFlash("Sorry, but only admins can import content", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		token := r.FormValue("token")
+		kind := r.FormValue("kind")
+		if _, ok := importKinds[kind]; !ok || !bson.IsObjectIdHex(token) {
+			http.Error(w, "Invalid import", http.StatusBadRequest)
+			return
+		}
+
+		level, _ := strconv.Atoi(r.FormValue("level"))
+		opts := ImportOptions{
+			Folder: strings.TrimSpace(r.FormValue("folder")),
+			Level:  level,
+			Author: user,
+			Apply:  true,
+		}
+
+		report, err := runUploadedImport(db, token, kind, opts)
+		if os.IsNotExist(err) {
+			s.AddFlash("The upload has expired, upload the file again to import it", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/import/", http.StatusFound)
+			return
+		}
+		if err != nil && (report == nil || report.Imported() == 0) {
+			ErrorLogger.Print("Could not apply import {token: "+token+", userID: "+user.ID.Hex()+"} ", err)
+			s.AddFlash("Error! The import stopped before it finished. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/import/", http.StatusFound)
+			return
+		}
+		if err != nil {
+			// the documents that were created stay, importing the upload again skips them
+			ErrorLogger.Print("Import stopped part way {token: "+token+", documents: "+strconv.Itoa(report.Imported())+", userID: "+user.ID.Hex()+"} ", err)
+			s.AddFlash("Error! The import stopped before it finished. Only the pages listed below were imported, apply the import again to import the rest.", "danger")
+			s.Save(r, w)
+
+			data := map[string]interface{}{
+				"user":       user,
+				"page":       "import",
+				"report":     report,
+				"token":      token,
+				"kind":       kind,
+				"fileName":   r.FormValue("fileName"),
+				"folder":     opts.Folder,
+				"level":      opts.Level,
+				"incomplete": true,
+			}
+
+			RenderTemplate(rend, w, r, "import/index", data)
+			return
+		}
+		os.Remove(importUploadPath(token, kind))
+
+		InfoLogger.Print("Import applied {token: " + token + ", documents: " + strconv.Itoa(report.Imported()) + ", folders: " + strconv.Itoa(len(report.Folders)) + ", userID: " + user.ID.Hex() + "}")
+
+		data := map[string]interface{}{
+			"user":     user,
+			"page":     "import",
+			"report":   report,
+			"fileName": r.FormValue("fileName"),
+		}
+
+		RenderTemplate(rend, w, r, "import/index", data)
+	}
+}
+
+// importUploadPath is where an uploaded import is kept until it is applied
+func importUploadPath(token string, kind string) string {
+	return filepath.Join(os.TempDir(), "gowiki-import-"+token+importKinds[kind])
+}
+
+// runUploadedImport imports an uploaded file, or reports what importing it would do
+func runUploadedImport(db *DB, token string, kind string, opts ImportOptions) (*ImportReport, error) {
+	if kind == "files" {
+		files, err := zip.OpenReader(importUploadPath(token, kind))
+		if err != nil {
+			return nil, err
+		}
+		defer files.Close()
+
+		return ImportFiles(db, files, opts)
+	}
+
+	dump, err := os.Open(importUploadPath(token, kind))
+	if err != nil {
+		return nil, err
+	}
+	defer dump.Close()
+
+	return ImportMediaWiki(db, dump, opts)
+}
+
+// cleanImportUploads removes uploads that were never applied
+func cleanImportUploads() {
+	uploads, _ := filepath.Glob(filepath.Join(os.TempDir(), "gowiki-import-*"))
+	for _, upload := range uploads {
+		info, err := os.Stat(upload)
+		if err == nil && time.Since(info.ModTime()) > importUploadAge {
+			os.Remove(upload)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package models
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/unrolled/render"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// EditLock marks a document as being edited by someone.
+// Locks are soft: other editors are warned, not stopped, and a lock expires when the
+// editor page stops sending heartbeats.
+type EditLock struct {
+	ID         bson.ObjectId `json:"id" bson:"_id"`
+	HolderID   bson.ObjectId `json:"holderID" bson:"holderID"`
+	HolderName string        `json:"holderName" bson:"holderName"`
+	Started    time.Time     `json:"started" bson:"started"`
+	Heartbeat  time.Time     `json:"heartbeat" bson:"heartbeat"`
+}
+
+const lockCol = "editLocks"
+
+// lockTimeout is how long a lock lives without a heartbeat.
+// The editor page sends a heartbeat every 30 seconds.
+const lockTimeout = 2 * time.Minute
+
+// LockHeartbeatHandler keeps the user's lock on a document alive while the editor is open.
+// If the lock expired or was broken it is taken again when nobody else holds it.
+func LockHeartbeatHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			http.Error(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		d, err := loadPage(db, id)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		if !d.canEdit(db, user) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if r.FormValue("release") != "" {
+			err = releaseLock(db, d.ID, user.ID)
+			if err != nil {
+				ErrorLogger.Print("Could not release edit lock {id: "+id+", userID: "+user.ID.Hex()+"} ", err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		lock, err := takeLock(db, d.ID, user)
+		if err != nil {
+			ErrorLogger.Print("Could not refresh edit lock {id: "+id+", userID: "+user.ID.Hex()+"} ", err)
+			http.Error(w, "Could not refresh lock", http.StatusInternalServerError)
+			return
+		}
+
+		rend.JSON(w, http.StatusOK, map[string]interface{}{
+			"held":    lock.HolderID == user.ID,
+			"holder":  lock.HolderName,
+			"started": lock.Started,
+		})
+	}
+}
+
+// LockBreakHandler removes someone else's lock on a document
+func LockBreakHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		d, err := loadPage(db, id)
+		if err != nil {
+			ErrorLogger.Print("Document not found for breaking lock. id: "+id, err)
+			s.AddFlash("Looks like something went wrong. If this error persists, please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		if !d.canBreakLock(db, user) {
+			InfoLogger.Print("User tried to break an edit lock without permission: {userID: " + user.ID.Hex() + ", documentID: " + id + "}")
+			s.AddFlash("Sorry, but you don't have permission to break this lock", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		lock, err := findLock(db, d.ID)
+		if err != nil {
+			ErrorLogger.Print("Could not find edit lock {id: "+id+"} ", err)
+			s.AddFlash("Error! Could not break the lock. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		if lock == nil {
+			s.AddFlash("Nobody is editing this document anymore", "info")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		err = releaseLock(db, d.ID, lock.HolderID)
+		if err != nil {
+			ErrorLogger.Print("Could not break edit lock {id: "+id+"} ", err)
+			s.AddFlash("Error! Could not break the lock. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		InfoLogger.Print("Edit lock broken {id: " + id + ", holderID: " + lock.HolderID.Hex() + ", userID: " + user.ID.Hex() + "}")
+		s.AddFlash("The lock held by "+lock.HolderName+" was broken", "success")
+		s.Save(r, w)
+		http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+	}
+}
+
+// expired checks if the lock has gone without a heartbeat for too long
+func (l *EditLock) expired() bool {
+	return time.Since(l.Heartbeat) > lockTimeout
+}
+
+// canBreakLock checks if the user may remove another editor's lock.
+// Admins and the owner of the document may break locks.
+func (d *Document) canBreakLock(db *DB, user *User) bool {
+	if user.Admin {
+		return true
+	}
+
+	return d.ownerID() != "" && d.ownerID() == user.ID && d.visibleTo(db, user)
+}
+
+// findLock finds the active lock on a document. It returns nil if there is none.
+func findLock(db *DB, docID bson.ObjectId) (*EditLock, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(lockCol)
+
+	lock := &EditLock{}
+	err := collection.FindId(docID).One(lock)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if lock.expired() {
+		return nil, nil
+	}
+
+	return lock, nil
+}
+
+// takeLock locks the document for the user, or refreshes the user's lock.
+// If someone else holds an active lock, that lock is returned unchanged.
+// The lock is taken in a single update, so two editors opening the document at once can't both hold it.
+func takeLock(db *DB, docID bson.ObjectId, user *User) (*EditLock, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(lockCol)
+
+	// a lock held by someone else can expire between the attempts, so it is tried again once
+	for attempt := 0; attempt < 2; attempt++ {
+		now := time.Now()
+		lock := &EditLock{}
+
+		refresh := mgo.Change{
+			Update:    bson.M{"$set": bson.M{"holderName": user.Name, "heartbeat": now}},
+			ReturnNew: true,
+		}
+		_, err := collection.Find(bson.M{"_id": docID, "holderID": user.ID}).Apply(refresh, lock)
+		if err == nil {
+			return lock, nil
+		}
+		if err != mgo.ErrNotFound {
+			return nil, err
+		}
+
+		// an expired lock is taken over, and a missing one created. An active lock of someone else
+		// doesn't match, so the upsert fails on the document's id instead.
+		take := mgo.Change{
+			Update:    bson.M{"$set": bson.M{"holderID": user.ID, "holderName": user.Name, "started": now, "heartbeat": now}},
+			Upsert:    true,
+			ReturnNew: true,
+		}
+		_, err = collection.Find(bson.M{"_id": docID, "heartbeat": bson.M{"$lt": now.Add(-lockTimeout)}}).Apply(take, lock)
+		if err == nil {
+			return lock, nil
+		}
+		if !mgo.IsDup(err) {
+			return nil, err
+		}
+
+		lock, err = findLock(db, docID)
+		if err != nil || lock != nil {
+			return lock, err
+		}
+	}
+
+	return nil, errors.New("The lock kept changing while it was taken")
+}
+
+// releaseLock removes the lock on a document if it is held by the given user
+func releaseLock(db *DB, docID bson.ObjectId, holderID bson.ObjectId) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(lockCol)
+
+	err := collection.Remove(bson.M{"_id": docID, "holderID": holderID})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,154 @@
+package models
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Mail is a plain text email to a single recipient
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+	// Headers are extra headers, like List-Unsubscribe
+	Headers map[string]string
+}
+
+// Mailer delivers emails. Set the mailer used by the site with SetMailer.
+type Mailer interface {
+	Send(m *Mail) error
+}
+
+// FileMailer writes every email to a file in Dir instead of sending it, for development and testing
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+// SMTPMailer sends emails through an SMTP server
+type SMTPMailer struct {
+	Host     string
+	Username string
+	Password string
+	From     string
+}
+
+const defaultMailFrom = "SCMS <scms@localhost>"
+
+var mailer Mailer = &FileMailer{Dir: "mail", From: defaultMailFrom}
+
+// mailBaseURL is the address of the site, that links in emails start with
+var mailBaseURL = "http://localhost:8080"
+
+// MailInit sets up the mailer from the mail config
+func MailInit(conf MailConf) {
+	from := conf.From
+	if from == "" {
+		from = defaultMailFrom
+	}
+
+	if conf.Driver == "smtp" {
+		SetMailer(&SMTPMailer{Host: conf.Host, Username: conf.Username, Password: conf.Password, From: from})
+	} else {
+		dir := conf.Dir
+		if dir == "" {
+			dir = "mail"
+		}
+		SetMailer(&FileMailer{Dir: dir, From: from})
+	}
+
+	if conf.BaseURL != "" {
+		mailBaseURL = strings.TrimSuffix(conf.BaseURL, "/")
+	}
+}
+
+// SetMailer replaces the mailer emails are delivered with
+func SetMailer(m Mailer) {
+	mailer = m
+}
+
+// sendMail delivers an email in the background, so pages don't wait for the mail server
+func sendMail(m *Mail) {
+	go func() {
+		err := mailer.Send(m)
+		if err != nil {
+			ErrorLogger.Print("Could not send email {to: "+m.To+", subject: "+m.Subject+"} ", err)
+		}
+	}()
+}
+
+// Send writes the email to a new .eml file
+func (fm *FileMailer) Send(m *Mail) error {
+	err := os.MkdirAll(fm.Dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	name := time.Now().Format("20060102-150405") + "-" + bson.NewObjectId().Hex() + ".eml"
+	return ioutil.WriteFile(filepath.Join(fm.Dir, name), m.message(fm.From), 0600)
+}
+
+// Send sends the email through the SMTP server, logging in when a username is set
+func (sm *SMTPMailer) Send(m *Mail) error {
+	var auth smtp.Auth
+	if sm.Username != "" {
+		host, _, err := net.SplitHostPort(sm.Host)
+		if err != nil {
+			host = sm.Host
+		}
+		auth = smtp.PlainAuth("", sm.Username, sm.Password, host)
+	}
+
+	return smtp.SendMail(sm.Host, auth, mailAddress(sm.From), []string{m.To}, m.message(sm.From))
+}
+
+// message formats the email as a MIME message
+func (m *Mail) message(from string) []byte {
+	headers := map[string]string{
+		"From":                      from,
+		"To":                        m.To,
+		"Subject":                   mime.QEncoding.Encode("utf-8", m.Subject),
+		"Date":                      time.Now().Format(time.RFC1123Z),
+		"MIME-Version":              "1.0",
+		"Content-Type":              "text/plain; charset=utf-8",
+		"Content-Transfer-Encoding": "8bit",
+	}
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var msg bytes.Buffer
+	for _, k := range keys {
+		// header values can't break the message apart
+		msg.WriteString(k + ": " + strings.NewReplacer("\r", "", "\n", "").Replace(headers[k]) + "\r\n")
+	}
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.Replace(strings.Replace(m.Body, "\r\n", "\n", -1), "\n", "\r\n", -1))
+
+	return msg.Bytes()
+}
+
+// mailAddress returns the bare address of "Name <address>"
+func mailAddress(from string) string {
+	if i := strings.LastIndex(from, "<"); i >= 0 {
+		return strings.TrimSuffix(from[i+1:], ">")
+	}
+
+	return from
+}
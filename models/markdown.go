@@ -0,0 +1,200 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+)
+
+// markdownSpecial matches the characters that would be read as Markdown formatting in text
+var markdownSpecial = regexp.MustCompile("[\\\\`*_\\[\\]<>|~]")
+
+// markdownLineStart matches text at the start of a line that would be read as a block
+var markdownLineStart = regexp.MustCompile(`^(\s*)([#>+=-]|\d+[.)])`)
+
+// renderMarkdown renders a document Delta as Markdown. Formatting Markdown has no syntax for,
+// like colours and underlines, is dropped.
+func renderMarkdown(delta *Delta) string {
+	r := &markdownRenderer{}
+
+	for _, op := range delta.Ops {
+		text, ok := op.Insert.(string)
+		if !ok {
+			if embed, ok := op.Insert.(map[string]interface{}); ok {
+				r.line.WriteString(markdownInline(markdownEmbed(embed), op.Attributes, true))
+				r.raw.WriteString(" ")
+				r.pending = true
+			}
+			continue
+		}
+
+		lines := strings.Split(text, "\n")
+		for i, line := range lines {
+			if line != "" {
+				r.line.WriteString(markdownInline(line, op.Attributes, false))
+				r.raw.WriteString(line)
+				r.pending = true
+			}
+
+			if i < len(lines)-1 {
+				r.endLine(op.Attributes)
+			}
+		}
+	}
+
+	if r.pending {
+		r.endLine(nil)
+	}
+	r.closeCode()
+
+	return strings.TrimSpace(r.out.String()) + "\n"
+}
+
+// markdownRenderer collects the lines of a Delta into Markdown blocks
+type markdownRenderer struct {
+	out     strings.Builder
+	line    strings.Builder
+	raw     strings.Builder
+	pending bool
+	// kind is the kind of the last block, to keep list items and code lines together
+	kind string
+	code []string
+	// language is the language of the code being collected, written after the opening fence
+	language string
+}
+
+func (r *markdownRenderer) endLine(attributes map[string]interface{}) {
+	content := r.line.String()
+	raw := r.raw.String()
+	r.line.Reset()
+	r.raw.Reset()
+	r.pending = false
+
+	if language, ok := codeLanguage(attributes); ok {
+		if r.kind == "code" && r.language != language {
+			r.closeCode()
+		}
+		if r.kind != "code" {
+			r.separate("code")
+			r.language = language
+		}
+		// code is plain text, so the unformatted line is used
+		r.code = append(r.code, raw)
+		return
+	}
+	r.closeCode()
+
+	indent := 0
+	if n, ok := attributes["indent"].(float64); ok && n > 0 && n <= 8 {
+		indent = int(n)
+	}
+
+	if list, ok := attributes["list"].(string); ok {
+		r.separate("list")
+		marker := "- "
+		switch list {
+		case "ordered":
+			marker = "1. "
+		case "checked":
+			marker = "- [x] "
+		case "unchecked":
+			marker = "- [ ] "
+		}
+		r.out.WriteString(strings.Repeat("    ", indent) + marker + content + "\n")
+		return
+	}
+
+	if strings.TrimSpace(content) == "" {
+		// empty lines only separate blocks in Markdown
+		r.kind = ""
+		return
+	}
+
+	r.separate("")
+	if n, ok := attributes["header"].(float64); ok && n >= 1 && n <= 6 {
+		r.out.WriteString(strings.Repeat("#", int(n)) + " " + content + "\n")
+	} else if isTrue(attributes["blockquote"]) {
+		r.out.WriteString("> " + content + "\n")
+	} else {
+		r.out.WriteString(markdownLineStart.ReplaceAllString(content, `$1\$2`) + "\n")
+	}
+}
+
+// separate starts a new block, with a blank line unless it continues a list
+func (r *markdownRenderer) separate(kind string) {
+	if r.out.Len() > 0 && (kind == "" || kind != r.kind) {
+		r.out.WriteString("\n")
+	}
+	r.kind = kind
+}
+
+func (r *markdownRenderer) closeCode() {
+	if r.code == nil {
+		return
+	}
+
+	fence := "```"
+	for strings.Contains(strings.Join(r.code, "\n"), fence) {
+		fence += "`"
+	}
+	r.out.WriteString(fence + r.language + "\n" + strings.Join(r.code, "\n") + "\n" + fence + "\n")
+	r.code = nil
+	r.kind = ""
+	r.language = ""
+}
+
+// markdownInline escapes text and adds the Markdown for its inline formats.
+// Markdown from embeds is already formatted and isn't escaped again.
+func markdownInline(text string, attributes map[string]interface{}, embed bool) string {
+	if !embed {
+		if isTrue(attributes["code"]) {
+			fence := "`"
+			for strings.Contains(text, fence) {
+				fence += "`"
+			}
+			text = fence + text + fence
+		} else {
+			text = markdownSpecial.ReplaceAllString(text, `\$0`)
+		}
+	}
+
+	// emphasis can't start or end with a space, so the spaces are kept outside of it
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return text
+	}
+	before := text[:strings.Index(text, trimmed)]
+	after := text[len(before)+len(trimmed):]
+
+	if isTrue(attributes["strike"]) {
+		trimmed = "~~" + trimmed + "~~"
+	}
+	if isTrue(attributes["italic"]) {
+		trimmed = "_" + trimmed + "_"
+	}
+	if isTrue(attributes["bold"]) {
+		trimmed = "**" + trimmed + "**"
+	}
+	if link, ok := attributes["link"].(string); ok {
+		trimmed = "[" + trimmed + "](" + markdownURL(sanitizeURL(link, safeURL)) + ")"
+	}
+
+	return before + trimmed + after
+}
+
+// markdownEmbed returns the Markdown for an image or a link to a video
+func markdownEmbed(embed map[string]interface{}) string {
+	if src, ok := embed["image"].(string); ok {
+		return "![](" + markdownURL(sanitizeURL(src, safeImageURL)) + ")"
+	}
+	if src, ok := embed["video"].(string); ok {
+		src = markdownURL(sanitizeURL(src, safeURL))
+		return "[" + src + "](" + src + ")"
+	}
+
+	return ""
+}
+
+// markdownURL escapes the characters that would end a Markdown link
+func markdownURL(url string) string {
+	return strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29").Replace(url)
+}
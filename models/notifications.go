@@ -0,0 +1,587 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/unrolled/render"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Watch subscribes a user to the changes of a document or of the documents in a folder
+type Watch struct {
+	ID       bson.ObjectId `json:"id" bson:"_id"`
+	UserID   bson.ObjectId `json:"userID" bson:"userID"`
+	Kind     string        `json:"kind" bson:"kind"`
+	TargetID bson.ObjectId `json:"targetID" bson:"targetID"`
+	Created  time.Time     `json:"created"`
+}
+
+// Notification tells a user about a change to something they watch
+type Notification struct {
+	ID         bson.ObjectId `json:"id" bson:"_id"`
+	UserID     bson.ObjectId `json:"-" bson:"userID"`
+	Event      string        `json:"event"`
+	DocumentID bson.ObjectId `json:"-" bson:"documentID,omitempty"`
+	FolderID   bson.ObjectId `json:"-" bson:"folderID,omitempty"`
+	// Title is the title of the document or the name of the folder when it changed
+	Title     string        `json:"title"`
+	Detail    string        `json:"detail,omitempty" bson:"detail,omitempty"`
+	ActorID   bson.ObjectId `json:"-" bson:"actorID"`
+	ActorName string        `json:"actor" bson:"actorName"`
+	Created   time.Time     `json:"created"`
+	Read      bool          `json:"read" bson:"read"`
+}
+
+const watchCol = "watches"
+const notificationCol = "notifications"
+
+// the changes watchers are notified about
+const (
+	EventPublished = "published"
+	EventDraft     = "draft"
+	EventReview    = "review"
+	EventMoved     = "moved"
+	EventDeleted   = "deleted"
+	// EventDue reminds the owner of a document that it is due for a review, there is no actor
+	EventDue = "due"
+	// EventMention tells a user they were mentioned in a comment on a document
+	EventMention = "mention"
+)
+
+// eventMessages describe the events in notifications, with the name of the user and the title of what changed
+var eventMessages = map[string]string{
+	EventPublished: "%s published %s",
+	EventDraft:     "%s saved a draft of %s",
+	EventReview:    "%s sent %s for review",
+	EventMoved:     "%s moved %s",
+	EventDeleted:   "%s moved %s to the trash",
+	EventMention:   "%s mentioned you in %s",
+}
+
+// maxNotifications is the number of notifications the notification center lists
+const maxNotifications = 100
+
+// maxRecentNotifications is the number of notifications shown in the menu in the navigation
+const maxRecentNotifications = 8
+
+// WatchHandler starts or stops watching a document or folder
+func WatchHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		kind := vars["kind"]
+		id := vars["id"]
+		redir := "/" + kind + "/view/" + id
+
+		var name string
+		var target bson.ObjectId
+		switch kind {
+		case "document":
+			d, err := loadPage(db, id)
+			if err != nil || d.Deleted || !d.visibleTo(db, user) {
+				s.AddFlash("Sorry, but you can't watch that document", "warning")
+				s.Save(r, w)
+				http.Redirect(w, r, "/", http.StatusFound)
+				return
+			}
+			name, target = d.DisplayTitle(), d.ID
+		case "folder":
+			f, err := findFolder(db, id)
+			if err != nil || f.Deleted || !f.visibleTo(user) {
+				s.AddFlash("Sorry, but you can't watch that folder", "warning")
+				s.Save(r, w)
+				http.Redirect(w, r, "/folders/", http.StatusFound)
+				return
+			}
+			name, target = f.Name, f.ID
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		watching := r.FormValue("watch") == "1"
+		err := setWatch(db, user.ID, kind, target, watching)
+		if err != nil {
+			ErrorLogger.Print("Could not change watch {kind: "+kind+", id: "+id+", userID: "+user.ID.Hex()+"} ", err)
+			s.AddFlash("Error! Could not change what you watch. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, redir, http.StatusFound)
+			return
+		}
+
+		InfoLogger.Print("Watch changed {kind: " + kind + ", id: " + id + ", watching: " + strconv.FormatBool(watching) + ", userID: " + user.ID.Hex() + "}")
+		if watching {
+			s.AddFlash("You're watching \""+name+"\" and will be notified when it changes", "success")
+		} else {
+			s.AddFlash("You stopped watching \""+name+"\"", "success")
+		}
+		s.Save(r, w)
+		http.Redirect(w, r, redir, http.StatusFound)
+	}
+}
+
+// NotificationsHandler lists the user's notifications
+func NotificationsHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		notifications, err := findNotifications(db, user.ID, maxNotifications)
+		if err != nil {
+			ErrorLogger.Print("Could not find notifications {userID: "+user.ID.Hex()+"} ", err)
+			s.AddFlash("Looks like something went wrong. If this error persists, please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		watches, err := findWatchedItems(db, user)
+		if err != nil {
+			ErrorLogger.Print("Could not find watches {userID: "+user.ID.Hex()+"} ", err)
+			err = nil
+		}
+
+		// the session doesn't keep the digest settings
+		digest := ""
+		if u, err := findUser(db, user.ID.Hex()); err == nil {
+			digest = u.Digest
+		}
+
+		data := map[string]interface{}{
+			"user":          user,
+			"notifications": notifications,
+			"watches":       watches,
+			"digest":        digest,
+			"page":          "notifications",
+		}
+
+		RenderTemplate(rend, w, r, "notification/index", data)
+	}
+}
+
+// RecentNotificationsHandler returns the number of unread notifications and the latest ones,
+// for the menu in the navigation
+func RecentNotificationsHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			http.Error(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+
+		notifications, err := findNotifications(db, user.ID, maxRecentNotifications)
+		if err != nil {
+			ErrorLogger.Print("Could not find notifications {userID: "+user.ID.Hex()+"} ", err)
+			http.Error(w, "Could not find notifications", http.StatusInternalServerError)
+			return
+		}
+
+		unread, err := countUnreadNotifications(db, user.ID)
+		if err != nil {
+			ErrorLogger.Print("Could not count notifications {userID: "+user.ID.Hex()+"} ", err)
+			http.Error(w, "Could not find notifications", http.StatusInternalServerError)
+			return
+		}
+
+		type item struct {
+			Notification
+			Message string `json:"message"`
+			URL     string `json:"url"`
+		}
+		items := []item{}
+		for _, n := range notifications {
+			items = append(items, item{n, n.Message(), "/notifications/open/" + n.ID.Hex()})
+		}
+
+		rend.JSON(w, http.StatusOK, map[string]interface{}{
+			"unread":        unread,
+			"notifications": items,
+		})
+	}
+}
+
+// NotificationOpenHandler marks a notification as read and goes to what it is about
+func NotificationOpenHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		n, err := findNotification(db, id, user.ID)
+		if err != nil {
+			http.Redirect(w, r, "/notifications/", http.StatusFound)
+			return
+		}
+
+		err = markNotificationsRead(db, user.ID, n.ID)
+		if err != nil {
+			ErrorLogger.Print("Could not mark notification read {id: "+id+"} ", err)
+			err = nil
+		}
+
+		http.Redirect(w, r, n.URL(), http.StatusFound)
+	}
+}
+
+// NotificationsReadHandler marks all the user's notifications as read
+func NotificationsReadHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		err := markNotificationsRead(db, user.ID, "")
+		if err != nil {
+			ErrorLogger.Print("Could not mark notifications read {userID: "+user.ID.Hex()+"} ", err)
+			http.Error(w, "Could not mark notifications read", http.StatusInternalServerError)
+			return
+		}
+
+		// the menu marks them read in the background
+		if r.Header.Get("X-Requested-With") == "fetch" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		http.Redirect(w, r, "/notifications/", http.StatusFound)
+	}
+}
+
+// Message describes the notification, like `Anna published "Runbook"`
+func (n *Notification) Message() string {
+	title := strconv.Quote(n.Title)
+	if n.DocumentID == "" {
+		title = "the folder " + title
+	}
+
+	if n.Event == EventDue {
+		return title + " is due for a review" + n.Detail
+	}
+
+	return fmt.Sprintf(eventMessages[n.Event], n.ActorName, title) + n.Detail
+}
+
+// URL is the page the notification is about
+func (n *Notification) URL() string {
+	switch {
+	case n.DocumentID != "" && n.Event != EventDeleted:
+		return "/document/view/" + n.DocumentID.Hex()
+	case n.FolderID != "" && !(n.DocumentID == "" && n.Event == EventDeleted):
+		return "/folder/view/" + n.FolderID.Hex()
+	}
+
+	return "/"
+}
+
+// notifyDocument notifies the users watching a document, or its folder, about a change by actor.
+// Watchers are only told about what they may see now, and drafts only concern their editors and reviewers.
+// otherFolderIDs are folders whose watchers are notified as well, like the folder a document was moved out of.
+func notifyDocument(db *DB, d *Document, event string, actor *User, detail string, otherFolderIDs ...bson.ObjectId) {
+	targets := append([]bson.ObjectId{d.ID}, otherFolderIDs...)
+	if d.FolderID != "" {
+		targets = append(targets, d.FolderID)
+	}
+
+	notifyWatchers(db, targets, actor, &Notification{
+		Event:      event,
+		DocumentID: d.ID,
+		FolderID:   d.FolderID,
+		Title:      d.DisplayTitle(),
+		Detail:     detail,
+	}, func(u *User) bool {
+		if !d.visibleTo(db, u) {
+			return false
+		}
+		if event == EventDraft || event == EventReview {
+			return d.canEdit(db, u) || d.canReview(db, u)
+		}
+		return true
+	})
+}
+
+// notifyFolder notifies the users watching a folder, or a document in it, about a change to the folder by actor
+func notifyFolder(db *DB, f *Folder, event string, actor *User) {
+	targets := []bson.ObjectId{f.ID}
+	if err := f.findDocsForFolder(db); err == nil {
+		for _, d := range f.Documents {
+			targets = append(targets, d.ID)
+		}
+	}
+
+	notifyWatchers(db, targets, actor, &Notification{
+		Event:    event,
+		FolderID: f.ID,
+		Title:    f.Name,
+	}, f.visibleTo)
+}
+
+// notifyWatchers sends a copy of n to every user watching one of targets, except the actor,
+// that may see the change. Each watcher is notified once, in the app and by email.
+func notifyWatchers(db *DB, targets []bson.ObjectId, actor *User, n *Notification, allowed func(u *User) bool) {
+	userIDs, err := findWatcherIDs(db, targets)
+	if err != nil {
+		ErrorLogger.Print("Could not find watchers {targets: "+strconv.Itoa(len(targets))+"} ", err)
+		return
+	}
+
+	for _, userID := range userIDs {
+		if userID == actor.ID {
+			continue
+		}
+
+		u, err := findUser(db, userID.Hex())
+		if err != nil || u.Deleted || !allowed(u) {
+			continue
+		}
+
+		note := *n
+		note.ActorID = actor.ID
+		note.ActorName = actor.Name
+		notifyUser(db, u, &note)
+	}
+}
+
+// notifyUser notifies u of n in the app and by email
+func notifyUser(db *DB, u *User, n *Notification) {
+	n.ID = bson.NewObjectId()
+	n.UserID = u.ID
+	n.Created = time.Now()
+
+	err := n.save(db)
+	if err != nil {
+		ErrorLogger.Print("Could not save notification {userID: "+u.ID.Hex()+"} ", err)
+		return
+	}
+
+	if u.Email != "" {
+		sendMail(n.mail(u))
+	}
+}
+
+// mail is the email for a notification
+func (n *Notification) mail(u *User) *Mail {
+	reason := "You get this email because you watch this document or its folder. " +
+		"Open it and choose Unwatch to stop getting these emails.\n"
+	switch n.Event {
+	case EventDue:
+		reason = "You get this email because you own this document. " +
+			"Open it and choose Still Accurate if it is, or edit it if it isn't.\n"
+	case EventMention:
+		reason = "You get this email because you were mentioned in a comment on this document.\n"
+	}
+
+	body := "Hi " + u.Name + ",\n\n" +
+		n.Message() + ".\n\n" +
+		mailBaseURL + n.URL() + "\n\n" +
+		reason
+
+	return &Mail{
+		To:      u.Email,
+		Subject: n.Message(),
+		Body:    body,
+	}
+}
+
+func (n *Notification) save(db *DB) error {
+	session := db.sess.Clone()
+	defer session.Close()
+
+	collection := session.DB(db.name).C(notificationCol)
+	return collection.Insert(n)
+}
+
+// setWatch starts or stops the user watching the target
+func setWatch(db *DB, userID bson.ObjectId, kind string, targetID bson.ObjectId, watching bool) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(watchCol)
+
+	selector := bson.M{"userID": userID, "targetID": targetID}
+	if !watching {
+		_, err := collection.RemoveAll(selector)
+		return err
+	}
+
+	_, err := collection.Upsert(selector, bson.M{
+		"$setOnInsert": bson.M{"_id": bson.NewObjectId(), "kind": kind, "created": time.Now()},
+	})
+	return err
+}
+
+// isWatching checks if the user watches the target
+func isWatching(db *DB, userID bson.ObjectId, targetID bson.ObjectId) bool {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(watchCol)
+
+	count, err := collection.Find(bson.M{"userID": userID, "targetID": targetID}).Count()
+	return err == nil && count > 0
+}
+
+// findWatcherIDs finds the users watching any of the targets
+func findWatcherIDs(db *DB, targets []bson.ObjectId) ([]bson.ObjectId, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(watchCol)
+
+	var userIDs []bson.ObjectId
+	err := collection.Find(bson.M{"targetID": bson.M{"$in": targets}}).Distinct("userID", &userIDs)
+	return userIDs, err
+}
+
+// watchedItem is a document or folder the user watches
+type watchedItem struct {
+	Kind  string
+	Title string
+	URL   string
+}
+
+// findWatchedItems finds the documents and folders the user watches and can still see
+func findWatchedItems(db *DB, user *User) ([]watchedItem, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(watchCol)
+
+	var watches []Watch
+	err := collection.Find(bson.M{"userID": user.ID}).Sort("created").All(&watches)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []watchedItem{}
+	for _, watch := range watches {
+		switch watch.Kind {
+		case "document":
+			d, err := loadPage(db, watch.TargetID.Hex())
+			if err == nil && !d.Deleted && d.visibleTo(db, user) {
+				items = append(items, watchedItem{"document", d.DisplayTitle(), "/document/view/" + d.ID.Hex()})
+			}
+		case "folder":
+			f, err := findFolder(db, watch.TargetID.Hex())
+			if err == nil && !f.Deleted && f.visibleTo(user) {
+				items = append(items, watchedItem{"folder", f.Name, "/folder/view/" + f.ID.Hex()})
+			}
+		}
+	}
+
+	return items, nil
+}
+
+func findNotifications(db *DB, userID bson.ObjectId, limit int) ([]Notification, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(notificationCol)
+
+	var notifications []Notification
+	err := collection.Find(bson.M{"userID": userID}).Sort("-created").Limit(limit).All(&notifications)
+	return notifications, err
+}
+
+func findNotification(db *DB, idHex string, userID bson.ObjectId) (*Notification, error) {
+	if !bson.IsObjectIdHex(idHex) {
+		return nil, errors.New("Invalid notification id: " + idHex)
+	}
+
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(notificationCol)
+
+	n := &Notification{}
+	err := collection.Find(bson.M{"_id": bson.ObjectIdHex(idHex), "userID": userID}).One(n)
+	if err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+func countUnreadNotifications(db *DB, userID bson.ObjectId) (int, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(notificationCol)
+
+	return collection.Find(bson.M{"userID": userID, "read": false}).Count()
+}
+
+// markNotificationsRead marks one of the user's notifications as read, or all of them when id is empty
+func markNotificationsRead(db *DB, userID bson.ObjectId, id bson.ObjectId) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(notificationCol)
+
+	selector := bson.M{"userID": userID, "read": false}
+	if id != "" {
+		selector["_id"] = id
+	}
+
+	_, err := collection.UpdateAll(selector, bson.M{"$set": bson.M{"read": true}})
+	return err
+}
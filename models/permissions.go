@@ -112,3 +112,50 @@ func permissionSave(db *DB, ps []Permission) error {
 
 	return err
 }
+
+// findPermission finds the permissions a user has been given on a folder.
+func findPermission(db *DB, folderID bson.ObjectId, userID bson.ObjectId) (*Permission, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(permissionCol)
+	p := &Permission{}
+
+	err := collection.Find(bson.M{"folderId": folderID, "userId": userID}).One(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// hasPermission checks if a user may perform an action ("list", "read", "write", "create" or "delete") on a folder.
+// Admins may do anything. Nobody but admins may act on documents that aren't in a folder.
+func hasPermission(db *DB, user *User, folderID bson.ObjectId, action string) bool {
+	if user.Admin {
+		return true
+	}
+
+	if folderID == "" {
+		return false
+	}
+
+	p, err := findPermission(db, folderID, user.ID)
+	if err != nil {
+		return false
+	}
+
+	switch action {
+	case "list":
+		return p.List
+	case "read":
+		return p.Read
+	case "write":
+		return p.Write
+	case "create":
+		return p.Create
+	case "delete":
+		return p.Delete
+	}
+
+	return false
+}
@@ -10,6 +10,11 @@ import (
 
 // RenderTemplate renders the given template and handles flash messages
 func RenderTemplate(rend *render.Render, w http.ResponseWriter, r *http.Request, tmpl string, data map[string]interface{}) {
+	RenderTemplateStatus(rend, w, r, http.StatusFound, tmpl, data)
+}
+
+// RenderTemplateStatus renders the given template with a specific HTTP status and handles flash messages
+func RenderTemplateStatus(rend *render.Render, w http.ResponseWriter, r *http.Request, status int, tmpl string, data map[string]interface{}) {
 	// Get the user session from the context.
 	ctx := r.Context()
 	s, ok := ctx.Value(sessKey).(*sessions.Session)
@@ -39,7 +44,7 @@ func RenderTemplate(rend *render.Render, w http.ResponseWriter, r *http.Request,
 		data["page"] = tmpl
 	}
 
-	err := rend.HTML(w, http.StatusFound, tmpl, data)
+	err := rend.HTML(w, status, tmpl, data)
 	if err != nil {
 		ErrorLogger.Print("Error trying to render page: "+tmpl, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
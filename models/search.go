@@ -0,0 +1,518 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/sessions"
+	"github.com/unrolled/render"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// searchEntry is the search index of one document.
+// The words are only stored as keyed tokens, so the index can't be read without the document key,
+// and the text used for snippets is encrypted like the document itself.
+type searchEntry struct {
+	ID      bson.ObjectId `bson:"_id"`
+	Tokens  []string      `bson:"tokens"`
+	Text    []byte        `bson:"text"`
+	Updated time.Time     `bson:"updated"`
+}
+
+// SearchResult is a document matching a search, with a snippet of the matching text
+type SearchResult struct {
+	Document *Document
+	Title    string
+	Snippet  template.HTML
+	score    int
+}
+
+const searchCol = "searchIndex"
+
+// minPrefix is the shortest partial word that finds longer words
+const minPrefix = 3
+
+// maxWordLength is the longest part of a word that is indexed, in characters
+const maxWordLength = 30
+
+// maxSearchTerms limits the number of words in a search
+const maxSearchTerms = 10
+
+// maxSearchResults limits the number of documents shown for a search
+const maxSearchResults = 50
+
+// snippetLength is the number of characters shown around the first match
+const snippetLength = 200
+
+// searchKey is derived from the document key, so that search tokens can't be compared with other hashes.
+// It is set up on first use because the document key is only hashed in init.
+var searchKey []byte
+var searchKeyOnce sync.Once
+
+// SearchHandler shows the documents the user can see that contain every word of the q parameter
+func SearchHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		query := strings.TrimSpace(r.URL.Query().Get("q"))
+
+		var results []SearchResult
+		if query != "" {
+			var err error
+			results, err = search(db, user, query)
+			if err != nil {
+				ErrorLogger.Print("Could not search documents {userID: "+user.ID.Hex()+"} ", err)
+				s.AddFlash("Looks like something went wrong. If this error persists, please contact support", "danger")
+				s.Save(r, w)
+				http.Redirect(w, r, "/", http.StatusFound)
+				return
+			}
+			if len(results) > maxSearchResults {
+				results = results[:maxSearchResults]
+			}
+		}
+
+		data := map[string]interface{}{
+			"user":    user,
+			"query":   query,
+			"results": results,
+			"page":    "search",
+		}
+
+		RenderTemplate(rend, w, r, "search/index", data)
+	}
+}
+
+// searchWords splits text into lower case words
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsNumber(c)
+	})
+}
+
+// blindToken hashes a word with the search key. Full words and prefixes are hashed separately.
+func blindToken(kind string, word string) string {
+	searchKeyOnce.Do(func() {
+		mac := hmac.New(sha256.New, keyHash)
+		mac.Write([]byte("search index"))
+		searchKey = mac.Sum(nil)
+	})
+
+	mac := hmac.New(sha256.New, searchKey)
+	mac.Write([]byte(kind + ":" + word))
+	return hex.EncodeToString(mac.Sum(nil)[:12])
+}
+
+// indexTokens returns the tokens for every word in text and for every prefix long enough to search for
+func indexTokens(text string) []string {
+	seen := map[string]bool{}
+	var tokens []string
+	add := func(token string) {
+		if !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+
+	for _, word := range searchWords(text) {
+		runes := []rune(word)
+		if len(runes) > maxWordLength {
+			runes = runes[:maxWordLength]
+		}
+
+		add(blindToken("w", string(runes)))
+		for n := minPrefix; n <= len(runes); n++ {
+			add(blindToken("p", string(runes[:n])))
+		}
+	}
+
+	return tokens
+}
+
+// queryTerms returns the distinct words of a search, shortened the same way they are indexed
+func queryTerms(query string) []string {
+	seen := map[string]bool{}
+	var terms []string
+	for _, word := range searchWords(query) {
+		runes := []rune(word)
+		if len(runes) > maxWordLength {
+			runes = runes[:maxWordLength]
+		}
+		term := string(runes)
+
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+		if len(terms) == maxSearchTerms {
+			break
+		}
+	}
+
+	return terms
+}
+
+// queryToken matches documents with words starting with the term, or only the exact word when it is short
+func queryToken(term string) string {
+	if len([]rune(term)) < minPrefix {
+		return blindToken("w", term)
+	}
+
+	return blindToken("p", term)
+}
+
+// deltaText returns the plain text of a Delta, with embeds replaced by spaces
+func deltaText(delta *Delta) string {
+	var text strings.Builder
+	for _, op := range delta.Ops {
+		if s, ok := op.Insert.(string); ok {
+			text.WriteString(s)
+		} else {
+			text.WriteString(" ")
+		}
+	}
+
+	return text.String()
+}
+
+// searchesDraft checks if the document is found by its draft, because it was never published.
+// Only its editors and reviewers can see those documents.
+func (d *Document) searchesDraft() bool {
+	return d.Published.IsZero() && d.Status != "" && d.Draft != nil
+}
+
+// searchableContent returns the title and text that readers of the document see
+func (d *Document) searchableContent() (string, string, error) {
+	if d.searchesDraft() {
+		delta, err := d.workingDelta()
+		if err != nil {
+			return "", "", err
+		}
+
+		return d.Draft.Title, deltaText(delta), nil
+	}
+
+	delta, err := d.contentDelta()
+	if err != nil {
+		return "", "", err
+	}
+
+	return d.Title, deltaText(delta), nil
+}
+
+// updateSearchIndex indexes the current content of a document, replacing what was indexed before
+func updateSearchIndex(db *DB, d *Document) error {
+	if d.Deleted {
+		return removeFromSearchIndex(db, d.ID)
+	}
+
+	title, text, err := d.searchableContent()
+	if err != nil {
+		return err
+	}
+
+	ciphertext, err := encryptBytes([]byte(text))
+	if err != nil {
+		return err
+	}
+
+	entry := &searchEntry{
+		ID:      d.ID,
+		Tokens:  indexTokens(title + "\n" + text),
+		Text:    ciphertext,
+		Updated: time.Now(),
+	}
+
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(searchCol)
+
+	_, err = collection.UpsertId(d.ID, entry)
+	return err
+}
+
+// removeFromSearchIndex removes a document from the search index
+func removeFromSearchIndex(db *DB, id bson.ObjectId) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(searchCol)
+
+	err := collection.RemoveId(id)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// indexDocument updates the search index after a change, logging instead of failing
+// so that a broken index never stops a document from being saved
+func indexDocument(db *DB, d *Document) {
+	err := updateSearchIndex(db, d)
+	if err != nil {
+		ErrorLogger.Print("Could not update the search index of document {id: "+d.ID.Hex()+"} ", err)
+	}
+}
+
+// unindexDocument removes a document from the search index, logging any error
+func unindexDocument(db *DB, id bson.ObjectId) {
+	err := removeFromSearchIndex(db, id)
+	if err != nil {
+		ErrorLogger.Print("Could not remove document from the search index {id: "+id.Hex()+"} ", err)
+	}
+}
+
+// search finds all the documents the user can see that contain every word of the query, best matches first
+func search(db *DB, user *User, query string) ([]SearchResult, error) {
+	terms := queryTerms(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	tokens := make([]string, len(terms))
+	for i, term := range terms {
+		tokens[i] = queryToken(term)
+	}
+
+	session := db.sess.Clone()
+	defer session.Close()
+	appDB := session.DB(db.name)
+
+	var entries []searchEntry
+	err := appDB.C(searchCol).Find(bson.M{"tokens": bson.M{"$all": tokens}}).Select(bson.M{"tokens": 0}).All(&entries)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+
+	texts := map[bson.ObjectId][]byte{}
+	ids := make([]bson.ObjectId, len(entries))
+	for i, e := range entries {
+		ids[i] = e.ID
+		texts[e.ID] = e.Text
+	}
+
+	var docs []Document
+	err = appDB.C(documentCol).Find(bson.M{"_id": bson.M{"$in": ids}, "deleted": notDeleted}).
+		Select(bson.M{"body": 0, "delta": 0, "draft.body": 0, "draft.delta": 0}).All(&docs)
+	if err != nil {
+		return nil, err
+	}
+
+	// documents in a folder that was moved to the trash can't be opened either
+	inTrash, err := findTrashedFolderIDs(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []SearchResult
+	for i := range docs {
+		d := &docs[i]
+		if inTrash[d.FolderID] || user.Level < d.Level || !d.visibleTo(db, user) {
+			continue
+		}
+
+		plaintext, err := decryptBytes(texts[d.ID])
+		if err != nil {
+			ErrorLogger.Print("Could not decrypt search index of document {id: "+d.ID.Hex()+"} ", err)
+			continue
+		}
+
+		title := d.DisplayTitle()
+
+		result := SearchResult{
+			Document: d,
+			Title:    title,
+			score:    matchScore(title, string(plaintext), terms),
+		}
+		// tech users only ever see sample text, so they don't get to see the real content in snippets either
+		if !user.Tech {
+			result.Snippet = snippet(string(plaintext), terms)
+		}
+		results = append(results, result)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].Document.Edited.After(results[j].Document.Edited)
+	})
+
+	return results, nil
+}
+
+// findTrashedFolderIDs returns the IDs of the folders in the trash
+func findTrashedFolderIDs(db *DB) (map[bson.ObjectId]bool, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(col)
+
+	var trashed []Folder
+	err := collection.Find(bson.M{"deleted": true}).Select(bson.M{"_id": 1}).All(&trashed)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := map[bson.ObjectId]bool{}
+	for _, f := range trashed {
+		ids[f.ID] = true
+	}
+
+	return ids, nil
+}
+
+// matchScore counts how often the terms appear, with matches in the title counting more
+func matchScore(title string, text string, terms []string) int {
+	score := 0
+	for _, word := range searchWords(title) {
+		if matchesTerm(word, terms) {
+			score += 10
+		}
+	}
+	for _, word := range searchWords(text) {
+		if matchesTerm(word, terms) {
+			score++
+		}
+	}
+
+	return score
+}
+
+// matchesTerm checks if a word is found by any of the terms, the same way the index finds it
+func matchesTerm(word string, terms []string) bool {
+	for _, term := range terms {
+		if word == term || (len([]rune(term)) >= minPrefix && strings.HasPrefix(word, term)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// snippet cuts the text around the first matching word and highlights the matches
+func snippet(text string, terms []string) template.HTML {
+	runes := []rune(strings.Join(strings.Fields(text), " "))
+	lower := []rune(strings.ToLower(string(runes)))
+	if len(lower) != len(runes) {
+		// a few characters change length when lower cased, fall back to the original text
+		lower = runes
+	}
+
+	// find the words and whether each of them matches
+	type span struct {
+		start, end int
+		match      bool
+	}
+	var spans []span
+	first := -1
+	for i := 0; i < len(lower); {
+		if !unicode.IsLetter(lower[i]) && !unicode.IsNumber(lower[i]) {
+			i++
+			continue
+		}
+		start := i
+		for i < len(lower) && (unicode.IsLetter(lower[i]) || unicode.IsNumber(lower[i])) {
+			i++
+		}
+		match := matchesTerm(string(lower[start:i]), terms)
+		if match && first == -1 {
+			first = start
+		}
+		spans = append(spans, span{start, i, match})
+	}
+
+	if first == -1 {
+		first = 0
+	}
+
+	// start a little before the first match, at the beginning of a word
+	from := first - snippetLength/4
+	if from < 0 {
+		from = 0
+	}
+	for from > 0 && from < len(runes) && runes[from-1] != ' ' {
+		from++
+	}
+	to := minInt(from+snippetLength, len(runes))
+	for to < len(runes) && runes[to] != ' ' && to-from < snippetLength+maxWordLength {
+		to++
+	}
+
+	var out strings.Builder
+	if from > 0 {
+		out.WriteString("&hellip; ")
+	}
+	pos := from
+	for _, sp := range spans {
+		if !sp.match || sp.start < from || sp.end > to {
+			continue
+		}
+		out.WriteString(template.HTMLEscapeString(string(runes[pos:sp.start])))
+		out.WriteString("<mark>")
+		out.WriteString(template.HTMLEscapeString(string(runes[sp.start:sp.end])))
+		out.WriteString("</mark>")
+		pos = sp.end
+	}
+	out.WriteString(template.HTMLEscapeString(string(runes[pos:to])))
+	if to < len(runes) {
+		out.WriteString(" &hellip;")
+	}
+
+	return template.HTML(out.String())
+}
+
+// RebuildSearchIndex indexes every document again from scratch, and returns the number of documents indexed
+func RebuildSearchIndex(db *DB) (int, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	appDB := session.DB(db.name)
+
+	_, err := appDB.C(searchCol).RemoveAll(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	err = appDB.C(searchCol).EnsureIndexKey("tokens")
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	d := Document{}
+	iter := appDB.C(documentCol).Find(bson.M{"deleted": notDeleted}).Iter()
+	for iter.Next(&d) {
+		err = updateSearchIndex(db, &d)
+		if err != nil {
+			ErrorLogger.Print("Could not index document {id: "+d.ID.Hex()+"} ", err)
+		} else {
+			count++
+		}
+		d = Document{}
+	}
+
+	return count, iter.Close()
+}
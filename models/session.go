@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/sessions"
 	"github.com/urfave/negroni"
@@ -40,9 +41,18 @@ func SessionMiddleware(db *DB) negroni.HandlerFunc {
 			return
 		}
 
+		// users that were deleted since they logged in are logged out, their cookie can't be revoked any other way
+		if id, ok := s.Values["id"].(string); ok && isDeletedUser(db, id) {
+			InfoLogger.Print("Logged out deleted user {id: " + id + "}")
+			for key := range s.Values {
+				delete(s.Values, key)
+			}
+			s.Save(r, w)
+		}
+
 		if s.Values["id"] == nil {
 			// if we're already in the login page then don't redirect to the login page again.
-			if r.URL.Path != "/login" {
+			if r.URL.Path != "/login" && !isPublicPath(r.URL.Path) {
 				http.Redirect(w, r.WithContext(ctx), "/login", http.StatusFound)
 			}
 		}
@@ -52,6 +62,19 @@ func SessionMiddleware(db *DB) negroni.HandlerFunc {
 	})
 }
 
+// publicPaths are the paths that can be visited without logging in
+var publicPaths = []string{"/share/", "/digest/unsubscribe/"}
+
+func isPublicPath(path string) bool {
+	for _, prefix := range publicPaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // SessionDelete removes the current user session
 func SessionDelete(w http.ResponseWriter, r *http.Request) {
 	sess, _ := store.Get(r, "user")
@@ -0,0 +1,710 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/unrolled/render"
+
+	"golang.org/x/crypto/scrypt"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Share is a link that shows a single document to someone without an account
+type Share struct {
+	ID         bson.ObjectId `json:"id" bson:"_id"`
+	Token      string        `json:"-" bson:"token"`
+	DocumentID bson.ObjectId `json:"documentID" bson:"documentID"`
+	CreatedBy  bson.ObjectId `json:"createdBy" bson:"createdBy"`
+	Created    time.Time     `json:"created"`
+	Expires    time.Time     `json:"expires"`
+	Password   []byte        `json:"-" bson:"password,omitempty"`
+	Salt       []byte        `json:"-" bson:"salt,omitempty"`
+	// MaxViews is the number of times the link can be opened, 0 for no limit
+	MaxViews   int           `json:"maxViews" bson:"maxViews"`
+	Views      int           `json:"views" bson:"views"`
+	LastViewed time.Time     `json:"lastViewed" bson:"lastViewed,omitempty"`
+	Revoked    bool          `json:"revoked" bson:"revoked,omitempty"`
+	RevokedAt  time.Time     `json:"revokedAt" bson:"revokedAt,omitempty"`
+	RevokedBy  bson.ObjectId `json:"revokedBy" bson:"revokedBy,omitempty"`
+	// FailedAttempts counts wrong passwords since the last lockout, the password can't be tried again until LockedUntil
+	FailedAttempts int       `json:"-" bson:"failedAttempts,omitempty"`
+	LockedUntil    time.Time `json:"-" bson:"lockedUntil,omitempty"`
+	// CreatorName and URL are filled in for the list of shares
+	CreatorName string `json:"-" bson:"-"`
+	URL         string `json:"-" bson:"-"`
+}
+
+const shareCol = "shares"
+
+// shareExpiryDays are the lifetimes a share link can be given
+var shareExpiryDays = []int{1, 7, 30, 90}
+
+// shareMaxPasswordAttempts is the number of wrong passwords after which a link is locked for shareLockout
+const shareMaxPasswordAttempts = 5
+
+const shareLockout = 15 * time.Minute
+
+// shareImageGrant is how long after a page view its images can still be loaded
+const shareImageGrant = 10 * time.Minute
+
+// errShareUnavailable is returned for share links that are revoked, expired or used up
+var errShareUnavailable = errors.New("This link is no longer available.")
+
+// DocumentSharesHandler lists the active share links of a document, with a form to create another
+func DocumentSharesHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		d, err := loadPage(db, id)
+		if err != nil {
+			ErrorLogger.Print("Document not found for sharing. id: "+id, err)
+			s.AddFlash("Looks like something went wrong. If this error persists, please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		if !levelCheck(w, r, d) || !d.canShare(db, user) {
+			InfoLogger.Print("User tried to manage share links without permission: {userID: " + user.ID.Hex() + ", documentID: " + id + "}")
+			s.AddFlash("Sorry, but you don't have permission to share this document", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		shares, err := findActiveShares(db, d.ID)
+		if err != nil {
+			ErrorLogger.Print("Could not find share links {documentID: "+id+"} ", err)
+			s.AddFlash("Looks like something went wrong. If this error persists, please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+		for i := range shares {
+			shares[i].URL = shareURL(r, shares[i].Token)
+			creator, err := findUser(db, shares[i].CreatedBy.Hex())
+			if err == nil {
+				shares[i].CreatorName = creator.Name
+			}
+		}
+
+		data := map[string]interface{}{
+			"user":        user,
+			"document":    d,
+			"shares":      shares,
+			"expiryDays":  shareExpiryDays,
+			"isPublished": d.isPublished(),
+		}
+
+		RenderTemplate(rend, w, r, "document/shares", data)
+	}
+}
+
+// ShareCreateHandler creates a share link for a document
+func ShareCreateHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+		redir := "/document/shares/" + id
+
+		d, err := loadPage(db, id)
+		if err != nil {
+			ErrorLogger.Print("Document not found for sharing. id: "+id, err)
+			s.AddFlash("Looks like something went wrong. If this error persists, please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		if !levelCheck(w, r, d) || !d.canShare(db, user) {
+			InfoLogger.Print("User tried to create a share link without permission: {userID: " + user.ID.Hex() + ", documentID: " + id + "}")
+			s.AddFlash("Sorry, but you don't have permission to share this document", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		if !d.isPublished() {
+			s.AddFlash("Only published documents can be shared", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, redir, http.StatusFound)
+			return
+		}
+
+		days, _ := strconv.Atoi(r.FormValue("days"))
+		valid := false
+		for _, allowed := range shareExpiryDays {
+			valid = valid || days == allowed
+		}
+		maxViews, err := strconv.Atoi(r.FormValue("maxViews"))
+		if !valid || (r.FormValue("maxViews") != "" && (err != nil || maxViews < 0)) {
+			s.AddFlash("Choose how long the link lasts, and a view limit of 0 or more", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, redir, http.StatusFound)
+			return
+		}
+
+		sh, err := newShare(d.ID, user.ID, time.Duration(days)*24*time.Hour, r.FormValue("password"), maxViews)
+		if err == nil {
+			err = sh.save(db)
+		}
+		if err != nil {
+			ErrorLogger.Print("Could not create share link {documentID: "+id+", userID: "+user.ID.Hex()+"} ", err)
+			s.AddFlash("Error! Could not create the link. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, redir, http.StatusFound)
+			return
+		}
+
+		InfoLogger.Print("Share link created {id: " + sh.ID.Hex() + ", documentID: " + id + ", expires: " + sh.Expires.Format(time.RFC3339) + ", maxViews: " + strconv.Itoa(sh.MaxViews) + ", password: " + strconv.FormatBool(len(sh.Password) > 0) + ", userID: " + user.ID.Hex() + "}")
+		s.AddFlash("The link was created, copy it from the list below", "success")
+		s.Save(r, w)
+		http.Redirect(w, r, redir, http.StatusFound)
+	}
+}
+
+// ShareRevokeHandler stops a share link from working
+func ShareRevokeHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		sh, err := findShare(db, id)
+		if err != nil {
+			s.AddFlash("That link doesn't exist", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		redir := "/document/shares/" + sh.DocumentID.Hex()
+
+		d, err := loadPage(db, sh.DocumentID.Hex())
+		if err != nil || !levelCheck(w, r, d) || !d.canShare(db, user) {
+			InfoLogger.Print("User tried to revoke a share link without permission: {userID: " + user.ID.Hex() + ", shareID: " + id + "}")
+			s.AddFlash("Sorry, but you don't have permission to revoke this link", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		err = sh.revoke(db, user.ID)
+		if err != nil {
+			ErrorLogger.Print("Could not revoke share link {id: "+id+"} ", err)
+			s.AddFlash("Error! Could not revoke the link. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, redir, http.StatusFound)
+			return
+		}
+
+		InfoLogger.Print("Share link revoked {id: " + id + ", documentID: " + sh.DocumentID.Hex() + ", userID: " + user.ID.Hex() + "}")
+		s.AddFlash("The link was revoked", "success")
+		s.Save(r, w)
+		http.Redirect(w, r, redir, http.StatusFound)
+	}
+}
+
+// ShareViewHandler shows a shared document to anyone with the link, read-only and without the site navigation.
+// Links with a password ask for it first. Every view counts towards the link's view limit.
+func ShareViewHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the session from the context, visitors with a link don't have a user.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		vars := mux.Vars(r)
+		token := vars["token"]
+
+		sh, d, err := findUsableShare(db, token)
+		if err != nil {
+			InfoLogger.Print("Share link refused {token: " + tokenPrefix(token) + ", ip: " + r.RemoteAddr + ", reason: " + strconv.Quote(err.Error()) + "}")
+			renderShare(rend, w, http.StatusNotFound, "share/unavailable", map[string]interface{}{})
+			return
+		}
+
+		if len(sh.Password) > 0 && s.Values[shareSessionKey(sh)] != true {
+			status := http.StatusOK
+			data := map[string]interface{}{}
+			if r.Method == "POST" {
+				switch {
+				case time.Now().Before(sh.LockedUntil):
+					InfoLogger.Print("Share link password locked {id: " + sh.ID.Hex() + ", ip: " + r.RemoteAddr + "}")
+					status = http.StatusTooManyRequests
+				case !sh.checkPassword(r.FormValue("password")):
+					InfoLogger.Print("Share link wrong password {id: " + sh.ID.Hex() + ", documentID: " + sh.DocumentID.Hex() + ", ip: " + r.RemoteAddr + "}")
+					err = sh.failPassword(db)
+					if err != nil {
+						ErrorLogger.Print("Could not count wrong share link password {id: "+sh.ID.Hex()+"} ", err)
+					}
+					status = http.StatusForbidden
+					data["wrong"] = true
+				default:
+					err = sh.resetPasswordAttempts(db)
+					if err != nil {
+						ErrorLogger.Print("Could not reset share link password attempts {id: "+sh.ID.Hex()+"} ", err)
+					}
+					s.Values[shareSessionKey(sh)] = true
+					s.Save(r, w)
+					http.Redirect(w, r, "/share/"+token, http.StatusFound)
+					return
+				}
+			}
+
+			if time.Now().Before(sh.LockedUntil) {
+				status = http.StatusTooManyRequests
+				data["locked"] = true
+				data["wrong"] = false
+			}
+			renderShare(rend, w, status, "share/password", data)
+			return
+		}
+
+		if r.Method == "POST" {
+			http.Redirect(w, r, "/share/"+token, http.StatusFound)
+			return
+		}
+
+		err = sh.countView(db)
+		if err == mgo.ErrNotFound {
+			// the last allowed view was used up since the link was loaded
+			InfoLogger.Print("Share link refused {id: " + sh.ID.Hex() + ", ip: " + r.RemoteAddr + ", reason: \"view limit reached\"}")
+			renderShare(rend, w, http.StatusNotFound, "share/unavailable", map[string]interface{}{})
+			return
+		}
+		if err != nil {
+			ErrorLogger.Print("Could not count share link view {id: "+sh.ID.Hex()+"} ", err)
+			http.Error(w, "Could not load the document", http.StatusInternalServerError)
+			return
+		}
+
+		delta, err := d.contentDelta()
+		if err != nil {
+			ErrorLogger.Print("Could not decrypt shared document {id: "+d.ID.Hex()+", shareID: "+sh.ID.Hex()+"} ", err)
+			http.Error(w, "Could not load the document", http.StatusInternalServerError)
+			return
+		}
+
+		// the images of this page view can be loaded for a while, even if it used up the last view
+		s.Values[shareGrantKey(sh)] = time.Now().Add(shareImageGrant).Unix()
+		s.Save(r, w)
+
+		InfoLogger.Print("Share link viewed {id: " + sh.ID.Hex() + ", documentID: " + d.ID.Hex() + ", views: " + strconv.Itoa(sh.Views) + ", ip: " + r.RemoteAddr + ", userAgent: " + strconv.Quote(r.UserAgent()) + "}")
+
+		body, _ := anchorHeadings(renderDelta(shareImageSources(delta, token)))
+
+		// visitors have no code style of their own
+		var codeCSS template.CSS
+		if strings.Contains(string(body), "ql-syntax") {
+			body = highlightBody(body)
+			codeCSS = codeStyleCSS(defaultCodeStyle) + lineNumberCSS
+		}
+
+		data := map[string]interface{}{
+			"title":   d.Title,
+			"body":    body,
+			"codeCSS": codeCSS,
+			"edited":  d.Edited,
+			"expires": sh.Expires,
+		}
+
+		renderShare(rend, w, http.StatusOK, "share/view", data)
+	}
+}
+
+// ShareAttachmentHandler serves the images of a shared document to visitors of the share link,
+// for a short while after they viewed the page
+func ShareAttachmentHandler(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the session from the context, visitors with a link don't have a user.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		vars := mux.Vars(r)
+		token := vars["token"]
+		id := vars["id"]
+
+		sh, _, err := findUsableShare(db, token)
+		// the page view that used up the last allowed view still loads its images
+		if err == errShareUnavailable && !sh.Revoked && time.Now().Before(sh.Expires) {
+			err = nil
+		}
+		if err != nil || !hasShareGrant(s, sh) || (len(sh.Password) > 0 && s.Values[shareSessionKey(sh)] != true) {
+			InfoLogger.Print("Share link attachment refused {token: " + tokenPrefix(token) + ", attachmentID: " + id + ", ip: " + r.RemoteAddr + "}")
+			http.NotFound(w, r)
+			return
+		}
+
+		a, err := findAttachment(db, id)
+		if err != nil || a.DocumentID != sh.DocumentID {
+			http.NotFound(w, r)
+			return
+		}
+
+		data, err := decryptBytes(a.Data)
+		if err != nil {
+			ErrorLogger.Print("Could not decrypt attachment {id: "+id+"} ", err)
+			http.Error(w, "Could not decrypt attachment", http.StatusInternalServerError)
+			return
+		}
+
+		InfoLogger.Print("Share link attachment viewed {id: " + sh.ID.Hex() + ", attachmentID: " + id + ", ip: " + r.RemoteAddr + "}")
+		w.Header().Set("Content-Type", a.ContentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Cache-Control", "private, no-store")
+		w.Write(data)
+	}
+}
+
+// renderShare renders a page for visitors of a share link, in a layout without the site navigation
+func renderShare(rend *render.Render, w http.ResponseWriter, status int, tmpl string, data map[string]interface{}) {
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	err := rend.HTML(w, status, tmpl, data, render.HTMLOptions{Layout: "share/layout"})
+	if err != nil {
+		ErrorLogger.Print("Could not render share page "+tmpl+" ", err)
+	}
+}
+
+// canShare checks if the user may create and revoke share links for the document.
+// The author of the document and anyone who may edit it can share it.
+func (d *Document) canShare(db *DB, user *User) bool {
+	if user.Tech || !d.visibleTo(db, user) {
+		return false
+	}
+
+	return user.Admin || d.AuthorID == user.ID || d.canEdit(db, user)
+}
+
+// newShare creates a share link with a random token, the password is hashed before it is stored
+func newShare(docID bson.ObjectId, userID bson.ObjectId, lifetime time.Duration, password string, maxViews int) (*Share, error) {
+	raw := make([]byte, 24)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	sh := &Share{
+		ID:         bson.NewObjectId(),
+		Token:      base64.RawURLEncoding.EncodeToString(raw),
+		DocumentID: docID,
+		CreatedBy:  userID,
+		Created:    time.Now(),
+		Expires:    time.Now().Add(lifetime),
+		MaxViews:   maxViews,
+	}
+
+	if password != "" {
+		sh.Salt = make([]byte, 16)
+		_, err = rand.Read(sh.Salt)
+		if err != nil {
+			return nil, err
+		}
+		sh.Password, err = hashSharePassword(password, sh.Salt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sh, nil
+}
+
+func hashSharePassword(password string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(password), salt, 16384, 8, 1, 32)
+}
+
+func (sh *Share) checkPassword(password string) bool {
+	hash, err := hashSharePassword(password, sh.Salt)
+	return err == nil && subtle.ConstantTimeCompare(hash, sh.Password) == 1
+}
+
+// usable checks that the link isn't revoked, expired or used up
+func (sh *Share) usable() bool {
+	return !sh.Revoked && time.Now().Before(sh.Expires) && (sh.MaxViews == 0 || sh.Views < sh.MaxViews)
+}
+
+// ViewsLeft is the number of views the link has left, or -1 if there is no limit
+func (sh *Share) ViewsLeft() int {
+	if sh.MaxViews == 0 {
+		return -1
+	}
+
+	return sh.MaxViews - sh.Views
+}
+
+// HasPassword reports if the link asks for a password
+func (sh *Share) HasPassword() bool {
+	return len(sh.Password) > 0
+}
+
+func (sh *Share) save(db *DB) error {
+	session := db.sess.Clone()
+	defer session.Close()
+
+	collection := session.DB(db.name).C(shareCol)
+	_, err := collection.UpsertId(sh.ID, sh)
+	return err
+}
+
+// countView counts a view of the link, failing with mgo.ErrNotFound if it can't be viewed anymore
+func (sh *Share) countView(db *DB) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(shareCol)
+
+	query := bson.M{
+		"_id":     sh.ID,
+		"revoked": bson.M{"$ne": true},
+		"expires": bson.M{"$gt": time.Now()},
+	}
+	if sh.MaxViews > 0 {
+		query["views"] = bson.M{"$lt": sh.MaxViews}
+	}
+	change := mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"views": 1}, "$set": bson.M{"lastViewed": time.Now()}},
+		ReturnNew: true,
+	}
+
+	_, err := collection.Find(query).Apply(change, sh)
+	return err
+}
+
+// failPassword counts a wrong password, and locks the link once too many were tried
+func (sh *Share) failPassword(db *DB) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(shareCol)
+
+	change := mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"failedAttempts": 1}},
+		ReturnNew: true,
+	}
+	_, err := collection.FindId(sh.ID).Apply(change, sh)
+	if err != nil || sh.FailedAttempts < shareMaxPasswordAttempts {
+		return err
+	}
+
+	sh.FailedAttempts = 0
+	sh.LockedUntil = time.Now().Add(shareLockout)
+	return collection.UpdateId(sh.ID, bson.M{"$set": bson.M{"failedAttempts": 0, "lockedUntil": sh.LockedUntil}})
+}
+
+func (sh *Share) resetPasswordAttempts(db *DB) error {
+	if sh.FailedAttempts == 0 {
+		return nil
+	}
+
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(shareCol)
+
+	return collection.UpdateId(sh.ID, bson.M{"$set": bson.M{"failedAttempts": 0}})
+}
+
+func (sh *Share) revoke(db *DB, userID bson.ObjectId) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(shareCol)
+
+	return collection.UpdateId(sh.ID, bson.M{"$set": bson.M{"revoked": true, "revokedAt": time.Now(), "revokedBy": userID}})
+}
+
+func findShare(db *DB, idHex string) (*Share, error) {
+	if !bson.IsObjectIdHex(idHex) {
+		return nil, errors.New("Invalid share id: " + idHex)
+	}
+
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(shareCol)
+
+	sh := &Share{}
+	err := collection.FindId(bson.ObjectIdHex(idHex)).One(sh)
+	if err != nil {
+		return nil, err
+	}
+
+	return sh, nil
+}
+
+// findUsableShare finds the link with the token and its document. Documents that were deleted,
+// are in the trash or were never published can't be viewed through a link. It fails with errShareUnavailable,
+// and still returns the link and its document, if only the link can't be used anymore.
+func findUsableShare(db *DB, token string) (*Share, *Document, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(shareCol)
+
+	sh := &Share{}
+	err := collection.Find(bson.M{"token": token}).One(sh)
+	if err != nil {
+		return nil, nil, errors.New("Unknown token")
+	}
+
+	d, err := loadPage(db, sh.DocumentID.Hex())
+	if err != nil || d.Deleted || !d.isPublished() {
+		return sh, nil, errors.New("Document unavailable")
+	}
+
+	if d.FolderID != "" {
+		f, err := findFolder(db, d.FolderID.Hex())
+		if err != nil || f.Deleted {
+			return sh, nil, errors.New("Document unavailable")
+		}
+	}
+
+	if !sh.usable() {
+		return sh, d, errShareUnavailable
+	}
+
+	return sh, d, nil
+}
+
+// findActiveShares finds the links of a document that can still be used, newest first
+func findActiveShares(db *DB, docID bson.ObjectId) ([]Share, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(shareCol)
+
+	var shares []Share
+	query := bson.M{
+		"documentID": docID,
+		"revoked":    bson.M{"$ne": true},
+		"expires":    bson.M{"$gt": time.Now()},
+	}
+	err := collection.Find(query).Sort("-created").All(&shares)
+	if err != nil {
+		return nil, err
+	}
+
+	active := shares[:0]
+	for _, sh := range shares {
+		if sh.usable() {
+			active = append(active, sh)
+		}
+	}
+
+	return active, nil
+}
+
+// shareImageSources points the attachment images of a shared document at the share link
+func shareImageSources(delta *Delta, token string) *Delta {
+	shared := &Delta{Ops: make([]DeltaOp, len(delta.Ops))}
+	copy(shared.Ops, delta.Ops)
+
+	for i, op := range shared.Ops {
+		embed, ok := op.Insert.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		src, _ := embed["image"].(string)
+		if m := attachmentRef.FindStringSubmatch(src); m != nil {
+			shared.Ops[i].Insert = map[string]interface{}{"image": "/share/" + token + "/attachment/" + m[1]}
+		}
+	}
+
+	return shared
+}
+
+// shareURL is the full address of a share link, to send to people outside the site
+func shareURL(r *http.Request, token string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+
+	return scheme + "://" + r.Host + "/share/" + token
+}
+
+// shareSessionKey is the session value set once the visitor gave the link's password
+func shareSessionKey(sh *Share) string {
+	return "share-" + sh.ID.Hex()
+}
+
+// shareGrantKey is the session value that lets the visitor load the images of the page they viewed, until it expires
+func shareGrantKey(sh *Share) string {
+	return "share-" + sh.ID.Hex() + "-images"
+}
+
+func hasShareGrant(s *sessions.Session, sh *Share) bool {
+	expires, ok := s.Values[shareGrantKey(sh)].(int64)
+	return ok && time.Now().Unix() < expires
+}
+
+// tokenPrefix shortens a token for the logs, so the logs can't be used to open links
+func tokenPrefix(token string) string {
+	if len(token) > 6 {
+		return token[:6] + "..."
+	}
+
+	return strings.Repeat("*", len(token))
+}
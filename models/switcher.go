@@ -0,0 +1,258 @@
+package models
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/gorilla/sessions"
+	"github.com/unrolled/render"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// SwitchItem is a document or folder offered by the quick switcher
+type SwitchItem struct {
+	Kind      string `json:"kind"`
+	Title     string `json:"title"`
+	URL       string `json:"url"`
+	Folder    string `json:"folder,omitempty"`
+	Positions []int  `json:"positions"`
+	Recent    bool   `json:"recent"`
+	score     int
+}
+
+// maxSwitchItems is the number of suggestions the quick switcher shows
+const maxSwitchItems = 10
+
+// recentBoost is added to the score of the most recently viewed document, and less for older ones
+const recentBoost = 40
+
+// QuickSwitchHandler returns the documents and folders whose titles fuzzy match the q parameter.
+// Without a query it returns the documents the user viewed last.
+func QuickSwitchHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			http.Error(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+
+		items, err := findSwitchItems(db, user, r.URL.Query().Get("q"))
+		if err != nil {
+			ErrorLogger.Print("Could not find quick switcher items {userID: "+user.ID.Hex()+"} ", err)
+			http.Error(w, "Could not find documents", http.StatusInternalServerError)
+			return
+		}
+
+		rend.JSON(w, http.StatusOK, items)
+	}
+}
+
+// findSwitchItems finds the best matches for query among the documents and folders the user can see
+func findSwitchItems(db *DB, user *User, query string) ([]SwitchItem, error) {
+	query = strings.TrimSpace(query)
+
+	folders, err := findFoldersAndDocuments(db, user)
+	if err != nil {
+		return nil, err
+	}
+	folderNames := map[bson.ObjectId]string{}
+	for _, f := range *folders {
+		folderNames[f.ID] = f.Name
+	}
+
+	docs, err := findVisibleDocs(db, user, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	views, err := findRecentViews(db, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	boost := map[bson.ObjectId]int{}
+	for i, v := range views {
+		boost[v.DocumentID] = recentBoost * (len(views) - i) / len(views)
+	}
+
+	inTrash, err := findTrashedFolderIDs(db)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []SwitchItem{}
+	for i := range docs {
+		d := &docs[i]
+		if inTrash[d.FolderID] {
+			continue
+		}
+
+		title := d.DisplayTitle()
+
+		_, recent := boost[d.ID]
+		if query == "" && !recent {
+			continue
+		}
+
+		score, positions := fuzzyMatch(query, title)
+		if score < 0 {
+			continue
+		}
+
+		items = append(items, SwitchItem{
+			Kind:      "document",
+			Title:     title,
+			URL:       "/document/view/" + d.ID.Hex(),
+			Folder:    folderNames[d.FolderID],
+			Positions: positions,
+			Recent:    recent,
+			score:     score + boost[d.ID],
+		})
+	}
+
+	if query != "" {
+		for _, f := range *folders {
+			score, positions := fuzzyMatch(query, f.Name)
+			if score < 0 {
+				continue
+			}
+
+			items = append(items, SwitchItem{
+				Kind:      "folder",
+				Title:     f.Name,
+				URL:       "/folder/view/" + f.ID.Hex(),
+				Positions: positions,
+				score:     score,
+			})
+		}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].score != items[j].score {
+			return items[i].score > items[j].score
+		}
+		return len(items[i].Title) < len(items[j].Title)
+	})
+
+	if len(items) > maxSwitchItems {
+		items = items[:maxSwitchItems]
+	}
+
+	return items, nil
+}
+
+// fuzzyMatch checks that the characters of query appear in title in order, ignoring case.
+// Matches at the start of words and runs of consecutive characters score higher, gaps score lower,
+// and the best scoring way of matching is used. It returns -1 if title doesn't match,
+// and the positions of the matched characters in title otherwise.
+func fuzzyMatch(query string, title string) (int, []int) {
+	q := []rune(strings.ToLower(strings.Join(strings.Fields(query), "")))
+	t := []rune(title)
+	if len(q) == 0 {
+		return 0, []int{}
+	}
+	if len(q) > len(t) {
+		return -1, nil
+	}
+
+	const none = -1 << 30
+	// score[i][j] is the best score for matching q[:i+1] with q[i] at t[j], from[i][j] where q[i-1] was
+	score := make([][]int, len(q))
+	from := make([][]int, len(q))
+	for i := range q {
+		score[i] = make([]int, len(t))
+		from[i] = make([]int, len(t))
+		// the best score of the previous row up to j-6, where the gap penalty stops growing
+		farBest, farFrom := none, -1
+		for j := range t {
+			score[i][j] = none
+			if i > 0 && j >= 6 && score[i-1][j-6] > farBest {
+				farBest, farFrom = score[i-1][j-6], j-6
+			}
+			if unicode.ToLower(t[j]) != q[i] {
+				continue
+			}
+
+			best, bestFrom := 0, -1
+			if i > 0 {
+				best, bestFrom = none, -1
+				if farBest != none {
+					best, bestFrom = farBest-5, farFrom
+				}
+				for k := maxInt(j-5, 0); k < j; k++ {
+					if score[i-1][k] == none {
+						continue
+					}
+					s := score[i-1][k] - (j - k - 1)
+					if k == j-1 {
+						s = score[i-1][k] + 5
+					}
+					if s > best {
+						best, bestFrom = s, k
+					}
+				}
+				if best == none {
+					continue
+				}
+			}
+
+			score[i][j] = best + 1 + wordStartBonus(t, j)
+			from[i][j] = bestFrom
+		}
+	}
+
+	last := len(q) - 1
+	end := -1
+	for j := range t {
+		if score[last][j] != none && (end == -1 || score[last][j] > score[last][end]) {
+			end = j
+		}
+	}
+	if end == -1 {
+		return -1, nil
+	}
+
+	positions := make([]int, len(q))
+	for i, j := last, end; i >= 0; i-- {
+		positions[i] = j
+		j = from[i][j]
+	}
+
+	// don't let long gaps push a match below zero, it still matched
+	return maxInt(score[last][end], 0), positions
+}
+
+// wordStartBonus scores a match at the start of a title, a word or a camel case hump
+func wordStartBonus(t []rune, j int) int {
+	switch {
+	case j == 0:
+		return 15
+	case !unicode.IsLetter(t[j-1]) && !unicode.IsNumber(t[j-1]):
+		return 10
+	case unicode.IsUpper(t[j]) && unicode.IsLower(t[j-1]):
+		return 8
+	}
+
+	return 0
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
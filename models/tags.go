@@ -0,0 +1,332 @@
+package models
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/unrolled/render"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TagCount is a tag with the number of documents the user can see that have it
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// maxTagLength is the longest a tag can be, in characters
+const maxTagLength = 40
+
+// tagChars matches the characters that aren't allowed in tags
+var tagChars = regexp.MustCompile(`[^\pL\pN_-]+`)
+
+// TagsHandler lists every tag used on documents the user can see
+func TagsHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		tags, err := findTags(db, user)
+		if err != nil {
+			ErrorLogger.Print("Could not find tags {userID: "+user.ID.Hex()+"} ", err)
+			s.AddFlash("Looks like something went wrong. If this error persists, please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		data := map[string]interface{}{
+			"user": user,
+			"tags": tags,
+			"page": "tags",
+		}
+
+		RenderTemplate(rend, w, r, "tag/index", data)
+	}
+}
+
+// TagHandler lists the documents with a tag that the user can see
+func TagHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		tag := normalizeTag(vars["tag"])
+
+		docs, err := findVisibleDocs(db, user, bson.M{"tags": tag})
+		if err != nil {
+			ErrorLogger.Print("Could not find documents for tag {tag: "+tag+", userID: "+user.ID.Hex()+"} ", err)
+			s.AddFlash("Looks like something went wrong. If this error persists, please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/tags/", http.StatusFound)
+			return
+		}
+
+		data := map[string]interface{}{
+			"user":      user,
+			"tag":       tag,
+			"documents": docs,
+			"page":      "tags",
+		}
+
+		RenderTemplate(rend, w, r, "tag/view", data)
+	}
+}
+
+// TagSuggestHandler returns the tags starting with the q parameter, most used first, for the tag input
+func TagSuggestHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			http.Error(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+
+		tags, err := findTags(db, user)
+		if err != nil {
+			ErrorLogger.Print("Could not find tags {userID: "+user.ID.Hex()+"} ", err)
+			http.Error(w, "Could not find tags", http.StatusInternalServerError)
+			return
+		}
+
+		sort.SliceStable(tags, func(i, j int) bool {
+			return tags[i].Count > tags[j].Count
+		})
+
+		prefix := normalizeTag(r.URL.Query().Get("q"))
+		suggestions := []string{}
+		for _, t := range tags {
+			if strings.HasPrefix(t.Tag, prefix) {
+				suggestions = append(suggestions, t.Tag)
+			}
+			if len(suggestions) == 10 {
+				break
+			}
+		}
+
+		rend.JSON(w, http.StatusOK, suggestions)
+	}
+}
+
+// TagRenameHandler renames a tag on every document. Renaming to an existing tag merges the two.
+func TagRenameHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		from := normalizeTag(vars["tag"])
+		to := normalizeTag(r.FormValue("to"))
+
+		if !user.Admin {
+			InfoLogger.Print("User tried to rename a tag without permission: {userID: " + user.ID.Hex() + ", tag: " + from + "}")
+			s.AddFlash("Sorry, but only admins can rename tags", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, tagURL(from), http.StatusFound)
+			return
+		}
+
+		if to == "" || to == from {
+			s.AddFlash("Please enter a new name for the tag", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, tagURL(from), http.StatusFound)
+			return
+		}
+
+		changed, err := renameTag(db, from, to)
+		if err != nil {
+			ErrorLogger.Print("Could not rename tag {from: "+from+", to: "+to+"} ", err)
+			s.AddFlash("Error! Could not rename the tag. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, tagURL(from), http.StatusFound)
+			return
+		}
+
+		InfoLogger.Print("Tag renamed {from: " + from + ", to: " + to + ", userID: " + user.ID.Hex() + "}")
+		s.AddFlash("The tag "+from+" was renamed to "+to+" on "+pluralize(changed, "document"), "success")
+		s.Save(r, w)
+		http.Redirect(w, r, tagURL(to), http.StatusFound)
+	}
+}
+
+// normalizeTag turns user input into a tag: lower case, with dashes instead of spaces
+func normalizeTag(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	tag = strings.Trim(tagChars.ReplaceAllString(tag, "-"), "-")
+	if runes := []rune(tag); len(runes) > maxTagLength {
+		tag = strings.TrimRight(string(runes[:maxTagLength]), "-")
+	}
+
+	return tag
+}
+
+// parseTags reads a comma separated list of tags, dropping empty ones and duplicates
+func parseTags(input string) []string {
+	var tags []string
+	seen := map[string]bool{}
+	for _, t := range strings.Split(input, ",") {
+		t = normalizeTag(t)
+		if t != "" && !seen[t] {
+			seen[t] = true
+			tags = append(tags, t)
+		}
+	}
+
+	sort.Strings(tags)
+	return tags
+}
+
+func tagURL(tag string) string {
+	return "/tags/" + url.PathEscape(tag)
+}
+
+func pluralize(n int, word string) string {
+	if n == 1 {
+		return "1 " + word
+	}
+
+	return strconv.Itoa(n) + " " + word + "s"
+}
+
+// findVisibleDocs finds the documents matching query that the user can see, sorted by title.
+// Templates are left out and the content isn't loaded.
+func findVisibleDocs(db *DB, user *User, query bson.M) ([]Document, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(documentCol)
+
+	query["deleted"] = notDeleted
+	query["template"] = bson.M{"$ne": true}
+
+	var all []Document
+	err := collection.Find(query).Select(bson.M{"body": 0, "delta": 0, "draft.body": 0, "draft.delta": 0}).Sort("title").All(&all)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []Document
+	for i := range all {
+		if all[i].visibleTo(db, user) {
+			docs = append(docs, all[i])
+		}
+	}
+
+	return docs, nil
+}
+
+// findTags counts the tags on the documents the user can see, sorted by tag
+func findTags(db *DB, user *User) ([]TagCount, error) {
+	docs, err := findVisibleDocs(db, user, bson.M{"tags.0": bson.M{"$exists": true}})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int{}
+	for _, d := range docs {
+		for _, t := range d.Tags {
+			counts[t]++
+		}
+	}
+
+	tags := make([]TagCount, 0, len(counts))
+	for t, n := range counts {
+		tags = append(tags, TagCount{Tag: t, Count: n})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Tag < tags[j].Tag
+	})
+
+	return tags, nil
+}
+
+// renameTag replaces a tag with another on every document and draft, including documents in the trash.
+// Documents that already have both keep a single copy. It returns the number of documents changed.
+func renameTag(db *DB, from string, to string) (int, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(documentCol)
+
+	changed, err := renameTagIn(collection, "tags", from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = renameTagIn(collection, "draft.tags", from, to)
+	return changed, err
+}
+
+// renameTagIn renames the tag in the tags field of every document, keeping the tags sorted
+func renameTagIn(collection *mgo.Collection, field string, from string, to string) (int, error) {
+	_, err := collection.UpdateAll(bson.M{field: from}, bson.M{"$addToSet": bson.M{field: to}})
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := collection.UpdateAll(bson.M{field: from}, bson.M{"$pull": bson.M{field: from}})
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = collection.UpdateAll(bson.M{field: to}, bson.M{"$push": bson.M{field: bson.M{"$each": []string{}, "$sort": 1}}})
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Updated, nil
+}
@@ -0,0 +1,173 @@
+package models
+
+import (
+	"html/template"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Placeholders that are substituted when a new document is created from a template
+const (
+	placeholderDate   = "{date}"
+	placeholderTime   = "{time}"
+	placeholderAuthor = "{author}"
+	placeholderFolder = "{folder}"
+)
+
+// defaultTemplates are the templates created by SeedTemplates
+var defaultTemplates = []struct {
+	title string
+	body  string
+}{
+	{
+		"Meeting Notes",
+		"<h1>Meeting Notes - {date}</h1>" +
+			"<p><strong>Folder:</strong> {folder}</p>" +
+			"<p><strong>Note taker:</strong> {author}</p>" +
+			"<h2>Attendees</h2><ul><li><br></li></ul>" +
+			"<h2>Agenda</h2><ol><li><br></li></ol>" +
+			"<h2>Decisions</h2><ul><li><br></li></ul>" +
+			"<h2>Action Items</h2><ul><li>Who - What - When</li></ul>",
+	},
+	{
+		"Runbook",
+		"<h1>Runbook: Service Name</h1>" +
+			"<p><strong>Owner:</strong> {author}</p>" +
+			"<p><strong>Last reviewed:</strong> {date}</p>" +
+			"<h2>Overview</h2><p>What the service does and who depends on it.</p>" +
+			"<h2>Dependencies</h2><ul><li><br></li></ul>" +
+			"<h2>Monitoring and Alerts</h2><ul><li><br></li></ul>" +
+			"<h2>Common Procedures</h2><ol><li><br></li></ol>" +
+			"<h2>Escalation</h2><p><br></p>",
+	},
+	{
+		"Incident Report",
+		"<h1>Incident Report - {date}</h1>" +
+			"<p><strong>Reported by:</strong> {author}</p>" +
+			"<p><strong>Reported at:</strong> {date} {time}</p>" +
+			"<p><strong>Severity:</strong> </p>" +
+			"<h2>Summary</h2><p><br></p>" +
+			"<h2>Timeline</h2><ul><li>{time} - Incident reported</li></ul>" +
+			"<h2>Impact</h2><p><br></p>" +
+			"<h2>Root Cause</h2><p><br></p>" +
+			"<h2>Follow-up Actions</h2><ul><li><br></li></ul>",
+	},
+}
+
+// findTemplates finds the templates the user is allowed to use
+func findTemplates(db *DB, user *User) (*[]Document, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(documentCol)
+
+	query := bson.M{
+		"template": true,
+		"deleted":  notDeleted,
+		"$or": []bson.M{
+			bson.M{"level": bson.M{"$lte": user.Level}},
+			bson.M{"userIDs": user.ID},
+		},
+	}
+
+	var found []Document
+	err := collection.Find(query).Select(bson.M{"body": 0, "draft.body": 0}).Sort("title").All(&found)
+	if err != nil {
+		return nil, err
+	}
+
+	// templates that were never published are only offered to their editors and reviewers
+	templates := []Document{}
+	for _, t := range found {
+		if t.visibleTo(db, user) {
+			templates = append(templates, t)
+		}
+	}
+
+	return &templates, nil
+}
+
+// applyPlaceholders fills in the placeholders of a template body for a new document
+func applyPlaceholders(body template.HTML, user *User, folder *Folder) template.HTML {
+	now := time.Now()
+	folderName := ""
+	if folder != nil {
+		folderName = folder.Name
+	}
+
+	r := strings.NewReplacer(
+		placeholderDate, now.Format("2 January 2006"),
+		placeholderTime, now.Format("15:04"),
+		placeholderAuthor, template.HTMLEscapeString(user.Name),
+		placeholderFolder, template.HTMLEscapeString(folderName),
+	)
+
+	return template.HTML(r.Replace(string(body)))
+}
+
+// templateBody loads a template and returns its body ready to be used in a new document
+func templateBody(db *DB, idHex string, user *User, folder *Folder) (template.HTML, error) {
+	t, err := loadPage(db, idHex)
+	if err != nil {
+		return "", err
+	}
+
+	if !t.visibleTo(db, user) {
+		return "", nil
+	}
+
+	// a template that was never published only has its draft
+	var body template.HTML
+	if len(t.Body) == 0 {
+		body, err = t.draftBody()
+	} else {
+		body, err = t.decrypt()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return applyPlaceholders(body, user, folder), nil
+}
+
+// SeedTemplates creates the default document templates that don't exist yet.
+// It returns the number of templates that were created.
+func SeedTemplates(db *DB) (int, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(documentCol)
+	created := 0
+
+	for _, dt := range defaultTemplates {
+		count, err := collection.Find(bson.M{"template": true, "title": dt.title, "deleted": notDeleted}).Count()
+		if err != nil {
+			return created, err
+		}
+		if count > 0 {
+			continue
+		}
+
+		d := &Document{
+			ID:       bson.NewObjectId(),
+			Title:    dt.title,
+			Template: true,
+			Created:  time.Now(),
+			Edited:   time.Now(),
+		}
+
+		_, err = d.setContent(htmlToDelta(dt.body))
+		if err != nil {
+			return created, err
+		}
+
+		err = d.save(db)
+		if err != nil {
+			return created, err
+		}
+		indexDocument(db, d)
+		created++
+	}
+
+	return created, nil
+}
@@ -0,0 +1,764 @@
+package models
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/unrolled/render"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TrashItem represents a deleted document, folder or user in the trash
+type TrashItem struct {
+	Kind          string
+	ID            bson.ObjectId
+	Title         string
+	FolderID      bson.ObjectId
+	DeletedAt     time.Time
+	DeletedBy     bson.ObjectId
+	DeletedByName string
+}
+
+// notDeleted matches records that are not in the trash
+var notDeleted = bson.M{"$ne": true}
+
+// trashCols maps the kinds of items that can be deleted to their collections
+var trashCols = map[string]string{
+	"document": documentCol,
+	"folder":   col,
+	"user":     userCol,
+}
+
+// DocumentDeleteHandler moves a document into the trash
+func DocumentDeleteHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		d, err := loadPage(db, id)
+		if err != nil {
+			ErrorLogger.Print("Document not found for deletion. id: "+id, err)
+			s.AddFlash("Looks like something went wrong. If this error persists, please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		if !hasPermission(db, user, d.FolderID, "delete") {
+			InfoLogger.Print("User tried to delete document without permission: {userID: " + user.ID.Hex() + ", documentID: " + id + "}")
+			s.AddFlash("Sorry, but you don't have permission to delete this document", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		err = softDelete(db, documentCol, d.ID, user.ID)
+		if err != nil {
+			ErrorLogger.Print("Could not delete document {id: "+id+"} ", err)
+			s.AddFlash("Error! Could not delete document. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		unindexDocument(db, d.ID)
+		notifyDocument(db, d, EventDeleted, user, "")
+		recordDocumentChange(db, d, EventDeleted, user, "", "")
+
+		InfoLogger.Print("Document moved to trash {id: " + id + ", userID: " + user.ID.Hex() + "}")
+		s.AddFlash("\""+d.Title+"\" was moved to the trash", "success")
+		s.Save(r, w)
+
+		redir := "/"
+		if d.FolderID != "" {
+			redir = "/folder/view/" + d.FolderID.Hex()
+		}
+		http.Redirect(w, r, redir, http.StatusFound)
+	}
+}
+
+// FolderDeleteHandler moves a folder, and with it the documents inside it, into the trash
+func FolderDeleteHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		f, err := findFolder(db, id)
+		if err != nil {
+			ErrorLogger.Print("Folder not found for deletion. id: "+id, err)
+			s.AddFlash("Looks like something went wrong. If this error persists, please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/folders/", http.StatusFound)
+			return
+		}
+
+		if !hasPermission(db, user, f.ID, "delete") {
+			InfoLogger.Print("User tried to delete folder without permission: {userID: " + user.ID.Hex() + ", folderID: " + id + "}")
+			s.AddFlash("Sorry, but you don't have permission to delete this folder", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/folder/view/"+id, http.StatusFound)
+			return
+		}
+
+		err = softDelete(db, col, f.ID, user.ID)
+		if err != nil {
+			ErrorLogger.Print("Could not delete folder {id: "+id+"} ", err)
+			s.AddFlash("Error! Could not delete folder. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/folder/view/"+id, http.StatusFound)
+			return
+		}
+
+		// the documents go with the folder, so they can't be reached through search, links or favorites
+		ids, err := softDeleteFolderDocuments(db, f.ID, user.ID)
+		if err != nil {
+			ErrorLogger.Print("Could not delete documents of folder {id: "+id+"} ", err)
+			s.AddFlash("Error! Could not delete all documents of the folder. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/folders/", http.StatusFound)
+			return
+		}
+		for _, docID := range ids {
+			unindexDocument(db, docID)
+		}
+
+		notifyFolder(db, f, EventDeleted, user)
+		recordFolderChange(db, f, EventDeleted, user)
+
+		InfoLogger.Print("Folder moved to trash {id: " + id + ", userID: " + user.ID.Hex() + "}")
+		s.AddFlash("Folder \""+f.Name+"\" was moved to the trash", "success")
+		s.Save(r, w)
+		http.Redirect(w, r, "/folders/", http.StatusFound)
+	}
+}
+
+// UserDeleteHandler moves a user into the trash. Only admins may delete users.
+func UserDeleteHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		if !user.Admin || id == user.ID.Hex() {
+			InfoLogger.Print("User tried to delete a user without permission: {userID: " + user.ID.Hex() + ", deleteUserID: " + id + "}")
+			s.AddFlash("Sorry, but you can't delete this user", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/users/", http.StatusFound)
+			return
+		}
+
+		u, err := findUser(db, id)
+		if err != nil {
+			ErrorLogger.Print("User not found for deletion. id: "+id, err)
+			s.AddFlash("Looks like something went wrong. If this error persists, please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/users/", http.StatusFound)
+			return
+		}
+
+		err = softDelete(db, userCol, u.ID, user.ID)
+		if err != nil {
+			ErrorLogger.Print("Could not delete user {id: "+id+"} ", err)
+			s.AddFlash("Error! Could not delete user. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/users/", http.StatusFound)
+			return
+		}
+
+		InfoLogger.Print("User moved to trash {id: " + id + ", userID: " + user.ID.Hex() + "}")
+		s.AddFlash("User \""+u.Name+"\" was moved to the trash", "success")
+		s.Save(r, w)
+		http.Redirect(w, r, "/users/", http.StatusFound)
+	}
+}
+
+// TrashHandler lists the items in the trash.
+// Admins see everything, other users only see what they deleted themselves.
+func TrashHandler(db *DB, rend *render.Render, retentionDays int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		items, err := findTrash(db, user)
+		if err != nil {
+			ErrorLogger.Print("Error trying to find items in the trash.\n", err)
+			s.AddFlash("Looks like something went wrong. If this error persists, please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		data := map[string]interface{}{
+			"user":          user,
+			"items":         items,
+			"retentionDays": retentionDays,
+			"page":          "trash",
+		}
+
+		RenderTemplate(rend, w, r, "trash/index", data)
+	}
+}
+
+// TrashRestoreHandler moves an item out of the trash, back to where it was
+func TrashRestoreHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		kind := vars["kind"]
+		id := vars["id"]
+
+		item, err := findTrashItem(db, kind, id)
+		if err != nil {
+			ErrorLogger.Print("Trash item not found {kind: "+kind+", id: "+id+"} ", err)
+			s.AddFlash("That item is no longer in the trash", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/trash/", http.StatusFound)
+			return
+		}
+
+		if !user.Admin && item.DeletedBy != user.ID {
+			InfoLogger.Print("User tried to restore an item without permission: {userID: " + user.ID.Hex() + ", kind: " + kind + ", id: " + id + "}")
+			s.AddFlash("Sorry, but you don't have permission to restore that", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/trash/", http.StatusFound)
+			return
+		}
+
+		// a document can only go back to its folder once the folder itself has been restored
+		if kind == "document" && item.FolderID != "" {
+			if inTrash, _ := isInTrash(db, col, item.FolderID); inTrash {
+				s.AddFlash("The folder of \""+item.Title+"\" is also in the trash. Restore the folder first.", "warning")
+				s.Save(r, w)
+				http.Redirect(w, r, "/trash/", http.StatusFound)
+				return
+			}
+		}
+
+		err = restore(db, trashCols[kind], item.ID)
+		if err != nil {
+			ErrorLogger.Print("Could not restore item {kind: "+kind+", id: "+id+"} ", err)
+			s.AddFlash("Error! Could not restore that item. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/trash/", http.StatusFound)
+			return
+		}
+
+		switch kind {
+		case "document":
+			d, err := loadPage(db, id)
+			if err == nil {
+				indexDocument(db, d)
+			}
+		case "folder":
+			ids, err := restoreFolderDocuments(db, item.ID)
+			if err != nil {
+				ErrorLogger.Print("Could not restore documents of folder {id: "+id+"} ", err)
+				s.AddFlash("Error! Could not restore all documents of the folder. If this error persists please contact support", "danger")
+				s.Save(r, w)
+				http.Redirect(w, r, "/trash/", http.StatusFound)
+				return
+			}
+			for _, docID := range ids {
+				if d, err := loadPage(db, docID.Hex()); err == nil {
+					indexDocument(db, d)
+				}
+			}
+		}
+
+		InfoLogger.Print("Restored from trash {kind: " + kind + ", id: " + id + ", userID: " + user.ID.Hex() + "}")
+		s.AddFlash("\""+item.Title+"\" was restored", "success")
+		s.Save(r, w)
+		http.Redirect(w, r, "/trash/", http.StatusFound)
+	}
+}
+
+// TrashPurgeHandler permanently removes an item from the trash. Only admins may purge.
+func TrashPurgeHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		kind := vars["kind"]
+		id := vars["id"]
+
+		if !user.Admin {
+			InfoLogger.Print("User tried to purge an item without permission: {userID: " + user.ID.Hex() + ", kind: " + kind + ", id: " + id + "}")
+			s.AddFlash("Sorry, only admins can permanently delete items", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/trash/", http.StatusFound)
+			return
+		}
+
+		item, err := findTrashItem(db, kind, id)
+		if err != nil {
+			ErrorLogger.Print("Trash item not found {kind: "+kind+", id: "+id+"} ", err)
+			s.AddFlash("That item is no longer in the trash", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/trash/", http.StatusFound)
+			return
+		}
+
+		err = purge(db, item)
+		if err != nil {
+			ErrorLogger.Print("Could not purge item {kind: "+kind+", id: "+id+"} ", err)
+			s.AddFlash("Error! Could not permanently delete that item. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/trash/", http.StatusFound)
+			return
+		}
+
+		InfoLogger.Print("Purged from trash {kind: " + kind + ", id: " + id + ", userID: " + user.ID.Hex() + "}")
+		s.AddFlash("\""+item.Title+"\" was permanently deleted", "success")
+		s.Save(r, w)
+		http.Redirect(w, r, "/trash/", http.StatusFound)
+	}
+}
+
+// TrashPurger permanently removes items that have been in the trash for longer than retentionDays.
+// It checks once an hour and never returns, so run it in its own goroutine.
+func TrashPurger(db *DB, retentionDays int) {
+	if retentionDays <= 0 {
+		InfoLogger.Print("Trash retention is not set, deleted items will only be purged manually.")
+		return
+	}
+
+	for {
+		cutoff := time.Now().AddDate(0, 0, -retentionDays)
+		count, err := purgeOlderThan(db, cutoff)
+		if err != nil {
+			ErrorLogger.Print("Error purging old items from the trash.\n", err)
+		} else if count > 0 {
+			InfoLogger.Print("Purged " + strconv.Itoa(count) + " items older than " + strconv.Itoa(retentionDays) + " days from the trash")
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
+
+func softDelete(db *DB, colName string, id bson.ObjectId, userID bson.ObjectId) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(colName)
+
+	update := bson.M{"$set": bson.M{
+		"deleted":   true,
+		"deletedAt": time.Now(),
+		"deletedBy": userID,
+	}}
+
+	return collection.UpdateId(id, update)
+}
+
+func restore(db *DB, colName string, id bson.ObjectId) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(colName)
+
+	update := bson.M{"$unset": bson.M{
+		"deleted":           "",
+		"deletedAt":         "",
+		"deletedBy":         "",
+		"deletedWithFolder": "",
+	}}
+
+	return collection.UpdateId(id, update)
+}
+
+// softDeleteFolderDocuments moves the documents of a folder into the trash with it, and returns their ids.
+// Documents that were already in the trash stay there when the folder is restored.
+func softDeleteFolderDocuments(db *DB, folderID bson.ObjectId, userID bson.ObjectId) ([]bson.ObjectId, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(documentCol)
+
+	query := bson.M{"folderID": folderID, "deleted": notDeleted}
+	var docs []Document
+	err := collection.Find(query).Select(bson.M{"_id": 1}).All(&docs)
+	if err != nil {
+		return nil, err
+	}
+
+	update := bson.M{"$set": bson.M{
+		"deleted":           true,
+		"deletedAt":         time.Now(),
+		"deletedBy":         userID,
+		"deletedWithFolder": true,
+	}}
+	_, err = collection.UpdateAll(query, update)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]bson.ObjectId, len(docs))
+	for i, d := range docs {
+		ids[i] = d.ID
+	}
+
+	return ids, nil
+}
+
+// restoreFolderDocuments moves the documents that went into the trash with their folder back out, and returns their ids
+func restoreFolderDocuments(db *DB, folderID bson.ObjectId) ([]bson.ObjectId, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(documentCol)
+
+	query := bson.M{"folderID": folderID, "deleted": true, "deletedWithFolder": true}
+	var docs []Document
+	err := collection.Find(query).Select(bson.M{"_id": 1}).All(&docs)
+	if err != nil {
+		return nil, err
+	}
+
+	update := bson.M{"$unset": bson.M{
+		"deleted":           "",
+		"deletedAt":         "",
+		"deletedBy":         "",
+		"deletedWithFolder": "",
+	}}
+	_, err = collection.UpdateAll(query, update)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]bson.ObjectId, len(docs))
+	for i, d := range docs {
+		ids[i] = d.ID
+	}
+
+	return ids, nil
+}
+
+func isInTrash(db *DB, colName string, id bson.ObjectId) (bool, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(colName)
+
+	count, err := collection.Find(bson.M{"_id": id, "deleted": true}).Count()
+	return count > 0, err
+}
+
+// findTrash finds the items in the trash that the user is allowed to see, newest first
+func findTrash(db *DB, user *User) ([]TrashItem, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	var items []TrashItem
+
+	query := bson.M{"deleted": true}
+	if !user.Admin {
+		query["deletedBy"] = user.ID
+	}
+
+	// documents that went with their folder are listed as the folder
+	docQuery := bson.M{"deletedWithFolder": bson.M{"$ne": true}}
+	for k, v := range query {
+		docQuery[k] = v
+	}
+
+	var docs []Document
+	err := session.DB(db.name).C(documentCol).Find(docQuery).Select(bson.M{"body": 0}).All(&docs)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range docs {
+		items = append(items, TrashItem{"document", d.ID, d.DisplayTitle(), d.FolderID, d.DeletedAt, d.DeletedBy, ""})
+	}
+
+	var folders []Folder
+	err = session.DB(db.name).C(col).Find(query).All(&folders)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range folders {
+		items = append(items, TrashItem{"folder", f.ID, f.Name, "", f.DeletedAt, f.DeletedBy, ""})
+	}
+
+	if user.Admin {
+		var users []User
+		err = session.DB(db.name).C(userCol).Find(query).All(&users)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range users {
+			items = append(items, TrashItem{"user", u.ID, u.Name, "", u.DeletedAt, u.DeletedBy, ""})
+		}
+	}
+
+	// fill in who deleted each item
+	names := map[bson.ObjectId]string{}
+	for i := range items {
+		id := items[i].DeletedBy
+		if _, ok := names[id]; !ok {
+			names[id] = "Unknown"
+			if u, err := findUser(db, id.Hex()); err == nil {
+				names[id] = u.Name
+			}
+		}
+		items[i].DeletedByName = names[id]
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].DeletedAt.After(items[j].DeletedAt)
+	})
+
+	return items, nil
+}
+
+func findTrashItem(db *DB, kind string, idHex string) (*TrashItem, error) {
+	colName, ok := trashCols[kind]
+	if !ok || !bson.IsObjectIdHex(idHex) {
+		return nil, errors.New("Invalid trash item {kind: " + kind + ", id: " + idHex + "}")
+	}
+
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(colName)
+	query := bson.M{"_id": bson.ObjectIdHex(idHex), "deleted": true}
+	item := &TrashItem{Kind: kind}
+
+	switch kind {
+	case "document":
+		d := &Document{}
+		if err := collection.Find(query).Select(bson.M{"body": 0}).One(d); err != nil {
+			return nil, err
+		}
+		item.ID, item.Title, item.FolderID, item.DeletedAt, item.DeletedBy = d.ID, d.DisplayTitle(), d.FolderID, d.DeletedAt, d.DeletedBy
+	case "folder":
+		f := &Folder{}
+		if err := collection.Find(query).One(f); err != nil {
+			return nil, err
+		}
+		item.ID, item.Title, item.DeletedAt, item.DeletedBy = f.ID, f.Name, f.DeletedAt, f.DeletedBy
+	case "user":
+		u := &User{}
+		if err := collection.Find(query).One(u); err != nil {
+			return nil, err
+		}
+		item.ID, item.Title, item.DeletedAt, item.DeletedBy = u.ID, u.Name, u.DeletedAt, u.DeletedBy
+	}
+
+	return item, nil
+}
+
+// purge permanently removes an item along with everything that belongs to it
+func purge(db *DB, item *TrashItem) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	appDB := session.DB(db.name)
+
+	switch item.Kind {
+	case "document":
+		if err := purgeDocumentData(appDB, item.ID); err != nil {
+			return err
+		}
+	case "folder":
+		var docs []Document
+		err := appDB.C(documentCol).Find(bson.M{"folderID": item.ID}).Select(bson.M{"_id": 1}).All(&docs)
+		if err != nil {
+			return err
+		}
+		for _, d := range docs {
+			if err := purgeDocumentData(appDB, d.ID); err != nil {
+				return err
+			}
+		}
+		if _, err := appDB.C(documentCol).RemoveAll(bson.M{"folderID": item.ID}); err != nil {
+			return err
+		}
+		if _, err := appDB.C(permissionCol).RemoveAll(bson.M{"folderId": item.ID}); err != nil {
+			return err
+		}
+		if _, err := appDB.C(watchCol).RemoveAll(bson.M{"targetID": item.ID}); err != nil {
+			return err
+		}
+		if _, err := appDB.C(favoriteCol).RemoveAll(bson.M{"targetID": item.ID}); err != nil {
+			return err
+		}
+		if _, err := appDB.C(notificationCol).RemoveAll(bson.M{"folderID": item.ID}); err != nil {
+			return err
+		}
+		if _, err := appDB.C(changeCol).RemoveAll(bson.M{"folderID": item.ID}); err != nil {
+			return err
+		}
+	case "user":
+		if _, err := appDB.C(permissionCol).RemoveAll(bson.M{"userId": item.ID}); err != nil {
+			return err
+		}
+		if _, err := appDB.C(viewCol).RemoveAll(bson.M{"userID": item.ID}); err != nil {
+			return err
+		}
+		if _, err := appDB.C(savedSearchCol).RemoveAll(bson.M{"userID": item.ID}); err != nil {
+			return err
+		}
+		if _, err := appDB.C(watchCol).RemoveAll(bson.M{"userID": item.ID}); err != nil {
+			return err
+		}
+		if _, err := appDB.C(favoriteCol).RemoveAll(bson.M{"userID": item.ID}); err != nil {
+			return err
+		}
+		if _, err := appDB.C(notificationCol).RemoveAll(bson.M{"userID": item.ID}); err != nil {
+			return err
+		}
+		if _, err := appDB.C(ackCol).RemoveAll(bson.M{"userID": item.ID}); err != nil {
+			return err
+		}
+	}
+
+	return appDB.C(trashCols[item.Kind]).RemoveId(item.ID)
+}
+
+// purgeDocumentData removes everything that belongs to a document from the other collections
+func purgeDocumentData(appDB *mgo.Database, id bson.ObjectId) error {
+	if _, err := appDB.C(attachmentCol).RemoveAll(bson.M{"documentID": id}); err != nil {
+		return err
+	}
+	if _, err := appDB.C(threadCol).RemoveAll(bson.M{"documentID": id}); err != nil {
+		return err
+	}
+	if _, err := appDB.C(searchCol).RemoveAll(bson.M{"_id": id}); err != nil {
+		return err
+	}
+	if _, err := appDB.C(viewCol).RemoveAll(bson.M{"documentID": id}); err != nil {
+		return err
+	}
+	if _, err := appDB.C(shareCol).RemoveAll(bson.M{"documentID": id}); err != nil {
+		return err
+	}
+	if _, err := appDB.C(watchCol).RemoveAll(bson.M{"targetID": id}); err != nil {
+		return err
+	}
+	if _, err := appDB.C(favoriteCol).RemoveAll(bson.M{"targetID": id}); err != nil {
+		return err
+	}
+	if _, err := appDB.C(notificationCol).RemoveAll(bson.M{"documentID": id}); err != nil {
+		return err
+	}
+	if _, err := appDB.C(changeCol).RemoveAll(bson.M{"documentID": id}); err != nil {
+		return err
+	}
+	if _, err := appDB.C(ackCol).RemoveAll(bson.M{"documentID": id}); err != nil {
+		return err
+	}
+	if _, err := appDB.C(lockCol).RemoveAll(bson.M{"_id": id}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// purgeOlderThan purges every item that was deleted before cutoff
+func purgeOlderThan(db *DB, cutoff time.Time) (int, error) {
+	count := 0
+	for _, kind := range []string{"document", "folder", "user"} {
+		session := db.sess.Clone()
+		var records []struct {
+			ID bson.ObjectId `bson:"_id"`
+		}
+		query := bson.M{"deleted": true, "deletedAt": bson.M{"$lt": cutoff}}
+		err := session.DB(db.name).C(trashCols[kind]).Find(query).Select(bson.M{"_id": 1}).All(&records)
+		session.Close()
+		if err != nil {
+			return count, err
+		}
+
+		for _, rec := range records {
+			err = purge(db, &TrashItem{Kind: kind, ID: rec.ID})
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+
+	return count, nil
+}
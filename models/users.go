@@ -9,20 +9,31 @@ import (
 	"github.com/unrolled/render"
 
 	"strconv"
+	"time"
 
 	"golang.org/x/crypto/scrypt"
+	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
 // User defines a user in the system
 type User struct {
-	ID       bson.ObjectId `json:"id" bson:"_id"`
-	Name     string        `json:"name"`
-	Email    string        `json:"email"`
-	Level    int           `json:"level"`
-	Admin    bool          `json:"admin"`
-	Tech     bool          `json:"tech"`
-	Password []byte        `json:"-"`
+	ID        bson.ObjectId `json:"id" bson:"_id"`
+	Name      string        `json:"name"`
+	Email     string        `json:"email"`
+	Level     int           `json:"level"`
+	Admin     bool          `json:"admin"`
+	Tech      bool          `json:"tech"`
+	Password  []byte        `json:"-"`
+	Deleted   bool          `json:"deleted" bson:"deleted,omitempty"`
+	DeletedAt time.Time     `json:"deletedAt" bson:"deletedAt,omitempty"`
+	DeletedBy bson.ObjectId `json:"deletedBy" bson:"deletedBy,omitempty"`
+	// Digest is how often the user gets an email with the changes in the wiki, daily, weekly or never when empty
+	Digest      string    `json:"digest" bson:"digest,omitempty"`
+	DigestSent  time.Time `json:"-" bson:"digestSent,omitempty"`
+	DigestToken string    `json:"-" bson:"digestToken,omitempty"`
+	// CodeStyle is the colour scheme the user sees code blocks in, the default one when empty
+	CodeStyle string `json:"codeStyle" bson:"codeStyle,omitempty"`
 }
 
 const userCol = "users"
@@ -306,13 +317,24 @@ func getUserFromSession(s *sessions.Session) (user *User, ok bool) {
 	}, ok
 }
 
+// isDeletedUser checks if the user is in the trash or gone. Users are kept logged in when the database can't be reached.
+func isDeletedUser(db *DB, idHex string) bool {
+	u, err := findUser(db, idHex)
+	if err != nil && err != mgo.ErrNotFound && bson.IsObjectIdHex(idHex) {
+		ErrorLogger.Print("Could not check if user was deleted {id: "+idHex+"} ", err)
+		return false
+	}
+
+	return err != nil || u.Deleted
+}
+
 func findAllUsers(db *DB) (*[]User, error) {
 	session := db.sess.Clone()
 	defer session.Close()
 
 	collection := session.DB(db.name).C(userCol)
 	var users []User
-	err := collection.Find(nil).Sort("name").All(&users)
+	err := collection.Find(bson.M{"deleted": notDeleted}).Sort("name").All(&users)
 	if err != nil {
 		return nil, err
 	}
@@ -321,6 +343,10 @@ func findAllUsers(db *DB) (*[]User, error) {
 }
 
 func findUser(db *DB, idHex string) (*User, error) {
+	if !bson.IsObjectIdHex(idHex) {
+		return nil, errors.New("Invalid user id: " + idHex)
+	}
+
 	id := bson.ObjectIdHex(idHex)
 	session := db.sess.Clone()
 	defer session.Close()
@@ -335,15 +361,35 @@ func findUser(db *DB, idHex string) (*User, error) {
 	return u, nil
 }
 
-func findUsers(db *DB, ids *[]bson.ObjectId) (users *[]User, err error) {
+// FindUserByEmail finds a user that isn't in the trash by their email address
+func FindUserByEmail(db *DB, email string) (*User, error) {
 	session := db.sess.Clone()
 	defer session.Close()
 	collection := session.DB(db.name).C(userCol)
+	user := User{}
+
+	err := collection.Find(bson.M{"email": email, "deleted": notDeleted}).One(&user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func findUsers(db *DB, ids *[]bson.ObjectId) (*[]User, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(userCol)
+	users := &[]User{}
 
 	query := bson.M{"_id": bson.M{"$in": ids}}
-	err = collection.Find(query).Sort("name").All(users)
+	err := collection.Find(query).Sort("name").All(users)
 
-	return nil, err
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
 }
 
 func findNotUsers(db *DB, ids *[]bson.ObjectId) (*[]User, error) {
@@ -371,6 +417,7 @@ func (user *User) Authenticate(db *DB) (found bool, err error) {
 	err = collection.Find(bson.M{
 		"email":    user.Email,
 		"password": user.Password,
+		"deleted":  notDeleted,
 	}).One(&user)
 
 	found = user.ID.Hex() != ""
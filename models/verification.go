@@ -0,0 +1,404 @@
+package models
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/unrolled/render"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Verification keeps a document from going out of date: every IntervalDays its owner,
+// or anyone who may edit it, confirms that it is still accurate
+type Verification struct {
+	OwnerID        bson.ObjectId `json:"ownerID" bson:"ownerID,omitempty"`
+	IntervalDays   int           `json:"intervalDays" bson:"intervalDays"`
+	Due            time.Time     `json:"due" bson:"due,omitempty"`
+	VerifiedAt     time.Time     `json:"verifiedAt" bson:"verifiedAt,omitempty"`
+	VerifiedByID   bson.ObjectId `json:"verifiedByID" bson:"verifiedByID,omitempty"`
+	VerifiedByName string        `json:"verifiedByName" bson:"verifiedByName,omitempty"`
+	// Reminded is when the owner was last reminded, they are reminded once every time the document is due
+	Reminded time.Time `json:"-" bson:"reminded,omitempty"`
+}
+
+// ReviewInterval is one of the intervals documents can be reviewed at
+type ReviewInterval struct {
+	Days  int
+	Label string
+}
+
+// reviewIntervals are the intervals that can be chosen in the editor
+var reviewIntervals = []ReviewInterval{
+	{0, "Never"},
+	{30, "Every month"},
+	{90, "Every 3 months"},
+	{180, "Every 6 months"},
+	{365, "Every year"},
+}
+
+// isReviewInterval checks if the interval is one that can be chosen in the editor
+func isReviewInterval(days int) bool {
+	for _, interval := range reviewIntervals {
+		if interval.Days == days {
+			return true
+		}
+	}
+
+	return false
+}
+
+// VerificationItem is a document on the review dashboard
+type VerificationItem struct {
+	Document  *Document
+	OwnerName string
+	Folder    string
+	Overdue   bool
+	CanVerify bool
+}
+
+// VerificationGroup is the documents of one owner or folder on the review dashboard
+type VerificationGroup struct {
+	Name    string
+	Overdue int
+	Items   []VerificationItem
+}
+
+// reviewDueSoon is how far ahead the review dashboard looks for documents that are almost due
+const reviewDueSoon = 14 * 24 * time.Hour
+
+// VerifyHandler records that a document is still accurate
+func VerifyHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		redir := "/document/view/" + id
+		if r.FormValue("redirect") == "dashboard" {
+			redir = "/verification/"
+		}
+
+		d, err := loadPage(db, id)
+		if err != nil || !d.canVerify(db, user) {
+			InfoLogger.Print("User tried to verify document without permission: {userID: " + user.ID.Hex() + ", documentID: " + id + "}")
+			s.AddFlash("Sorry, but you can't confirm that this document is accurate", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, redir, http.StatusFound)
+			return
+		}
+
+		d.verify(user, time.Now())
+		err = d.saveVerification(db)
+		if err != nil {
+			ErrorLogger.Print("Could not verify document {id: "+id+"} ", err)
+			s.AddFlash("Error! Could not save your confirmation. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, redir, http.StatusFound)
+			return
+		}
+
+		InfoLogger.Print("Document verified {id: " + id + ", userID: " + user.ID.Hex() + "}")
+		msg := "Thanks! \"" + d.Title + "\" was marked as still accurate"
+		if d.Verification.IntervalDays > 0 {
+			msg += ", the next review is due on " + d.Verification.Due.Format("2 Jan 2006")
+		}
+		s.AddFlash(msg, "success")
+		s.Save(r, w)
+		http.Redirect(w, r, redir, http.StatusFound)
+	}
+}
+
+// VerificationHandler lists the documents that are due for a review, grouped by owner or by folder
+func VerificationHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		group := r.URL.Query().Get("group")
+		if group != "folder" {
+			group = "owner"
+		}
+		mine := r.URL.Query().Get("mine") != ""
+
+		now := time.Now()
+		docs, err := findVisibleDocs(db, user, bson.M{
+			"verification.intervalDays": bson.M{"$gt": 0},
+			"verification.due":          bson.M{"$lte": now.Add(reviewDueSoon)},
+		})
+		if err != nil {
+			ErrorLogger.Print("Could not find documents due for review {userID: "+user.ID.Hex()+"} ", err)
+			s.AddFlash("Looks like something went wrong. If this error persists, please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		names, err := findUserNames(db)
+		if err != nil {
+			ErrorLogger.Print("Could not find user names for the review dashboard ", err)
+			err = nil
+		}
+
+		folderNames := map[bson.ObjectId]string{}
+		if folders, err := findAllFolders(db); err == nil {
+			for _, f := range *folders {
+				folderNames[f.ID] = f.Name
+			}
+		}
+
+		groups := map[string]*VerificationGroup{}
+		var order []string
+		for i := range docs {
+			d := &docs[i]
+			owner := d.ownerID()
+			if mine && owner != user.ID {
+				continue
+			}
+
+			item := VerificationItem{
+				Document:  d,
+				OwnerName: names[owner],
+				Folder:    folderNames[d.FolderID],
+				Overdue:   d.Verification.Overdue(),
+				CanVerify: d.canVerify(db, user),
+			}
+			if item.OwnerName == "" {
+				item.OwnerName = "No owner"
+			}
+			if item.Folder == "" {
+				item.Folder = "No folder"
+			}
+
+			key := item.OwnerName
+			if group == "folder" {
+				key = item.Folder
+			}
+
+			g, ok := groups[key]
+			if !ok {
+				g = &VerificationGroup{Name: key}
+				groups[key] = g
+				order = append(order, key)
+			}
+			g.Items = append(g.Items, item)
+			if item.Overdue {
+				g.Overdue++
+			}
+		}
+
+		// the groups with the most overdue documents come first
+		sort.Slice(order, func(i, j int) bool {
+			a, b := groups[order[i]], groups[order[j]]
+			if a.Overdue != b.Overdue {
+				return a.Overdue > b.Overdue
+			}
+			return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+		})
+
+		result := make([]VerificationGroup, 0, len(order))
+		for _, key := range order {
+			g := groups[key]
+			sort.SliceStable(g.Items, func(i, j int) bool {
+				return g.Items[i].Document.Verification.Due.Before(g.Items[j].Document.Verification.Due)
+			})
+			result = append(result, *g)
+		}
+
+		data := map[string]interface{}{
+			"user":   user,
+			"groups": result,
+			"group":  group,
+			"mine":   mine,
+			"page":   "verification",
+		}
+
+		RenderTemplate(rend, w, r, "document/verification", data)
+	}
+}
+
+// VerificationReminder notifies the owners of documents that are due for a review.
+// It checks once an hour and never returns, so run it in its own goroutine.
+func VerificationReminder(db *DB) {
+	for {
+		count, err := remindOwners(db, time.Now())
+		if err != nil {
+			ErrorLogger.Print("Error reminding owners of documents due for review.\n", err)
+		} else if count > 0 {
+			InfoLogger.Print("Reminded owners of " + strconv.Itoa(count) + " documents due for review")
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
+
+// remindOwners notifies the owner of every document that became due since they were last reminded,
+// and returns the number of documents they were reminded of
+func remindOwners(db *DB, now time.Time) (int, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(documentCol)
+
+	var due []Document
+	err := collection.Find(bson.M{
+		"verification.intervalDays": bson.M{"$gt": 0},
+		"verification.due":          bson.M{"$lte": now},
+		"deleted":                   notDeleted,
+	}).Select(bson.M{"body": 0, "delta": 0, "draft.body": 0, "draft.delta": 0}).All(&due)
+	if err != nil {
+		return 0, err
+	}
+
+	reminded := 0
+	for i := range due {
+		d := &due[i]
+		if !d.Verification.Reminded.Before(d.Verification.Due) {
+			continue
+		}
+
+		owner, err := findUser(db, d.ownerID().Hex())
+		if err == nil && !owner.Deleted && d.visibleTo(db, owner) {
+			notifyUser(db, owner, &Notification{
+				Event:      EventDue,
+				DocumentID: d.ID,
+				FolderID:   d.FolderID,
+				Title:      d.Title,
+				Detail:     ", it was last confirmed " + d.Verification.lastConfirmed(),
+			})
+			reminded++
+		}
+
+		// owners that can't be reminded still show up on the dashboard
+		err = collection.UpdateId(d.ID, bson.M{"$set": bson.M{"verification.reminded": now}})
+		if err != nil {
+			return reminded, err
+		}
+	}
+
+	return reminded, nil
+}
+
+// Overdue checks if the document should have been reviewed already
+func (v *Verification) Overdue() bool {
+	return v.IntervalDays > 0 && !v.Due.After(time.Now())
+}
+
+// lastConfirmed describes when the document was last confirmed, for reminders
+func (v *Verification) lastConfirmed() string {
+	if v.VerifiedAt.IsZero() {
+		return "never"
+	}
+
+	return "on " + v.VerifiedAt.Format("2 Jan 2006") + " by " + v.VerifiedByName
+}
+
+// ownerID is the user responsible for keeping the document accurate, its author unless someone else owns it
+func (d *Document) ownerID() bson.ObjectId {
+	if d.Verification != nil && d.Verification.OwnerID != "" {
+		return d.Verification.OwnerID
+	}
+
+	return d.AuthorID
+}
+
+// pendingVerification is the owner and review interval the document will have once its draft is published
+func (d *Document) pendingVerification() *Verification {
+	if d.Draft != nil && d.Draft.Verification != nil {
+		return d.Draft.Verification
+	}
+
+	return d.Verification
+}
+
+// canVerify checks if the user may confirm that the document is still accurate
+func (d *Document) canVerify(db *DB, user *User) bool {
+	if user.Tech || !d.visibleTo(db, user) || !d.isPublished() {
+		return false
+	}
+
+	return d.ownerID() == user.ID || d.canEdit(db, user) || d.canReview(db, user)
+}
+
+// setVerification changes the owner and review interval of the document.
+// The first review is due an interval after it was last confirmed, or after now if it never was.
+func (d *Document) setVerification(ownerID bson.ObjectId, days int, now time.Time) {
+	if d.Verification == nil {
+		if ownerID == "" && days <= 0 {
+			return
+		}
+		d.Verification = &Verification{}
+	}
+
+	v := d.Verification
+	v.OwnerID = ownerID
+	if days == v.IntervalDays {
+		return
+	}
+
+	v.IntervalDays = days
+	v.Due = time.Time{}
+	if days > 0 {
+		since := v.VerifiedAt
+		if since.IsZero() {
+			since = now
+		}
+		v.Due = since.AddDate(0, 0, days)
+	}
+}
+
+// verify records that the user confirmed the document is still accurate, and when the next review is due
+func (d *Document) verify(user *User, now time.Time) {
+	if d.Verification == nil {
+		d.Verification = &Verification{}
+	}
+
+	v := d.Verification
+	v.VerifiedAt = now
+	v.VerifiedByID = user.ID
+	v.VerifiedByName = user.Name
+	v.Reminded = time.Time{}
+	if v.IntervalDays > 0 {
+		v.Due = now.AddDate(0, 0, v.IntervalDays)
+	}
+}
+
+// saveVerification stores the verification of the document without touching its content
+func (d *Document) saveVerification(db *DB) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(documentCol)
+
+	return collection.UpdateId(d.ID, bson.M{"$set": bson.M{"verification": d.Verification}})
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// View records when a user last looked at a document, and when they last edited it
+type View struct {
+	ID         bson.ObjectId `json:"id" bson:"_id"`
+	UserID     bson.ObjectId `json:"userID" bson:"userID"`
+	DocumentID bson.ObjectId `json:"documentID" bson:"documentID"`
+	Viewed     time.Time     `json:"viewed"`
+	Edited     time.Time     `json:"edited" bson:"edited,omitempty"`
+}
+
+const viewCol = "views"
+
+// maxRecentViews is the number of recently viewed documents that are looked at
+const maxRecentViews = 20
+
+// recordView remembers that the user just looked at the document
+func recordView(db *DB, userID bson.ObjectId, docID bson.ObjectId) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(viewCol)
+
+	_, err := collection.Upsert(
+		bson.M{"userID": userID, "documentID": docID},
+		bson.M{
+			"$set":         bson.M{"viewed": time.Now()},
+			"$setOnInsert": bson.M{"_id": bson.NewObjectId()},
+		},
+	)
+	return err
+}
+
+// recordEdit remembers that the user just saved the document, which counts as looking at it too
+func recordEdit(db *DB, userID bson.ObjectId, docID bson.ObjectId) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(viewCol)
+
+	now := time.Now()
+	_, err := collection.Upsert(
+		bson.M{"userID": userID, "documentID": docID},
+		bson.M{
+			"$set":         bson.M{"viewed": now, "edited": now},
+			"$setOnInsert": bson.M{"_id": bson.NewObjectId()},
+		},
+	)
+	return err
+}
+
+// findRecentViews finds the documents the user looked at last, most recent first
+func findRecentViews(db *DB, userID bson.ObjectId) ([]View, error) {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(viewCol)
+
+	var views []View
+	err := collection.Find(bson.M{"userID": userID}).Sort("-viewed").Limit(maxRecentViews).All(&views)
+	return views, err
+}
@@ -0,0 +1,320 @@
+package models
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// wikiLinkPrefix marks links to other wiki pages in converted wikitext, until they are pointed at the imported documents
+const wikiLinkPrefix = "wiki:"
+
+var (
+	wikiHeading    = regexp.MustCompile(`^(={1,6})\s*(.*?)\s*(={1,6})\s*$`)
+	wikiList       = regexp.MustCompile(`^([*#:;]+)\s*(.*)$`)
+	wikiInternal   = regexp.MustCompile(`\[\[([^\]|]+)(?:\|([^\]]*))?\]\]([a-z]*)`)
+	wikiExternal   = regexp.MustCompile(`\[((?:https?|ftp|mailto):[^\s\]]+)(?:\s+([^\]]*))?\]`)
+	wikiBareURL    = regexp.MustCompile(`(^|[\s(])((?:https?|ftp)://[^\s<>\[\]"']+)`)
+	wikiTemplate   = regexp.MustCompile(`\{\{[^{}]*\}\}`)
+	wikiComment    = regexp.MustCompile(`(?s)<!--.*?-->`)
+	wikiRef        = regexp.MustCompile(`(?s)<ref[^>/]*/>|<ref[^>]*>(.*?)</ref>`)
+	wikiNowiki     = regexp.MustCompile(`(?s)<nowiki>(.*?)</nowiki>`)
+	wikiSkipTags   = regexp.MustCompile(`(?i)</?(references|gallery|noinclude|includeonly|onlyinclude)[^>]*>`)
+	wikiBoldItalic = regexp.MustCompile(`'''''(.+?)'''''`)
+	wikiBold       = regexp.MustCompile(`'''(.+?)'''`)
+	wikiItalic     = regexp.MustCompile(`''(.+?)''`)
+	wikiNowikiMark = regexp.MustCompile("\x00(\\d+)\x00")
+)
+
+// wikiResult is the HTML converted from a wiki page, with what couldn't be converted
+type wikiResult struct {
+	html       string
+	categories []string
+	files      []string
+	templates  int
+}
+
+// wikitextToHTML converts MediaWiki markup to HTML that htmlToDelta understands.
+// Links to other pages point to wikiLinkPrefix and the page title, categories are returned to become tags,
+// and templates and files, which the dump has no content for, are left out and counted.
+func wikitextToHTML(text string) *wikiResult {
+	res := &wikiResult{}
+
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	text = wikiComment.ReplaceAllString(text, "")
+
+	// nowiki content is kept exactly as it is, so it is set aside before anything else is converted
+	var nowiki []string
+	text = wikiNowiki.ReplaceAllStringFunc(text, func(m string) string {
+		nowiki = append(nowiki, html.EscapeString(wikiNowiki.FindStringSubmatch(m)[1]))
+		return "\x00" + strconv.Itoa(len(nowiki)-1) + "\x00"
+	})
+
+	// templates can be nested, so they are removed from the inside out
+	for wikiTemplate.MatchString(text) {
+		text = wikiTemplate.ReplaceAllStringFunc(text, func(string) string {
+			res.templates++
+			return ""
+		})
+	}
+
+	// references become notes in brackets where they are used
+	text = wikiRef.ReplaceAllStringFunc(text, func(m string) string {
+		note := strings.TrimSpace(wikiRef.FindStringSubmatch(m)[1])
+		if note == "" {
+			return ""
+		}
+		return " (" + note + ")"
+	})
+	text = wikiSkipTags.ReplaceAllString(text, "")
+
+	c := &wikiConverter{res: res}
+	for _, line := range strings.Split(text, "\n") {
+		c.line(line)
+	}
+	c.flush()
+
+	out := c.out.String()
+	out = wikiNowikiMark.ReplaceAllStringFunc(out, func(m string) string {
+		i, _ := strconv.Atoi(wikiNowikiMark.FindStringSubmatch(m)[1])
+		return nowiki[i]
+	})
+	res.html = out
+
+	return res
+}
+
+// wikiConverter turns wikitext into HTML a line at a time
+type wikiConverter struct {
+	res   *wikiResult
+	out   strings.Builder
+	para  []string
+	pre   []string
+	inPre bool
+	table []string
+	inTab bool
+}
+
+func (c *wikiConverter) line(line string) {
+	trimmed := strings.TrimSpace(line)
+
+	if c.inPre {
+		if i := strings.Index(line, "</pre>"); i >= 0 {
+			c.pre = append(c.pre, line[:i])
+			c.inPre = false
+			c.flushPre()
+			return
+		}
+		c.pre = append(c.pre, line)
+		return
+	}
+
+	if strings.HasPrefix(trimmed, "<pre") {
+		c.flush()
+		rest := trimmed[strings.Index(trimmed, ">")+1:]
+		if i := strings.Index(rest, "</pre>"); i >= 0 {
+			c.pre = []string{rest[:i]}
+			c.flushPre()
+			return
+		}
+		c.inPre = true
+		if rest != "" {
+			c.pre = []string{rest}
+		}
+		return
+	}
+
+	// tables have no equivalent in documents, so each row becomes a line with its cells separated
+	if c.inTab || strings.HasPrefix(trimmed, "{|") {
+		c.tableLine(trimmed)
+		return
+	}
+
+	// a line starting with a space is preformatted
+	if strings.HasPrefix(line, " ") && trimmed != "" {
+		c.flushPara()
+		c.pre = append(c.pre, line[1:])
+		return
+	}
+	c.flushPre()
+
+	switch {
+	case trimmed == "":
+		c.flush()
+	case strings.HasPrefix(trimmed, "----"):
+		c.flush()
+	case wikiHeading.MatchString(trimmed):
+		c.flush()
+		m := wikiHeading.FindStringSubmatch(trimmed)
+		level := minInt(len(m[1]), len(m[3]))
+		tag := "h" + strconv.Itoa(level)
+		c.out.WriteString("<" + tag + ">" + c.inline(m[2]) + "</" + tag + ">")
+	case wikiList.MatchString(trimmed):
+		c.flushPara()
+		m := wikiList.FindStringSubmatch(trimmed)
+		c.listItem(m[1], m[2])
+	default:
+		c.para = append(c.para, trimmed)
+	}
+}
+
+// listItem writes a list item, with nesting shown as Quill indents
+func (c *wikiConverter) listItem(markers string, content string) {
+	indent := ""
+	if len(markers) > 1 {
+		indent = ` class="ql-indent-` + strconv.Itoa(minInt(len(markers)-1, 8)) + `"`
+	}
+
+	switch markers[len(markers)-1] {
+	case '*':
+		c.out.WriteString("<ul><li" + indent + ">" + c.inline(content) + "</li></ul>")
+	case '#':
+		c.out.WriteString("<ol><li" + indent + ">" + c.inline(content) + "</li></ol>")
+	case ';':
+		// a definition term, possibly followed by its definition on the same line
+		term, def := content, ""
+		if i := strings.Index(content, ":"); i >= 0 {
+			term, def = content[:i], strings.TrimSpace(content[i+1:])
+		}
+		c.out.WriteString("<p" + indent + "><strong>" + c.inline(term) + "</strong></p>")
+		if def != "" {
+			c.out.WriteString(`<p class="ql-indent-` + strconv.Itoa(minInt(len(markers), 8)) + `">` + c.inline(def) + "</p>")
+		}
+	default:
+		// a colon indents the line
+		c.out.WriteString(`<p class="ql-indent-` + strconv.Itoa(minInt(len(markers), 8)) + `">` + c.inline(content) + "</p>")
+	}
+}
+
+func (c *wikiConverter) tableLine(line string) {
+	switch {
+	case strings.HasPrefix(line, "{|"):
+		c.flush()
+		c.inTab = true
+		c.table = nil
+	case strings.HasPrefix(line, "|}"):
+		c.flushRow()
+		c.inTab = false
+	case strings.HasPrefix(line, "|-"):
+		c.flushRow()
+	case strings.HasPrefix(line, "|+"):
+		c.out.WriteString("<p><em>" + c.inline(strings.TrimSpace(line[2:])) + "</em></p>")
+	case strings.HasPrefix(line, "|"), strings.HasPrefix(line, "!"):
+		sep := "||"
+		if line[0] == '!' {
+			sep = "!!"
+		}
+		for _, cell := range strings.Split(line[1:], sep) {
+			// drop cell attributes like style="..." | content
+			if i := strings.Index(cell, "|"); i >= 0 && !strings.Contains(cell[:i], "[[") {
+				cell = cell[i+1:]
+			}
+			cell = c.inline(strings.TrimSpace(cell))
+			if line[0] == '!' {
+				cell = "<strong>" + cell + "</strong>"
+			}
+			c.table = append(c.table, cell)
+		}
+	default:
+		// a cell continuing on the next line
+		if n := len(c.table); n > 0 {
+			c.table[n-1] += " " + c.inline(line)
+		}
+	}
+}
+
+func (c *wikiConverter) flushRow() {
+	if len(c.table) > 0 {
+		c.out.WriteString("<p>" + strings.Join(c.table, " | ") + "</p>")
+	}
+	c.table = nil
+}
+
+func (c *wikiConverter) flushPara() {
+	if len(c.para) > 0 {
+		c.out.WriteString("<p>" + c.inline(strings.Join(c.para, " ")) + "</p>")
+	}
+	c.para = nil
+}
+
+func (c *wikiConverter) flushPre() {
+	if len(c.pre) > 0 {
+		c.out.WriteString(`<pre class="ql-syntax">` + html.EscapeString(strings.Join(c.pre, "\n")) + "</pre>")
+	}
+	c.pre = nil
+}
+
+func (c *wikiConverter) flush() {
+	c.flushPara()
+	c.flushPre()
+	if c.inTab {
+		c.flushRow()
+		c.inTab = false
+	}
+}
+
+// inline converts links and bold and italic text
+func (c *wikiConverter) inline(text string) string {
+	text = wikiInternal.ReplaceAllStringFunc(text, func(m string) string {
+		parts := wikiInternal.FindStringSubmatch(m)
+		target, label, suffix := strings.TrimSpace(parts[1]), parts[2], parts[3]
+
+		ns := ""
+		if i := strings.Index(target, ":"); i > 0 {
+			ns = strings.ToLower(strings.TrimSpace(target[:i]))
+		}
+		switch ns {
+		case "category":
+			c.res.categories = append(c.res.categories, strings.TrimSpace(target[strings.Index(target, ":")+1:]))
+			return ""
+		case "file", "image", "media":
+			c.res.files = append(c.res.files, strings.TrimSpace(target[strings.Index(target, ":")+1:]))
+			return ""
+		}
+
+		if label == "" {
+			label = target
+		}
+		// links to a section of a page go to the page
+		if i := strings.Index(target, "#"); i >= 0 {
+			target = target[:i]
+		}
+		if target == "" {
+			return label + suffix
+		}
+
+		return `<a href="` + html.EscapeString(wikiLinkPrefix+target) + `">` + label + suffix + "</a>"
+	})
+
+	text = wikiExternal.ReplaceAllStringFunc(text, func(m string) string {
+		parts := wikiExternal.FindStringSubmatch(m)
+		label := parts[2]
+		if label == "" {
+			label = parts[1]
+		}
+		return `<a href="` + html.EscapeString(parts[1]) + `">` + label + "</a>"
+	})
+
+	text = wikiBareURL.ReplaceAllStringFunc(text, func(m string) string {
+		parts := wikiBareURL.FindStringSubmatch(m)
+		return parts[1] + `<a href="` + html.EscapeString(parts[2]) + `">` + parts[2] + "</a>"
+	})
+
+	text = wikiBoldItalic.ReplaceAllString(text, "<strong><em>$1</em></strong>")
+	text = wikiBold.ReplaceAllString(text, "<strong>$1</strong>")
+	text = wikiItalic.ReplaceAllString(text, "<em>$1</em>")
+
+	return text
+}
+
+// wikiTitle normalises a page title the way MediaWiki does, so links find their pages
+func wikiTitle(title string) string {
+	title = strings.Join(strings.Fields(strings.Replace(title, "_", " ", -1)), " ")
+	if title == "" {
+		return ""
+	}
+
+	runes := []rune(title)
+	return strings.ToUpper(string(runes[0])) + string(runes[1:])
+}
@@ -0,0 +1,529 @@
+package models
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/unrolled/render"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Document statuses
+const (
+	StatusDraft     = "draft"
+	StatusReview    = "review"
+	StatusPublished = "published"
+	StatusArchived  = "archived"
+)
+
+// Review decisions
+const (
+	ReviewApproved = "approved"
+	ReviewChanges  = "changes"
+)
+
+// Draft holds the changes to a document that haven't been published yet.
+// While a draft is being worked on, the published title and body of the document stay readable.
+type Draft struct {
+	Title    string        `json:"title"`
+	Body     []byte        `json:"body"`
+	Delta    []byte        `json:"-" bson:"delta,omitempty"`
+	Status   string        `json:"status"`
+	AuthorID bson.ObjectId `json:"authorID" bson:"authorID"`
+	Edited   time.Time     `json:"edited"`
+	Reviews  []Review      `json:"reviews" bson:"reviews,omitempty"`
+	// Summary describes the changes in the draft, for the digest emails
+	Summary string `json:"summary" bson:"summary,omitempty"`
+	// ContributorIDs are everyone who saved the draft, they become contributors of the document when it is published
+	ContributorIDs []bson.ObjectId `json:"contributorIDs" bson:"contributorIDs,omitempty"`
+	// Verification holds the owner and review interval chosen in the draft, they replace the document's when it is published
+	Verification *Verification `json:"verification" bson:"verification,omitempty"`
+	// Tags replace the document's tags when it is published. Drafts from before tags were kept in the draft have none.
+	Tags []string `json:"tags" bson:"tags"`
+}
+
+// Review is a reviewer's decision on a draft
+type Review struct {
+	ReviewerID   bson.ObjectId `json:"reviewerID" bson:"reviewerID"`
+	ReviewerName string        `json:"reviewerName" bson:"reviewerName"`
+	Decision     string        `json:"decision"`
+	Comment      string        `json:"comment"`
+	Created      time.Time     `json:"created"`
+}
+
+// ReviewHandler shows a draft that is waiting for review next to the published version
+func ReviewHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		d, err := loadPage(db, id)
+		if err != nil || d.Draft == nil {
+			s.AddFlash("There is no draft waiting for review on that document", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/reviews/", http.StatusFound)
+			return
+		}
+
+		if !d.canReview(db, user) {
+			InfoLogger.Print("User tried to review a document without permission: {userID: " + user.ID.Hex() + ", documentID: " + id + "}")
+			s.AddFlash("Sorry, but you are not a reviewer for this document", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		var published template.HTML
+		if d.isPublished() {
+			published, err = d.decrypt()
+			if err != nil {
+				ErrorLogger.Print("Could not decrypt published body of document id: "+id, err)
+				err = nil
+			}
+		}
+
+		draft, err := d.draftBody()
+		if err != nil {
+			ErrorLogger.Print("Could not decrypt draft of document id: "+id, err)
+			err = nil
+		}
+
+		author, err := findUser(db, d.Draft.AuthorID.Hex())
+		if err != nil {
+			author = &User{Name: "Unknown"}
+			err = nil
+		}
+
+		data := map[string]interface{}{
+			"user":      user,
+			"document":  d,
+			"published": published,
+			"draft":     draft,
+			"author":    author,
+		}
+
+		RenderTemplate(rend, w, r, "document/review", data)
+	}
+}
+
+// ReviewSaveHandler records a reviewer's decision on a draft.
+// Approving publishes the draft, requesting changes sends it back to its author.
+func ReviewSaveHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		d, err := loadPage(db, id)
+		if err != nil || d.Draft == nil || d.Draft.Status != StatusReview {
+			s.AddFlash("There is no draft waiting for review on that document", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/reviews/", http.StatusFound)
+			return
+		}
+
+		if !d.canReview(db, user) {
+			InfoLogger.Print("User tried to review a document without permission: {userID: " + user.ID.Hex() + ", documentID: " + id + "}")
+			s.AddFlash("Sorry, but you are not a reviewer for this document", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		r.ParseForm()
+		decision := r.FormValue("decision")
+		comment := r.FormValue("comment")
+
+		if decision != ReviewApproved && decision != ReviewChanges {
+			s.AddFlash("Please approve the draft or request changes", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/review/"+id, http.StatusFound)
+			return
+		}
+
+		if decision == ReviewChanges && comment == "" {
+			s.AddFlash("Please describe the changes you'd like to see", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/review/"+id, http.StatusFound)
+			return
+		}
+
+		d.Draft.Reviews = append(d.Draft.Reviews, Review{
+			ReviewerID:   user.ID,
+			ReviewerName: user.Name,
+			Decision:     decision,
+			Comment:      comment,
+			Created:      time.Now(),
+		})
+
+		summary := d.Draft.Summary
+		if decision == ReviewApproved {
+			d.publish()
+		} else {
+			d.Draft.Status = StatusDraft
+			d.Status = StatusDraft
+		}
+
+		err = d.saveRevision(db, d.Revision)
+		if err == errConflict {
+			s.AddFlash("The draft was changed while you were reviewing it. Please review the latest version.", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/review/"+id, http.StatusFound)
+			return
+		}
+		if err != nil {
+			ErrorLogger.Print("Could not save review of document id: "+id, err)
+			s.AddFlash("Error! Could not save your review. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/review/"+id, http.StatusFound)
+			return
+		}
+
+		indexDocument(db, d)
+		if decision == ReviewApproved {
+			notifyDocument(db, d, EventPublished, user, "")
+			recordDocumentChange(db, d, EventPublished, user, "", summary)
+		}
+
+		InfoLogger.Print("Document reviewed {id: " + id + ", decision: " + decision + ", userID: " + user.ID.Hex() + "}")
+		if decision == ReviewApproved {
+			s.AddFlash("The draft was approved and published", "success")
+		} else {
+			s.AddFlash("Changes were requested from the author", "success")
+		}
+		s.Save(r, w)
+		http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+	}
+}
+
+// ArchiveHandler archives a published document, or brings an archived document back
+func ArchiveHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		d, err := loadPage(db, id)
+		if err != nil {
+			ErrorLogger.Print("Document not found for archiving. id: "+id, err)
+			s.AddFlash("Looks like something went wrong. If this error persists, please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		if !d.canReview(db, user) {
+			InfoLogger.Print("User tried to archive a document without permission: {userID: " + user.ID.Hex() + ", documentID: " + id + "}")
+			s.AddFlash("Sorry, but you don't have permission to archive this document", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		status := StatusArchived
+		if d.Status == StatusArchived {
+			status = StatusPublished
+		} else if d.Draft != nil || !d.isPublished() {
+			s.AddFlash("Only published documents without a pending draft can be archived", "warning")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		err = d.setStatus(db, status)
+		if err != nil {
+			ErrorLogger.Print("Could not change status of document id: "+id, err)
+			s.AddFlash("Error! Could not change the document status. If this error persists please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+			return
+		}
+
+		InfoLogger.Print("Document status changed {id: " + id + ", status: " + status + ", userID: " + user.ID.Hex() + "}")
+		s.AddFlash("The document is now "+status, "success")
+		s.Save(r, w)
+		http.Redirect(w, r, "/document/view/"+id, http.StatusFound)
+	}
+}
+
+// ReviewsHandler lists the drafts waiting for the user's review
+func ReviewsHandler(db *DB, rend *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the user session from the context.
+		ctx := r.Context()
+		s, ok := ctx.Value(sessKey).(*sessions.Session)
+		if !ok {
+			err := errors.New("Error retrieving the session from context.\n")
+			ErrorLogger.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		user, ok := getUserFromSession(s)
+		if !ok {
+			return
+		}
+
+		session := db.sess.Clone()
+		defer session.Close()
+		collection := session.DB(db.name).C(documentCol)
+
+		var pending []Document
+		query := bson.M{"draft.status": StatusReview, "deleted": notDeleted}
+		err := collection.Find(query).Select(bson.M{"body": 0, "draft.body": 0}).Sort("draft.edited").All(&pending)
+		if err != nil {
+			ErrorLogger.Print("Error trying to find documents waiting for review.\n", err)
+			s.AddFlash("Looks like something went wrong. If this error persists, please contact support", "danger")
+			s.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		var documents []Document
+		for i := range pending {
+			if pending[i].canReview(db, user) {
+				documents = append(documents, pending[i])
+			}
+		}
+
+		data := map[string]interface{}{
+			"user":      user,
+			"documents": documents,
+			"page":      "reviews",
+		}
+
+		RenderTemplate(rend, w, r, "document/reviews", data)
+	}
+}
+
+// isPublished checks if the document has a published version that readers can see.
+// Documents from before the review workflow have no status and count as published.
+func (d *Document) isPublished() bool {
+	return d.Status == "" || d.Status == StatusPublished || d.Status == StatusArchived || !d.Published.IsZero()
+}
+
+// canEdit checks if the user may work on drafts of the document
+func (d *Document) canEdit(db *DB, user *User) bool {
+	if d.Draft != nil && d.Draft.AuthorID == user.ID {
+		return true
+	}
+
+	return hasPermission(db, user, d.FolderID, "write")
+}
+
+// canReview checks if the user may approve drafts of the document and publish them.
+// Reviewers are set on the document's folder. Admins may review any document.
+func (d *Document) canReview(db *DB, user *User) bool {
+	if user.Admin {
+		return true
+	}
+
+	if d.FolderID == "" {
+		return false
+	}
+
+	f, err := findFolder(db, d.FolderID.Hex())
+	if err != nil {
+		return false
+	}
+
+	for _, id := range f.ReviewerIDs {
+		if id == user.ID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// visibleTo checks if the user may see the document in listings and open it
+func (d *Document) visibleTo(db *DB, user *User) bool {
+	if user.Level < d.Level && !isDocumentUser(d, user) {
+		return false
+	}
+
+	return d.isPublished() || d.canEdit(db, user) || d.canReview(db, user)
+}
+
+// DisplayTitle returns the title readers see in listings.
+// A document that was never published is listed under the title of its draft.
+func (d *Document) DisplayTitle() string {
+	if d.searchesDraft() {
+		return d.Draft.Title
+	}
+
+	return d.Title
+}
+
+// draftBody decrypts the body of the document's draft
+func (d *Document) draftBody() (template.HTML, error) {
+	if d.Draft == nil {
+		return "", nil
+	}
+
+	plaintext, err := decryptBytes(d.Draft.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return template.HTML(plaintext), nil
+}
+
+// workingCopy returns the title and body that editors should continue working on
+func (d *Document) workingCopy() (string, template.HTML, error) {
+	if d.Draft != nil {
+		body, err := d.draftBody()
+		return d.Draft.Title, body, err
+	}
+
+	body, err := d.decrypt()
+	return d.Title, body, err
+}
+
+// saveDraft stores new content in the document's draft without touching the published version.
+// The Delta is kept as the source of truth, and the body is rendered from it and returned.
+func (d *Document) saveDraft(title string, delta *Delta, author bson.ObjectId) (template.HTML, error) {
+	body := renderDelta(delta)
+	ciphertext, err := encryptBytes([]byte(body))
+	if err != nil {
+		return "", err
+	}
+
+	deltaCiphertext, err := encryptDelta(delta)
+	if err != nil {
+		return "", err
+	}
+
+	if d.Draft == nil {
+		d.Draft = &Draft{Tags: d.Tags}
+	}
+
+	// documents from before the review workflow only count as published while they have no status,
+	// so their published date is stamped before the draft status would hide them from readers
+	if d.Published.IsZero() && d.isPublished() && len(d.Body) > 0 {
+		d.Published = d.Edited
+		if d.Published.IsZero() {
+			d.Published = d.Created
+		}
+	}
+
+	d.Draft.Title = title
+	d.Draft.Body = ciphertext
+	d.Draft.Delta = deltaCiphertext
+	d.Draft.AuthorID = author
+	d.Draft.ContributorIDs = appendID(d.Draft.ContributorIDs, author)
+	d.Draft.Edited = time.Now()
+	d.Draft.Status = StatusDraft
+	d.Status = StatusDraft
+
+	return body, nil
+}
+
+// pendingTags are the tags the document will have once its draft is published
+func (d *Document) pendingTags() []string {
+	if d.Draft != nil && d.Draft.Tags != nil {
+		return d.Draft.Tags
+	}
+
+	return d.Tags
+}
+
+// requestReview marks the draft as ready for review
+func (d *Document) requestReview() {
+	if d.Draft == nil {
+		return
+	}
+
+	d.Draft.Status = StatusReview
+	d.Status = StatusReview
+}
+
+// publish replaces the published version of the document with its draft
+func (d *Document) publish() {
+	if d.Draft == nil {
+		return
+	}
+
+	d.Title = d.Draft.Title
+	d.Body = d.Draft.Body
+	d.Delta = d.Draft.Delta
+	d.Edited = d.Draft.Edited
+	d.EditorID = d.Draft.AuthorID
+	for _, id := range d.Draft.ContributorIDs {
+		d.ContributorIDs = appendID(d.ContributorIDs, id)
+	}
+	d.ContributorIDs = appendID(d.ContributorIDs, d.Draft.AuthorID)
+	if d.Draft.Tags != nil {
+		d.Tags = d.Draft.Tags
+	}
+	now := time.Now()
+	if v := d.Draft.Verification; v != nil {
+		d.setVerification(v.OwnerID, v.IntervalDays, now)
+	}
+	d.Published = now
+	d.Version++
+	d.Status = StatusPublished
+	d.Draft = nil
+}
+
+func (d *Document) setStatus(db *DB, status string) error {
+	session := db.sess.Clone()
+	defer session.Close()
+	collection := session.DB(db.name).C(documentCol)
+
+	err := collection.UpdateId(d.ID, bson.M{"$set": bson.M{"status": status}})
+	if err != nil {
+		return err
+	}
+
+	d.Status = status
+	return nil
+}
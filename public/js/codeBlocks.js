@@ -0,0 +1,72 @@
+"use strict";
+// Shows the code blocks of the read-only `quill` viewer highlighted by the server,
+// numbers their lines and adds a button to copy them.
+
+// codeHighlighter returns the highlight function for Quill's syntax module.
+// Blocks are looked up by their text, anything the server didn't highlight is shown as it is.
+function codeHighlighter(blocks) {
+  const highlighted = new Map(blocks.map(b => [b.text, b.html]));
+  const escape = text => text.replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;');
+
+  return text => highlighted.get(text) || escape(text);
+}
+
+document.addEventListener('DOMContentLoaded', () => {
+  const pres = quill.root.querySelectorAll('pre.ql-syntax');
+  if (pres.length === 0) {
+    return;
+  }
+
+  // the numbers are an attribute shown by CSS, so they aren't part of the document or copied with it
+  pres.forEach(pre => {
+    let count = pre.textContent.replace(/\n$/, '').split('\n').length;
+    let numbers = [];
+    for (let i = 1; i <= count; i++) {
+      numbers.push(i);
+    }
+    pre.setAttribute('data-line-numbers', numbers.join('\n'));
+  });
+
+  // one copy button follows the mouse from block to block, the blocks themselves belong to Quill
+  const btnCopy = document.createElement('button');
+  btnCopy.type = 'button';
+  btnCopy.className = 'copy-code';
+  btnCopy.textContent = 'Copy';
+  btnCopy.hidden = true;
+  document.body.appendChild(btnCopy);
+
+  let current = null;
+  pres.forEach(pre => {
+    pre.addEventListener('mouseenter', () => {
+      current = pre;
+      let rect = pre.getBoundingClientRect();
+      btnCopy.style.top = (window.scrollY + rect.top + 4) + 'px';
+      btnCopy.style.left = (window.scrollX + rect.right - btnCopy.offsetWidth - 4) + 'px';
+      btnCopy.textContent = 'Copy';
+      btnCopy.hidden = false;
+      btnCopy.style.left = (window.scrollX + rect.right - btnCopy.offsetWidth - 4) + 'px';
+    });
+    pre.addEventListener('mouseleave', evt => {
+      if (evt.relatedTarget !== btnCopy) {
+        btnCopy.hidden = true;
+      }
+    });
+  });
+
+  btnCopy.addEventListener('mouseleave', evt => {
+    if (evt.relatedTarget !== current) {
+      btnCopy.hidden = true;
+    }
+  });
+
+  btnCopy.addEventListener('click', () => {
+    if (!current) {
+      return;
+    }
+    navigator.clipboard.writeText(current.textContent.replace(/\n$/, '')).then(() => {
+      btnCopy.textContent = 'Copied';
+    }, () => {
+      btnCopy.textContent = 'Copy failed';
+    });
+  });
+});
@@ -0,0 +1,72 @@
+"use strict";
+// Lets code blocks carry the language they are written in, so the server can highlight them.
+// Load it after Quill and before the editor is created; it expects the global `quill` editor
+// once the page has loaded, and the language select #slcCodeLanguage.
+(function() {
+  const CodeBlock = Quill.import('formats/code-block');
+
+  class LanguageCodeBlock extends CodeBlock {
+    static create(value) {
+      let node = super.create(value);
+      if (typeof value === 'string' && value) {
+        node.setAttribute('data-language', value);
+      }
+      return node;
+    }
+
+    static formats(node) {
+      return node.getAttribute('data-language') || true;
+    }
+
+    // Quill ignores formatting a code block as code again, which is how its language changes
+    format(name, value) {
+      if (name === this.statics.blotName && value) {
+        if (typeof value === 'string') {
+          this.domNode.setAttribute('data-language', value);
+        } else {
+          this.domNode.removeAttribute('data-language');
+        }
+        return;
+      }
+      super.format(name, value);
+    }
+  }
+  Quill.register(LanguageCodeBlock, true);
+
+  document.addEventListener('DOMContentLoaded', () => {
+    const divCodeLanguage = document.getElementById('divCodeLanguage');
+    const slcCodeLanguage = document.getElementById('slcCodeLanguage');
+    if (!slcCodeLanguage) {
+      return;
+    }
+
+    // the code block the cursor is in, if any
+    let current = () => {
+      let range = quill.getSelection();
+      if (!range) {
+        return null;
+      }
+      let [line] = quill.scroll.line(range.index);
+      return line instanceof LanguageCodeBlock ? line : null;
+    };
+
+    quill.on('editor-change', () => {
+      let block = current();
+      if (block) {
+        slcCodeLanguage.value = block.domNode.getAttribute('data-language') || '';
+        divCodeLanguage.hidden = false;
+      } else if (document.activeElement !== slcCodeLanguage) {
+        divCodeLanguage.hidden = true;
+      }
+    });
+
+    slcCodeLanguage.addEventListener('change', () => {
+      let range = quill.getSelection(true);
+      let [block] = quill.scroll.line(range.index);
+      if (!(block instanceof LanguageCodeBlock)) {
+        return;
+      }
+      quill.formatLine(block.offset(quill.scroll), block.length(), 'code-block', slcCodeLanguage.value || true, 'user');
+    });
+  });
+})();
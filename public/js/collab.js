@@ -0,0 +1,229 @@
+"use strict";
+// Real-time collaborative editing. Sends the editor's changes to the server, applies everyone
+// else's changes, and shows who else is editing and where their cursors are.
+// Expects the global `quill` editor and the `frmContent` edit form to already exist.
+(function() {
+  const documentID = frmContent.getAttribute('data-document-id');
+  if (!documentID || !window.WebSocket) {
+    return;
+  }
+
+  const Delta = Quill.import('delta');
+  const hdnRevision = document.getElementById('hdnRevision');
+  const divCollab = document.getElementById('divCollab');
+  const spnPeers = document.getElementById('spnPeers');
+  const spnCollabStatus = document.getElementById('spnCollabStatus');
+
+  const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
+  const socket = new WebSocket(protocol + '//' + window.location.host + '/document/collab/' + documentID);
+
+  // version is the last server version this editor has seen. A change that was sent but not
+  // acknowledged yet is outstanding; changes made while waiting are collected in buffer.
+  let version = 0;
+  let ready = false;
+  let outstanding = null;
+  let buffer = null;
+  const peers = {};
+
+  function send(msg) {
+    if (socket.readyState === WebSocket.OPEN) {
+      socket.send(JSON.stringify(msg));
+    }
+  }
+
+  function setStatus(text) {
+    spnCollabStatus.textContent = text;
+    divCollab.hidden = false;
+  }
+
+  function sendCursor() {
+    let range = quill.getSelection();
+    if (ready && range) {
+      send({ type: 'cursor', range: range });
+    }
+  }
+
+  function renderPeers() {
+    spnPeers.innerHTML = '';
+    Object.keys(peers).forEach(id => {
+      let span = document.createElement('span');
+      span.className = 'collab-peer';
+      span.style.color = peers[id].color;
+      span.textContent = peers[id].name;
+      spnPeers.appendChild(span);
+    });
+    setStatus(Object.keys(peers).length ? 'Also editing:' : 'Nobody else is editing right now.');
+  }
+
+  function renderCursor(peer) {
+    if (!peer.range) {
+      return;
+    }
+
+    if (!peer.el) {
+      peer.el = document.createElement('div');
+      peer.el.className = 'collab-cursor';
+      peer.el.style.backgroundColor = peer.color;
+      let label = document.createElement('span');
+      label.textContent = peer.name;
+      label.style.backgroundColor = peer.color;
+      peer.el.appendChild(label);
+      quill.container.appendChild(peer.el);
+    }
+
+    let index = Math.min(peer.range.index, quill.getLength() - 1);
+    let bounds = quill.getBounds(index);
+    peer.el.style.left = bounds.left + 'px';
+    peer.el.style.top = bounds.top + 'px';
+    peer.el.style.height = bounds.height + 'px';
+  }
+
+  // keep the other editors' cursors in place when the text before them changes
+  function shiftCursors(delta, exceptID) {
+    Object.keys(peers).forEach(id => {
+      let peer = peers[id];
+      if (id !== exceptID && peer.range) {
+        peer.range.index = delta.transformPosition(peer.range.index);
+      }
+      renderCursor(peer);
+    });
+  }
+
+  function addPeer(client) {
+    peers[client.id] = { name: client.name, color: client.color, range: null, el: null };
+  }
+
+  function removePeer(id) {
+    if (peers[id] && peers[id].el) {
+      peers[id].el.remove();
+    }
+    delete peers[id];
+  }
+
+  const handlers = {
+    init(msg) {
+      if (!msg.seeded) {
+        // the document has no stored Delta yet, start the session with this editor's content
+        send({ type: 'seed', revision: parseInt(hdnRevision.value, 10) || 0, delta: quill.getContents() });
+        return;
+      }
+
+      quill.setContents(new Delta(msg.delta.ops), 'api');
+      hdnRevision.value = msg.revision || 0;
+      version = msg.version;
+      outstanding = null;
+      buffer = null;
+      Object.keys(peers).forEach(removePeer);
+      (msg.peers || []).forEach(addPeer);
+      renderPeers();
+      ready = true;
+      quill.enable();
+      sendCursor();
+    },
+
+    ack(msg) {
+      version = msg.version;
+      if (buffer) {
+        outstanding = buffer;
+        buffer = null;
+        send({ type: 'op', version: version, delta: outstanding });
+      } else {
+        outstanding = null;
+      }
+    },
+
+    op(msg) {
+      version = msg.version;
+
+      // the server applied this change before ours, so it goes first
+      let change = new Delta(msg.delta.ops);
+      if (outstanding) {
+        let next = change.transform(outstanding, true);
+        change = outstanding.transform(change, false);
+        outstanding = next;
+      }
+      if (buffer) {
+        let next = change.transform(buffer, true);
+        change = buffer.transform(change, false);
+        buffer = next;
+      }
+
+      quill.updateContents(change, 'api');
+      shiftCursors(change, null);
+    },
+
+    join(msg) {
+      addPeer(msg.client);
+      renderPeers();
+      sendCursor();
+    },
+
+    leave(msg) {
+      removePeer(msg.clientID);
+      renderPeers();
+    },
+
+    cursor(msg) {
+      let peer = peers[msg.clientID];
+      if (peer) {
+        peer.range = msg.range;
+        renderCursor(peer);
+      }
+    },
+
+    saved(msg) {
+      hdnRevision.value = msg.revision || 0;
+      renderPeers();
+    },
+
+    stale(msg) {
+      setStatus(msg.message);
+    },
+
+    error(msg) {
+      setStatus(msg.message + ' Reload the page to continue editing together.');
+      ready = false;
+      socket.close();
+    }
+  };
+
+  // wait for the session's content before allowing changes
+  socket.addEventListener('open', () => quill.disable());
+
+  socket.addEventListener('message', evt => {
+    let msg = JSON.parse(evt.data);
+    if (handlers[msg.type]) {
+      handlers[msg.type](msg);
+    }
+  });
+
+  socket.addEventListener('close', () => {
+    if (ready) {
+      setStatus('Disconnected from the editing session. Your changes are only kept when you save.');
+    }
+    ready = false;
+    quill.enable();
+  });
+
+  quill.on('text-change', (delta, oldDelta, source) => {
+    if (!ready || source !== 'user') {
+      return;
+    }
+
+    if (outstanding) {
+      buffer = buffer ? buffer.compose(delta) : delta;
+    } else {
+      outstanding = delta;
+      send({ type: 'op', version: version, delta: outstanding });
+    }
+
+    shiftCursors(delta, null);
+    sendCursor();
+  });
+
+  quill.on('selection-change', (range, oldRange, source) => {
+    if (range && source === 'user') {
+      sendCursor();
+    }
+  });
+})();
@@ -0,0 +1,57 @@
+"use strict";
+// Lets readers comment on a selected range of the document, and highlights the ranges
+// that open discussions are about. Expects the global read-only `quill` viewer.
+(function() {
+  const highlight = '#fff3b0';
+  const hdnIndex = document.getElementById('hdnIndex');
+  const hdnLength = document.getElementById('hdnLength');
+  const hdnQuote = document.getElementById('hdnQuote');
+  const pSelection = document.getElementById('pSelection');
+  const qSelection = document.getElementById('qSelection');
+  const lnkWholeDocument = document.getElementById('lnkWholeDocument');
+
+  quill.on('selection-change', range => {
+    if (!range || range.length === 0) {
+      return;
+    }
+
+    hdnIndex.value = range.index;
+    hdnLength.value = range.length;
+    hdnQuote.value = quill.getText(range.index, range.length);
+    qSelection.textContent = hdnQuote.value;
+    pSelection.hidden = false;
+  });
+
+  lnkWholeDocument.addEventListener('click', evt => {
+    evt.preventDefault();
+    hdnIndex.value = hdnLength.value = hdnQuote.value = '';
+    pSelection.hidden = true;
+  });
+
+  // the document may have changed since the comment, so look for the quoted text
+  // where it was first, then anywhere else in the document
+  const text = quill.getText();
+  document.querySelectorAll('.thread[data-quote]').forEach(thread => {
+    let quote = thread.getAttribute('data-quote');
+    if (!quote) {
+      return;
+    }
+
+    let index = parseInt(thread.getAttribute('data-index'), 10);
+    if (text.substr(index, quote.length) !== quote) {
+      index = text.indexOf(quote);
+    }
+
+    let blockquote = thread.querySelector('.thread-quote');
+    if (index < 0) {
+      blockquote.title = 'This text is no longer in the document';
+      blockquote.classList.add('thread-quote-missing');
+      return;
+    }
+
+    if (!thread.classList.contains('thread-resolved')) {
+      quill.formatText(index, quote.length, 'background', highlight, 'api');
+    }
+    blockquote.addEventListener('click', () => quill.setSelection(index, quote.length, 'api'));
+  });
+})();
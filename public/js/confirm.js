@@ -0,0 +1,10 @@
+"use strict";
+// Asks for confirmation before submitting any form with the "confirm" class.
+// The question is taken from the form's data-confirm attribute.
+document.querySelectorAll('form.confirm').forEach(form => {
+  form.addEventListener('submit', evt => {
+    if (!window.confirm(form.getAttribute('data-confirm') || 'Are you sure?')) {
+      evt.preventDefault();
+    }
+  });
+});
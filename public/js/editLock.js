@@ -0,0 +1,52 @@
+"use strict";
+// Keeps the edit lock on the document alive while the editor is open,
+// and shows who else is editing when someone else holds the lock.
+
+const lockInterval = 30 * 1000;
+const lockDocumentID = document.getElementById('frmContent').getAttribute('data-document-id');
+const divLock = document.getElementById('divLock');
+const spnLock = document.getElementById('spnLock');
+
+function heartbeat() {
+  return fetch('/document/lock/' + lockDocumentID, {
+    method: 'POST',
+    credentials: 'same-origin'
+  }).then(res => {
+    if (!res.ok) {
+      throw new Error(res.statusText);
+    }
+    return res.json();
+  }).then(lock => {
+    if (lock.held) {
+      divLock.hidden = true;
+    } else {
+      spnLock.textContent = lock.holder + ' has been editing this document since ' +
+        new Date(lock.started).toLocaleString() + '. Your changes may conflict with theirs.';
+      divLock.hidden = false;
+    }
+  }).catch(err => {
+    console.error('Could not refresh the edit lock:', err);
+  });
+}
+
+function releaseLock() {
+  if (!lockDocumentID) {
+    return Promise.resolve();
+  }
+
+  let data = new FormData();
+  data.append('release', '1');
+
+  return fetch('/document/lock/' + lockDocumentID, {
+    method: 'POST',
+    body: data,
+    credentials: 'same-origin'
+  }).catch(err => {
+    console.error('Could not release the edit lock:', err);
+  });
+}
+
+// new documents can't be locked until they are saved
+if (lockDocumentID) {
+  setInterval(heartbeat, lockInterval);
+}
@@ -0,0 +1,97 @@
+"use strict";
+// Uploads images pasted, dropped or picked in the Quill editor as attachments,
+// so that documents reference them by ID instead of embedding base64 data.
+// Expects the global `quill` editor to already be initialised.
+
+function uploadImage(file) {
+  let data = new FormData();
+  data.append('image', file);
+  data.append('document-id', frmContent.getAttribute('data-document-id'));
+
+  return fetch('/attachment/upload', {
+    method: 'POST',
+    body: data,
+    credentials: 'same-origin'
+  }).then(res => {
+    if (!res.ok) {
+      return res.text().then(text => { throw new Error(text); });
+    }
+    return res.json();
+  });
+}
+
+function insertImages(files, index) {
+  Array.from(files)
+    .filter(file => file.type.startsWith('image/'))
+    .forEach(file => {
+      uploadImage(file).then(attachment => {
+        quill.insertEmbed(index, 'image', attachment.url, 'user');
+        quill.setSelection(index + 1, 0, 'silent');
+      }).catch(err => {
+        alert('Could not upload image: ' + err.message);
+      });
+    });
+}
+
+function dataURIToBlob(uri) {
+  let parts = uri.split(',');
+  let type = parts[0].split(':')[1].split(';')[0];
+  let bytes = atob(parts[1]);
+  let buffer = new Uint8Array(bytes.length);
+  for (let i = 0; i < bytes.length; i++) {
+    buffer[i] = bytes.charCodeAt(i);
+  }
+  return new Blob([buffer], { type: type });
+}
+
+function hasImageFiles(transfer) {
+  return transfer && Array.from(transfer.files || []).some(file => file.type.startsWith('image/'));
+}
+
+quill.root.addEventListener('paste', evt => {
+  if (!hasImageFiles(evt.clipboardData)) {
+    return;
+  }
+  evt.preventDefault();
+  evt.stopPropagation();
+  let range = quill.getSelection(true);
+  insertImages(evt.clipboardData.files, range.index);
+}, true);
+
+quill.root.addEventListener('drop', evt => {
+  if (!hasImageFiles(evt.dataTransfer)) {
+    return;
+  }
+  evt.preventDefault();
+  evt.stopPropagation();
+  let range = quill.getSelection(true);
+  insertImages(evt.dataTransfer.files, range ? range.index : quill.getLength());
+}, true);
+
+// the toolbar image button uploads the picked file instead of inlining it
+quill.getModule('toolbar').addHandler('image', () => {
+  let input = document.createElement('input');
+  input.type = 'file';
+  input.accept = 'image/*';
+  input.addEventListener('change', () => {
+    let range = quill.getSelection(true);
+    insertImages(input.files, range.index);
+  });
+  input.click();
+});
+
+// anything that still slipped in as a data URI (e.g. pasted HTML) is uploaded and swapped out
+quill.on('text-change', (delta, oldDelta, source) => {
+  if (source !== 'user') {
+    return;
+  }
+  quill.root.querySelectorAll('img[src^="data:"]').forEach(img => {
+    let uri = img.getAttribute('src');
+    img.setAttribute('src', '');
+    uploadImage(dataURIToBlob(uri)).then(attachment => {
+      img.setAttribute('src', attachment.url);
+    }).catch(() => {
+      img.setAttribute('src', uri);
+    });
+  });
+});
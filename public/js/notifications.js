@@ -0,0 +1,69 @@
+"use strict";
+// Notification center: shows the number of unread notifications in the navigation, and the latest ones in a menu.
+(function() {
+  let lnkNotifications = document.getElementById('lnkNotifications');
+  let spnUnread = document.getElementById('spnUnread');
+  let divNotifications = document.getElementById('divNotifications');
+  let ulNotifications = document.getElementById('ulNotifications');
+  let btnNotificationsRead = document.getElementById('btnNotificationsRead');
+  if (!lnkNotifications) {
+    return;
+  }
+
+  function load() {
+    fetch('/notifications/recent', {credentials: 'same-origin'})
+      .then(res => res.ok ? res.json() : null)
+      .then(found => {
+        if (found) {
+          show(found);
+        }
+      });
+  }
+
+  function show(found) {
+    spnUnread.hidden = found.unread === 0;
+    spnUnread.textContent = found.unread;
+
+    ulNotifications.innerHTML = '';
+    if (found.notifications.length === 0) {
+      let li = document.createElement('li');
+      li.textContent = 'No notifications yet';
+      ulNotifications.appendChild(li);
+    }
+    found.notifications.forEach(n => {
+      let li = document.createElement('li');
+      li.classList.toggle('unread', !n.read);
+      let a = document.createElement('a');
+      a.href = n.url;
+      a.textContent = n.message;
+      li.appendChild(a);
+      let small = document.createElement('small');
+      small.textContent = new Date(n.created).toLocaleString();
+      li.appendChild(small);
+      ulNotifications.appendChild(li);
+    });
+  }
+
+  lnkNotifications.addEventListener('click', evt => {
+    evt.preventDefault();
+    divNotifications.hidden = !divNotifications.hidden;
+    if (!divNotifications.hidden) {
+      load();
+    }
+  });
+
+  btnNotificationsRead.addEventListener('click', () => {
+    fetch('/notifications/read', {method: 'POST', credentials: 'same-origin', headers: {'X-Requested-With': 'fetch'}})
+      .then(load);
+  });
+
+  // clicking anywhere else closes the menu
+  document.addEventListener('click', evt => {
+    if (!divNotifications.hidden && !divNotifications.parentNode.contains(evt.target)) {
+      divNotifications.hidden = true;
+    }
+  });
+
+  load();
+  setInterval(load, 60000);
+})();
@@ -0,0 +1,132 @@
+"use strict";
+// Quick switcher: Ctrl+K (or Cmd+K) opens a box that jumps to a document or folder by its title.
+(function() {
+  let divSwitcher = document.getElementById('divSwitcher');
+  let txtSwitcher = document.getElementById('txtSwitcher');
+  let ulSwitcher = document.getElementById('ulSwitcher');
+  if (!divSwitcher) {
+    return;
+  }
+
+  let items = [];
+  let active = 0;
+  let request = 0;
+  let timer = null;
+
+  function open() {
+    divSwitcher.hidden = false;
+    txtSwitcher.value = '';
+    txtSwitcher.focus();
+    load();
+  }
+
+  function close() {
+    divSwitcher.hidden = true;
+  }
+
+  function load() {
+    let id = ++request;
+    fetch('/switcher?q=' + encodeURIComponent(txtSwitcher.value), {credentials: 'same-origin'})
+      .then(res => res.ok ? res.json() : [])
+      .then(found => {
+        // ignore answers to older keystrokes
+        if (id === request) {
+          items = found;
+          active = 0;
+          show();
+        }
+      });
+  }
+
+  // highlight the matched characters of a title
+  function title(item) {
+    let span = document.createElement('span');
+    let positions = new Set(item.positions);
+    Array.from(item.title).forEach((c, i) => {
+      if (positions.has(i)) {
+        let b = document.createElement('strong');
+        b.textContent = c;
+        span.appendChild(b);
+      } else {
+        span.appendChild(document.createTextNode(c));
+      }
+    });
+    return span;
+  }
+
+  function show() {
+    ulSwitcher.innerHTML = '';
+    items.forEach((item, i) => {
+      let li = document.createElement('li');
+      li.classList.toggle('active', i === active);
+      li.appendChild(title(item));
+
+      let details = item.kind === 'folder' ? 'Folder' : item.folder || '';
+      if (item.recent) {
+        details += details ? ', viewed recently' : 'Viewed recently';
+      }
+      if (details) {
+        let small = document.createElement('small');
+        small.textContent = details;
+        li.appendChild(small);
+      }
+
+      li.addEventListener('mousedown', evt => {
+        evt.preventDefault();
+        go(i);
+      });
+      ulSwitcher.appendChild(li);
+    });
+  }
+
+  function go(i) {
+    if (items[i]) {
+      window.location = items[i].url;
+    }
+  }
+
+  document.addEventListener('keydown', evt => {
+    if ((evt.ctrlKey || evt.metaKey) && evt.key.toLowerCase() === 'k') {
+      evt.preventDefault();
+      if (divSwitcher.hidden) {
+        open();
+      } else {
+        close();
+      }
+    }
+  });
+
+  txtSwitcher.addEventListener('input', () => {
+    clearTimeout(timer);
+    timer = setTimeout(load, 150);
+  });
+
+  txtSwitcher.addEventListener('keydown', evt => {
+    switch (evt.key) {
+      case 'ArrowDown':
+        evt.preventDefault();
+        active = Math.min(active + 1, items.length - 1);
+        show();
+        break;
+      case 'ArrowUp':
+        evt.preventDefault();
+        active = Math.max(active - 1, 0);
+        show();
+        break;
+      case 'Enter':
+        evt.preventDefault();
+        go(active);
+        break;
+      case 'Escape':
+        close();
+        break;
+    }
+  });
+
+  // clicking outside the box closes it
+  divSwitcher.addEventListener('mousedown', evt => {
+    if (evt.target === divSwitcher) {
+      close();
+    }
+  });
+})();
@@ -0,0 +1,107 @@
+"use strict";
+// Suggests existing tags for the tag being typed in the comma separated tag input.
+(function() {
+  let txtTags = document.getElementById('txtTags');
+  let ulSuggestions = document.getElementById('ulTagSuggestions');
+  if (!txtTags || !ulSuggestions) {
+    return;
+  }
+
+  let active = -1;
+  let request = 0;
+
+  // the tag being typed is the text after the last comma
+  function currentTag() {
+    let parts = txtTags.value.split(',');
+    return parts[parts.length - 1].trim();
+  }
+
+  function hide() {
+    ulSuggestions.hidden = true;
+    ulSuggestions.innerHTML = '';
+    active = -1;
+  }
+
+  function choose(tag) {
+    let parts = txtTags.value.split(',');
+    parts[parts.length - 1] = ' ' + tag;
+    txtTags.value = parts.join(',').replace(/^\s+/, '') + ', ';
+    hide();
+    txtTags.focus();
+  }
+
+  function highlight(index) {
+    let items = ulSuggestions.querySelectorAll('li');
+    if (items.length === 0) {
+      return;
+    }
+    active = (index + items.length) % items.length;
+    items.forEach((li, i) => li.classList.toggle('active', i === active));
+  }
+
+  function show(tags) {
+    let typed = txtTags.value.split(',').map(t => t.trim());
+    tags = tags.filter(t => typed.indexOf(t) === -1);
+    hide();
+    if (tags.length === 0) {
+      return;
+    }
+    tags.forEach(tag => {
+      let li = document.createElement('li');
+      li.textContent = tag;
+      // mousedown fires before the input loses focus
+      li.addEventListener('mousedown', evt => {
+        evt.preventDefault();
+        choose(tag);
+      });
+      ulSuggestions.appendChild(li);
+    });
+    ulSuggestions.hidden = false;
+  }
+
+  txtTags.addEventListener('input', () => {
+    let tag = currentTag();
+    if (tag === '') {
+      hide();
+      return;
+    }
+    let id = ++request;
+    fetch('/tags/suggest?q=' + encodeURIComponent(tag), {credentials: 'same-origin'})
+      .then(res => res.ok ? res.json() : [])
+      .then(tags => {
+        // ignore answers to older keystrokes
+        if (id === request) {
+          show(tags);
+        }
+      })
+      .catch(hide);
+  });
+
+  txtTags.addEventListener('keydown', evt => {
+    if (ulSuggestions.hidden) {
+      return;
+    }
+    switch (evt.key) {
+      case 'ArrowDown':
+        evt.preventDefault();
+        highlight(active + 1);
+        break;
+      case 'ArrowUp':
+        evt.preventDefault();
+        highlight(active - 1);
+        break;
+      case 'Enter':
+      case 'Tab':
+        if (active >= 0) {
+          evt.preventDefault();
+          choose(ulSuggestions.querySelectorAll('li')[active].textContent);
+        }
+        break;
+      case 'Escape':
+        hide();
+        break;
+    }
+  });
+
+  txtTags.addEventListener('blur', hide);
+})();
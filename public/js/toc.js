@@ -0,0 +1,37 @@
+"use strict";
+// Puts the anchors of the table of contents back on the headings of the read-only `quill` viewer,
+// which drops them when it renders the document, and copies links to sections.
+(function() {
+  const navTOC = document.getElementById('navTOC');
+  if (!navTOC) {
+    return;
+  }
+
+  // the server skips empty headings, so skip them here too to keep both lists in step
+  const headings = Array.from(quill.root.querySelectorAll('h1, h2, h3, h4, h5, h6'))
+    .filter(h => h.textContent.trim() !== '');
+  navTOC.querySelectorAll('.toc-link').forEach((link, i) => {
+    if (headings[i]) {
+      headings[i].id = link.getAttribute('data-anchor');
+    }
+  });
+
+  // the browser looked for the anchor before the headings had their ids
+  if (window.location.hash) {
+    let target = document.getElementById(decodeURIComponent(window.location.hash.substr(1)));
+    if (target) {
+      target.scrollIntoView();
+    }
+  }
+
+  navTOC.querySelectorAll('.copy-link').forEach(button => {
+    button.addEventListener('click', () => {
+      let url = window.location.origin + window.location.pathname + '#' + button.getAttribute('data-anchor');
+      navigator.clipboard.writeText(url).then(() => {
+        button.title = 'Link copied';
+      }, () => {
+        window.prompt('Copy the link to this section:', url);
+      });
+    });
+  });
+})();